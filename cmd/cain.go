@@ -6,7 +6,10 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/nuvo/cain/pkg/cain"
 	"github.com/nuvo/cain/pkg/utils"
@@ -33,25 +36,69 @@ func NewRootCmd(args []string) *cobra.Command {
 	cmd.AddCommand(NewBackupCmd(out))
 	cmd.AddCommand(NewRestoreCmd(out))
 	cmd.AddCommand(NewSchemaCmd(out))
+	cmd.AddCommand(NewVerifyCmd(out))
+	cmd.AddCommand(NewCopyCmd(out))
+	cmd.AddCommand(NewTierCmd(out))
+	cmd.AddCommand(NewPruneCmd(out))
+	cmd.AddCommand(NewOperatorCmd(out))
+	cmd.AddCommand(NewDaemonCmd(out))
+	cmd.AddCommand(NewAgentCmd(out))
 	cmd.AddCommand(NewVersionCmd(out))
 
 	return cmd
 }
 
 type backupCmd struct {
+	kubeconfig              string
+	context                 string
 	namespace               string
 	selector                string
+	statefulSet             string
+	cassandraDatacenter     string
+	unreadyPods             string
+	unreadyTimeout          time.Duration
 	container               string
 	keyspace                string
-	dst                     string
+	dsts                    []string
 	parallel                int
 	bufferSize              float64
+	maxBandwidth            float64
+	maxPodBandwidth         float64
 	s3partSize              int64
 	s3maxUploadParts        int
+	s3endpoint              string
+	s3forcePathStyle        bool
+	s3storageClass          string
+	s3sse                   string
+	s3sseKMSKeyID           string
+	s3acl                   string
+	retentionMode           string
+	retentionDays           int
+	retainUntil             string
 	cassandraDataDir        string
 	authentication          bool
 	cassandraUsername       string
 	nodetoolCredentialsFile string
+	credentialsSecret       string
+	checksum                bool
+	compression             string
+	layout                  string
+	archiveMaxSize          int64
+	encryptionKey           string
+	encryptionKeyID         string
+	encryptionKeySecret     string
+	datacenter              string
+	datacenterLabel         string
+	rackLabel               string
+	agent                   bool
+	agentPort               int
+	agentTokenFile          string
+	agentCAFile             string
+	events                  bool
+	annotate                bool
+	hooks                   []string
+	podHooks                []string
+	parsedHooks             []cain.Hook
 	verbose                 bool
 	out                     io.Writer
 }
@@ -65,32 +112,74 @@ func NewBackupCmd(out io.Writer) *cobra.Command {
 		Short: "backup cassandra cluster to cloud storage",
 		Long:  ``,
 		Args: func(cmd *cobra.Command, args []string) error {
-			if b.dst == "" {
+			if len(b.dsts) == 0 {
 				return errors.New("dst can not be empty")
 			}
 			if b.keyspace == "" {
 				return errors.New("keyspace can not be empty")
 			}
-			if strings.HasSuffix(strings.TrimRight(b.dst, "/"), b.keyspace) {
-				log.Println("WARNING: Destination path should not include the name of the keyspace")
+			for _, dst := range b.dsts {
+				if strings.HasSuffix(strings.TrimRight(dst, "/"), b.keyspace) {
+					log.Println("WARNING: Destination path should not include the name of the keyspace")
+				}
 			}
+			hooks, err := cain.ParseHooks(b.hooks, b.podHooks)
+			if err != nil {
+				return err
+			}
+			b.parsedHooks = hooks
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			options := cain.BackupOptions{
+				Kubeconfig:              b.kubeconfig,
+				Context:                 b.context,
 				Namespace:               b.namespace,
 				Selector:                b.selector,
+				StatefulSet:             b.statefulSet,
+				CassandraDatacenter:     b.cassandraDatacenter,
+				UnreadyPods:             b.unreadyPods,
+				UnreadyTimeout:          b.unreadyTimeout,
 				Container:               b.container,
 				Keyspace:                b.keyspace,
-				Dst:                     b.dst,
+				Dsts:                    b.dsts,
 				Parallel:                b.parallel,
 				BufferSize:              b.bufferSize,
+				MaxBandwidth:            b.maxBandwidth,
+				MaxPodBandwidth:         b.maxPodBandwidth,
 				S3PartSize:              b.s3partSize,
 				S3MaxUploadParts:        b.s3maxUploadParts,
+				S3Endpoint:              b.s3endpoint,
+				S3ForcePathStyle:        b.s3forcePathStyle,
+				S3StorageClass:          b.s3storageClass,
+				S3ServerSideEncryption:  b.s3sse,
+				S3SSEKMSKeyID:           b.s3sseKMSKeyID,
+				S3ACL:                   b.s3acl,
+				RetentionMode:           b.retentionMode,
+				RetentionDays:           b.retentionDays,
+				RetainUntil:             b.retainUntil,
 				CassandraDataDir:        b.cassandraDataDir,
 				Authentication:          b.authentication,
 				CassandraUsername:       b.cassandraUsername,
 				NodetoolCredentialsFile: b.nodetoolCredentialsFile,
+				CredentialsSecret:       b.credentialsSecret,
+				Checksum:                b.checksum,
+				Compression:             b.compression,
+				Layout:                  b.layout,
+				ArchiveMaxSize:          b.archiveMaxSize,
+				EncryptionKey:           b.encryptionKey,
+				EncryptionKeyID:         b.encryptionKeyID,
+				EncryptionKeySecret:     b.encryptionKeySecret,
+				Datacenter:              b.datacenter,
+				DatacenterLabel:         b.datacenterLabel,
+				RackLabel:               b.rackLabel,
+				Agent:                   b.agent,
+				AgentPort:               b.agentPort,
+				AgentTokenFile:          b.agentTokenFile,
+				AgentCAFile:             b.agentCAFile,
+				Events:                  b.events,
+				Annotate:                b.annotate,
+				Hooks:                   b.parsedHooks,
 				Verbose:                 b.verbose,
 			}
 			if _, err := cain.Backup(options); err != nil {
@@ -100,19 +189,55 @@ func NewBackupCmd(out io.Writer) *cobra.Command {
 	}
 	f := cmd.Flags()
 
+	f.StringVar(&b.kubeconfig, "kubeconfig", utils.GetStringEnvVar("CAIN_KUBECONFIG", ""), "path to the kubeconfig file of the cassandra cluster. defaults to $KUBECONFIG, ~/.kube/config or in cluster configuration. Overrides $CAIN_KUBECONFIG")
+	f.StringVar(&b.context, "context", utils.GetStringEnvVar("CAIN_CONTEXT", ""), "kubeconfig context of the cassandra cluster. defaults to the current context. Overrides $CAIN_CONTEXT")
 	f.StringVarP(&b.namespace, "namespace", "n", utils.GetStringEnvVar("CAIN_NAMESPACE", "default"), "namespace to find cassandra cluster. Overrides $CAIN_NAMESPACE")
 	f.StringVarP(&b.selector, "selector", "l", utils.GetStringEnvVar("CAIN_SELECTOR", "app=cassandra"), "selector to filter on. Overrides $CAIN_SELECTOR")
+	f.StringVar(&b.statefulSet, "statefulset", utils.GetStringEnvVar("CAIN_STATEFULSET", ""), "statefulset to act on, instead of selector. pods of all its ordinals are expected. Overrides $CAIN_STATEFULSET")
+	f.StringVar(&b.cassandraDatacenter, "cassandra-datacenter", utils.GetStringEnvVar("CAIN_CASSANDRA_DATACENTER", ""), "cass-operator CassandraDatacenter to act on, as name or namespace/name. sets the namespace, selector, container, data dir and credentials secret. Overrides $CAIN_CASSANDRA_DATACENTER")
+	f.StringVar(&b.unreadyPods, "unready-pods", utils.GetStringEnvVar("CAIN_UNREADY_PODS", utils.UnreadyPodsFail), "what to do with pods which are not ready: fail, wait (up to --unready-timeout) or skip. Overrides $CAIN_UNREADY_PODS")
+	f.DurationVar(&b.unreadyTimeout, "unready-timeout", utils.GetDurationEnvVar("CAIN_UNREADY_TIMEOUT", 10*time.Minute), "time to wait for pods to be ready with --unready-pods wait. Overrides $CAIN_UNREADY_TIMEOUT")
 	f.StringVarP(&b.container, "container", "c", utils.GetStringEnvVar("CAIN_CONTAINER", "cassandra"), "container name to act on. Overrides $CAIN_CONTAINER")
 	f.StringVarP(&b.keyspace, "keyspace", "k", utils.GetStringEnvVar("CAIN_KEYSPACE", ""), "keyspace to act on. Overrides $CAIN_KEYSPACE")
-	f.StringVar(&b.dst, "dst", utils.GetStringEnvVar("CAIN_DST", ""), "destination to backup to. Example: s3://bucket/cassandra. Overrides $CAIN_DST")
+	f.StringSliceVar(&b.dsts, "dst", utils.GetStringSliceEnvVar("CAIN_DST", nil), "destinations to backup to, comma separated or repeated. Example: s3://bucket/cassandra. Overrides $CAIN_DST")
 	f.IntVarP(&b.parallel, "parallel", "p", utils.GetIntEnvVar("CAIN_PARALLEL", 1), "number of files to copy in parallel. set this flag to 0 for full parallelism. Overrides $CAIN_PARALLEL")
 	f.Float64VarP(&b.bufferSize, "buffer-size", "b", utils.GetFloat64EnvVar("CAIN_BUFFER_SIZE", 6.75), "in memory buffer size (MB) to use for files copy (buffer per file). Overrides $CAIN_BUFFER_SIZE")
+	f.Float64Var(&b.maxBandwidth, "max-bandwidth", utils.GetFloat64EnvVar("CAIN_MAX_BANDWIDTH", 0), "maximum total bandwidth (MB/s) of all files copy, shared by all parallel copies. 0 means unlimited. Overrides $CAIN_MAX_BANDWIDTH")
+	f.Float64Var(&b.maxPodBandwidth, "max-pod-bandwidth", utils.GetFloat64EnvVar("CAIN_MAX_POD_BANDWIDTH", 0), "maximum bandwidth (MB/s) of files copy per pod. 0 means unlimited. Overrides $CAIN_MAX_POD_BANDWIDTH")
 	f.Int64VarP(&b.s3partSize, "s3-part-size", "s", utils.GetInt64EnvVar("CAIN_S3_PART_SIZE", 128*1024*1024), "size of each part in bytes for s3 multipart upload. Overrides $CAIN_S3_PART_SIZE")
 	f.IntVarP(&b.s3maxUploadParts, "s3-max-upload-parts", "m", utils.GetIntEnvVar("CAIN_S3_MAX_UPLOAD_PARTS", 10000), "maximum number of parts to upload in parallel for s3 multipart upload. Overrides $CAIN_S3_MAX_UPLOAD_PARTS")
+	f.StringVar(&b.s3endpoint, "s3-endpoint", utils.GetStringEnvVar("CAIN_S3_ENDPOINT", ""), "custom s3 endpoint, such as for MinIO or Ceph (optional). Overrides $CAIN_S3_ENDPOINT")
+	f.BoolVar(&b.s3forcePathStyle, "s3-force-path-style", utils.GetBoolEnvVar("CAIN_S3_FORCE_PATH_STYLE", false), "use path-style addressing for s3 (bucket in path instead of host). Overrides $CAIN_S3_FORCE_PATH_STYLE")
+	f.StringVar(&b.s3storageClass, "s3-storage-class", utils.GetStringEnvVar("CAIN_S3_STORAGE_CLASS", ""), "s3 storage class of uploaded files (optional). Example: STANDARD_IA. Overrides $CAIN_S3_STORAGE_CLASS")
+	f.StringVar(&b.s3sse, "s3-sse", utils.GetStringEnvVar("CAIN_S3_SSE", ""), "s3 server side encryption of uploaded files (optional). one of: AES256, aws:kms. Overrides $CAIN_S3_SSE")
+	f.StringVar(&b.s3sseKMSKeyID, "s3-sse-kms-key-id", utils.GetStringEnvVar("CAIN_S3_SSE_KMS_KEY_ID", ""), "kms key to use with --s3-sse aws:kms. defaults to the aws managed key. Overrides $CAIN_S3_SSE_KMS_KEY_ID")
+	f.StringVar(&b.s3acl, "s3-acl", utils.GetStringEnvVar("CAIN_S3_ACL", ""), "s3 canned acl of uploaded files (optional). Example: bucket-owner-full-control. Overrides $CAIN_S3_ACL")
+	f.StringVar(&b.retentionMode, "retention-mode", utils.GetStringEnvVar("CAIN_RETENTION_MODE", ""), "make uploaded files immutable with s3 object lock or azure blob immutability policies (optional). one of: governance, compliance. Overrides $CAIN_RETENTION_MODE")
+	f.IntVar(&b.retentionDays, "retention-days", utils.GetIntEnvVar("CAIN_RETENTION_DAYS", 0), "number of days to retain uploaded files for with --retention-mode. Overrides $CAIN_RETENTION_DAYS")
+	f.StringVar(&b.retainUntil, "retain-until", utils.GetStringEnvVar("CAIN_RETAIN_UNTIL", ""), "date to retain uploaded files until with --retention-mode, instead of --retention-days. Example: 2030-01-01. Overrides $CAIN_RETAIN_UNTIL")
 	f.StringVar(&b.cassandraDataDir, "cassandra-data-dir", utils.GetStringEnvVar("CAIN_CASSANDRA_DATA_DIR", "/var/lib/cassandra/data"), "cassandra data directory. Overrides $CAIN_CASSANDRA_DATA_DIR")
 	f.BoolVarP(&b.authentication, "authentication", "a", utils.GetBoolEnvVar("CAIN_AUTHENTICATION", false), "use authentication for nodetool and clqsh. Overrides $CAIN_AUTHENTICATION")
 	f.StringVarP(&b.cassandraUsername, "cassandra-username", "u", utils.GetStringEnvVar("CAIN_CASSANDRA_USERNAME", "cain"), "cassandra username. Overrides $CAIN_CASSANDRA_USERNAME")
 	f.StringVar(&b.nodetoolCredentialsFile, "nodetool-credentials-file", utils.GetStringEnvVar("CAIN_NODETOOL_CREDENTIALS_FILE", "/home/cassandra/.nodetool/credentials"), "path to nodetool credentials file. Overrides $CAIN_NODETOOL_CREDENTIALS_FILE")
+	f.StringVar(&b.credentialsSecret, "credentials-secret", utils.GetStringEnvVar("CAIN_CREDENTIALS_SECRET", ""), "secret to read cassandra and jmx credentials from, instead of --authentication (optional). Overrides $CAIN_CREDENTIALS_SECRET")
+	f.BoolVar(&b.checksum, "checksum", utils.GetBoolEnvVar("CAIN_CHECKSUM", true), "calculate sha256 checksums of files and verify them after upload. Overrides $CAIN_CHECKSUM")
+	f.StringVar(&b.compression, "compression", utils.GetStringEnvVar("CAIN_COMPRESSION", ""), "compression codec to compress files with (optional). one of: zstd, lz4. Overrides $CAIN_COMPRESSION")
+	f.StringVar(&b.layout, "layout", utils.GetStringEnvVar("CAIN_LAYOUT", "files"), "layout of the backup. files: an object per file, archive: tar archives per table and pod. Overrides $CAIN_LAYOUT")
+	f.Int64Var(&b.archiveMaxSize, "archive-max-size", utils.GetInt64EnvVar("CAIN_ARCHIVE_MAX_SIZE", 0), "maximum size (MB) of each archive with --layout archive. 0 means a single archive per table and pod. Overrides $CAIN_ARCHIVE_MAX_SIZE")
+	f.StringVar(&b.encryptionKey, "encryption-key", utils.GetStringEnvVar("CAIN_ENCRYPTION_KEY", ""), "key source to encrypt files with (optional). Example: file:///etc/cain/keyring, awskms://alias/cain. Overrides $CAIN_ENCRYPTION_KEY")
+	f.StringVar(&b.encryptionKeyID, "encryption-key-id", utils.GetStringEnvVar("CAIN_ENCRYPTION_KEY_ID", ""), "id of the key to encrypt with from a keyring file. defaults to the first key. Overrides $CAIN_ENCRYPTION_KEY_ID")
+	f.StringVar(&b.encryptionKeySecret, "encryption-key-secret", utils.GetStringEnvVar("CAIN_ENCRYPTION_KEY_SECRET", ""), "secret in the namespace holding a keyring to encrypt files with, in its keyring key, instead of --encryption-key (optional). Overrides $CAIN_ENCRYPTION_KEY_SECRET")
+	f.StringVar(&b.datacenter, "datacenter", utils.GetStringEnvVar("CAIN_DATACENTER", ""), "back up only the pods of this datacenter (optional). Overrides $CAIN_DATACENTER")
+	f.StringVar(&b.datacenterLabel, "datacenter-label", utils.GetStringEnvVar("CAIN_DATACENTER_LABEL", ""), "pod label holding the datacenter of a pod. read from nodetool info if empty. Overrides $CAIN_DATACENTER_LABEL")
+	f.StringVar(&b.rackLabel, "rack-label", utils.GetStringEnvVar("CAIN_RACK_LABEL", ""), "pod label holding the rack of a pod, with --datacenter-label. Overrides $CAIN_RACK_LABEL")
+	f.BoolVar(&b.agent, "agent", utils.GetBoolEnvVar("CAIN_AGENT", false), "coordinate cain agent sidecars instead of executing in pods. Overrides $CAIN_AGENT")
+	f.IntVar(&b.agentPort, "agent-port", utils.GetIntEnvVar("CAIN_AGENT_PORT", cain.AgentPort), "port of the agents with --agent. Overrides $CAIN_AGENT_PORT")
+	f.StringVar(&b.agentTokenFile, "agent-token-file", utils.GetStringEnvVar("CAIN_AGENT_TOKEN_FILE", ""), "path to a file holding the token of the agents with --agent. Overrides $CAIN_AGENT_TOKEN_FILE")
+	f.StringVar(&b.agentCAFile, "agent-ca-file", utils.GetStringEnvVar("CAIN_AGENT_CA_FILE", ""), "path to the ca certificate of the agents, to call them over https with --agent (optional). Overrides $CAIN_AGENT_CA_FILE")
+	f.BoolVar(&b.events, "events", utils.GetBoolEnvVar("CAIN_EVENTS", false), "record kubernetes events of the backup on the statefulset of the pods. Overrides $CAIN_EVENTS")
+	f.BoolVar(&b.annotate, "annotate", utils.GetBoolEnvVar("CAIN_ANNOTATE", false), "annotate the statefulset of the pods with the tag, time and size of the last successful backup of the keyspace. Overrides $CAIN_ANNOTATE")
+	f.StringArrayVar(&b.hooks, "hook", utils.GetStringArrayEnvVar("CAIN_HOOKS", nil), "shell command to run locally at a phase of the backup, as phase=command (repeatable). phases: pre-snapshot, post-snapshot, post-upload. Overrides $CAIN_HOOKS (one per line)")
+	f.StringArrayVar(&b.podHooks, "pod-hook", utils.GetStringArrayEnvVar("CAIN_POD_HOOKS", nil), "shell command to run in the container of each pod at a phase of the backup, as phase=command (repeatable). Overrides $CAIN_POD_HOOKS (one per line)")
 	return cmd
 }
 
@@ -121,16 +246,46 @@ type restoreCmd struct {
 	keyspace                string
 	tag                     string
 	schema                  string
+	srcKubeconfig           string
+	srcContext              string
+	kubeconfig              string
+	context                 string
 	namespace               string
 	selector                string
+	statefulSet             string
+	cassandraDatacenter     string
+	unreadyPods             string
+	unreadyTimeout          time.Duration
 	container               string
 	parallel                int
 	bufferSize              float64
+	maxBandwidth            float64
+	maxPodBandwidth         float64
+	s3endpoint              string
+	s3forcePathStyle        bool
 	userGroup               string
 	cassandraDataDir        string
 	authentication          bool
 	cassandraUsername       string
 	nodetoolCredentialsFile string
+	credentialsSecret       string
+	allowIncomplete         bool
+	checksum                bool
+	encryptionKey           string
+	encryptionKeySecret     string
+	rehydrate               bool
+	rehydrateDays           int
+	datacenter              string
+	datacenterLabel         string
+	rackLabel               string
+	agent                   bool
+	agentPort               int
+	agentTokenFile          string
+	agentCAFile             string
+	events                  bool
+	hooks                   []string
+	podHooks                []string
+	parsedHooks             []cain.Hook
 	verbose                 bool
 	out                     io.Writer
 }
@@ -156,6 +311,11 @@ func NewRestoreCmd(out io.Writer) *cobra.Command {
 			if strings.HasSuffix(strings.TrimRight(r.src, "/"), r.keyspace) {
 				log.Println("WARNING: Source path should not include the name of the keyspace")
 			}
+			hooks, err := cain.ParseHooks(r.hooks, r.podHooks)
+			if err != nil {
+				return err
+			}
+			r.parsedHooks = hooks
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
@@ -164,16 +324,44 @@ func NewRestoreCmd(out io.Writer) *cobra.Command {
 				Keyspace:                r.keyspace,
 				Tag:                     r.tag,
 				Schema:                  r.schema,
+				SrcKubeconfig:           r.srcKubeconfig,
+				SrcContext:              r.srcContext,
+				Kubeconfig:              r.kubeconfig,
+				Context:                 r.context,
 				Namespace:               r.namespace,
 				Selector:                r.selector,
+				StatefulSet:             r.statefulSet,
+				CassandraDatacenter:     r.cassandraDatacenter,
+				UnreadyPods:             r.unreadyPods,
+				UnreadyTimeout:          r.unreadyTimeout,
 				Container:               r.container,
 				Parallel:                r.parallel,
 				BufferSize:              r.bufferSize,
+				MaxBandwidth:            r.maxBandwidth,
+				MaxPodBandwidth:         r.maxPodBandwidth,
+				S3Endpoint:              r.s3endpoint,
+				S3ForcePathStyle:        r.s3forcePathStyle,
 				UserGroup:               r.userGroup,
 				CassandraDataDir:        r.cassandraDataDir,
 				Authentication:          r.authentication,
 				CassandraUsername:       r.cassandraUsername,
 				NodetoolCredentialsFile: r.nodetoolCredentialsFile,
+				CredentialsSecret:       r.credentialsSecret,
+				AllowIncomplete:         r.allowIncomplete,
+				Checksum:                r.checksum,
+				EncryptionKey:           r.encryptionKey,
+				EncryptionKeySecret:     r.encryptionKeySecret,
+				Rehydrate:               r.rehydrate,
+				RehydrateDays:           r.rehydrateDays,
+				Datacenter:              r.datacenter,
+				DatacenterLabel:         r.datacenterLabel,
+				RackLabel:               r.rackLabel,
+				Agent:                   r.agent,
+				AgentPort:               r.agentPort,
+				AgentTokenFile:          r.agentTokenFile,
+				AgentCAFile:             r.agentCAFile,
+				Events:                  r.events,
+				Hooks:                   r.parsedHooks,
 				Verbose:                 r.verbose,
 			}
 			if err := cain.Restore(options); err != nil {
@@ -187,25 +375,58 @@ func NewRestoreCmd(out io.Writer) *cobra.Command {
 	f.StringVarP(&r.keyspace, "keyspace", "k", utils.GetStringEnvVar("CAIN_KEYSPACE", ""), "keyspace to act on. Overrides $CAIN_KEYSPACE")
 	f.StringVarP(&r.tag, "tag", "t", utils.GetStringEnvVar("CAIN_TAG", ""), "tag to restore. Overrides $CAIN_TAG")
 	f.StringVarP(&r.schema, "schema", "s", utils.GetStringEnvVar("CAIN_SCHEMA", ""), "schema version to restore (optional). Overrides $CAIN_SCHEMA")
+	f.StringVar(&r.srcKubeconfig, "src-kubeconfig", utils.GetStringEnvVar("CAIN_SRC_KUBECONFIG", ""), "path to the kubeconfig file of a pvc source, to restore from another cluster. defaults to --kubeconfig. Overrides $CAIN_SRC_KUBECONFIG")
+	f.StringVar(&r.srcContext, "src-context", utils.GetStringEnvVar("CAIN_SRC_CONTEXT", ""), "kubeconfig context of a pvc source, to restore from another cluster. defaults to --context. Overrides $CAIN_SRC_CONTEXT")
+	f.StringVar(&r.kubeconfig, "kubeconfig", utils.GetStringEnvVar("CAIN_KUBECONFIG", ""), "path to the kubeconfig file of the cassandra cluster. defaults to $KUBECONFIG, ~/.kube/config or in cluster configuration. Overrides $CAIN_KUBECONFIG")
+	f.StringVar(&r.context, "context", utils.GetStringEnvVar("CAIN_CONTEXT", ""), "kubeconfig context of the cassandra cluster. defaults to the current context. Overrides $CAIN_CONTEXT")
 	f.StringVarP(&r.namespace, "namespace", "n", utils.GetStringEnvVar("CAIN_NAMESPACE", "default"), "namespace to find cassandra cluster. Overrides $CAIN_NAMESPACE")
 	f.StringVarP(&r.selector, "selector", "l", utils.GetStringEnvVar("CAIN_SELECTOR", "app=cassandra"), "selector to filter on. Overrides $CAIN_SELECTOR")
+	f.StringVar(&r.statefulSet, "statefulset", utils.GetStringEnvVar("CAIN_STATEFULSET", ""), "statefulset to act on, instead of selector. pods of all its ordinals are expected. Overrides $CAIN_STATEFULSET")
+	f.StringVar(&r.cassandraDatacenter, "cassandra-datacenter", utils.GetStringEnvVar("CAIN_CASSANDRA_DATACENTER", ""), "cass-operator CassandraDatacenter to act on, as name or namespace/name. sets the namespace, selector, container, data dir and credentials secret. Overrides $CAIN_CASSANDRA_DATACENTER")
+	f.StringVar(&r.unreadyPods, "unready-pods", utils.GetStringEnvVar("CAIN_UNREADY_PODS", utils.UnreadyPodsFail), "what to do with pods which are not ready: fail, wait (up to --unready-timeout) or skip. Overrides $CAIN_UNREADY_PODS")
+	f.DurationVar(&r.unreadyTimeout, "unready-timeout", utils.GetDurationEnvVar("CAIN_UNREADY_TIMEOUT", 10*time.Minute), "time to wait for pods to be ready with --unready-pods wait. Overrides $CAIN_UNREADY_TIMEOUT")
 	f.StringVarP(&r.container, "container", "c", utils.GetStringEnvVar("CAIN_CONTAINER", "cassandra"), "container name to act on. Overrides $CAIN_CONTAINER")
 	f.IntVarP(&r.parallel, "parallel", "p", utils.GetIntEnvVar("CAIN_PARALLEL", 1), "number of files to copy in parallel. set this flag to 0 for full parallelism. Overrides $CAIN_PARALLEL")
 	f.Float64VarP(&r.bufferSize, "buffer-size", "b", utils.GetFloat64EnvVar("CAIN_BUFFER_SIZE", 6.75), "in memory buffer size (MB) to use for files copy (buffer per file). Overrides $CAIN_BUFFER_SIZE")
+	f.Float64Var(&r.maxBandwidth, "max-bandwidth", utils.GetFloat64EnvVar("CAIN_MAX_BANDWIDTH", 0), "maximum total bandwidth (MB/s) of all files copy, shared by all parallel copies. 0 means unlimited. Overrides $CAIN_MAX_BANDWIDTH")
+	f.Float64Var(&r.maxPodBandwidth, "max-pod-bandwidth", utils.GetFloat64EnvVar("CAIN_MAX_POD_BANDWIDTH", 0), "maximum bandwidth (MB/s) of files copy per pod. 0 means unlimited. Overrides $CAIN_MAX_POD_BANDWIDTH")
+	f.StringVar(&r.s3endpoint, "s3-endpoint", utils.GetStringEnvVar("CAIN_S3_ENDPOINT", ""), "custom s3 endpoint, such as for MinIO or Ceph (optional). Overrides $CAIN_S3_ENDPOINT")
+	f.BoolVar(&r.s3forcePathStyle, "s3-force-path-style", utils.GetBoolEnvVar("CAIN_S3_FORCE_PATH_STYLE", false), "use path-style addressing for s3 (bucket in path instead of host). Overrides $CAIN_S3_FORCE_PATH_STYLE")
 	f.StringVar(&r.userGroup, "user-group", utils.GetStringEnvVar("CAIN_USER_GROUP", "cassandra:cassandra"), "user and group who should own restored files. Overrides $CAIN_USER_GROUP")
 	f.StringVar(&r.cassandraDataDir, "cassandra-data-dir", utils.GetStringEnvVar("CAIN_CASSANDRA_DATA_DIR", "/var/lib/cassandra/data"), "cassandra data directory. Overrides $CAIN_CASSANDRA_DATA_DIR")
 	f.BoolVarP(&r.authentication, "authentication", "a", utils.GetBoolEnvVar("CAIN_AUTHENTICATION", false), "use authentication for nodetool and clqsh. Overrides $CAIN_AUTHENTICATION")
 	f.StringVarP(&r.cassandraUsername, "cassandra-username", "u", utils.GetStringEnvVar("CAIN_CASSANDRA_USERNAME", "cain"), "cassandra username. Overrides $CAIN_CASSANDRA_USERNAME")
 	f.StringVarP(&r.nodetoolCredentialsFile, "nodetool-credentials-file", "f", utils.GetStringEnvVar("CAIN_NODETOOL_CREDENTIALS_FILE", "/home/cassandra/.nodetool/credentials"), "path to nodetool credentials file. Overrides $CAIN_NODETOOL_CREDENTIALS_FILE")
+	f.StringVar(&r.credentialsSecret, "credentials-secret", utils.GetStringEnvVar("CAIN_CREDENTIALS_SECRET", ""), "secret to read cassandra and jmx credentials from, instead of --authentication (optional). Overrides $CAIN_CREDENTIALS_SECRET")
+	f.BoolVar(&r.allowIncomplete, "allow-incomplete", utils.GetBoolEnvVar("CAIN_ALLOW_INCOMPLETE", false), "restore a backup even if it was not marked as complete. Overrides $CAIN_ALLOW_INCOMPLETE")
+	f.BoolVar(&r.checksum, "checksum", utils.GetBoolEnvVar("CAIN_CHECKSUM", true), "verify sha256 checksums of restored files against the backup manifest. Overrides $CAIN_CHECKSUM")
+	f.StringVar(&r.encryptionKey, "encryption-key", utils.GetStringEnvVar("CAIN_ENCRYPTION_KEY", ""), "key source to decrypt files with, if the backup is encrypted. Example: file:///etc/cain/keyring, awskms://alias/cain. Overrides $CAIN_ENCRYPTION_KEY")
+	f.StringVar(&r.encryptionKeySecret, "encryption-key-secret", utils.GetStringEnvVar("CAIN_ENCRYPTION_KEY_SECRET", ""), "secret in the namespace holding a keyring to decrypt files with, in its keyring key, instead of --encryption-key (optional). Overrides $CAIN_ENCRYPTION_KEY_SECRET")
+	f.BoolVar(&r.rehydrate, "rehydrate", utils.GetBoolEnvVar("CAIN_REHYDRATE", false), "start rehydration of archived files of the backup (s3 glacier, azure archive tier). restore again when it completes. Overrides $CAIN_REHYDRATE")
+	f.IntVar(&r.rehydrateDays, "rehydrate-days", utils.GetIntEnvVar("CAIN_REHYDRATE_DAYS", 7), "number of days to keep rehydrated copies of s3 files for. Overrides $CAIN_REHYDRATE_DAYS")
+	f.StringVar(&r.datacenter, "datacenter", utils.GetStringEnvVar("CAIN_DATACENTER", ""), "restore only the pods of this datacenter (optional). Overrides $CAIN_DATACENTER")
+	f.StringVar(&r.datacenterLabel, "datacenter-label", utils.GetStringEnvVar("CAIN_DATACENTER_LABEL", ""), "pod label holding the datacenter of a pod. read from nodetool info if empty. Overrides $CAIN_DATACENTER_LABEL")
+	f.StringVar(&r.rackLabel, "rack-label", utils.GetStringEnvVar("CAIN_RACK_LABEL", ""), "pod label holding the rack of a pod, with --datacenter-label. Overrides $CAIN_RACK_LABEL")
+	f.BoolVar(&r.agent, "agent", utils.GetBoolEnvVar("CAIN_AGENT", false), "coordinate cain agent sidecars instead of executing in pods. Overrides $CAIN_AGENT")
+	f.IntVar(&r.agentPort, "agent-port", utils.GetIntEnvVar("CAIN_AGENT_PORT", cain.AgentPort), "port of the agents with --agent. Overrides $CAIN_AGENT_PORT")
+	f.StringVar(&r.agentTokenFile, "agent-token-file", utils.GetStringEnvVar("CAIN_AGENT_TOKEN_FILE", ""), "path to a file holding the token of the agents with --agent. Overrides $CAIN_AGENT_TOKEN_FILE")
+	f.StringVar(&r.agentCAFile, "agent-ca-file", utils.GetStringEnvVar("CAIN_AGENT_CA_FILE", ""), "path to the ca certificate of the agents, to call them over https with --agent (optional). Overrides $CAIN_AGENT_CA_FILE")
+	f.BoolVar(&r.events, "events", utils.GetBoolEnvVar("CAIN_EVENTS", false), "record kubernetes events of the restore on the statefulset of the pods. Overrides $CAIN_EVENTS")
+	f.StringArrayVar(&r.hooks, "hook", utils.GetStringArrayEnvVar("CAIN_HOOKS", nil), "shell command to run locally at a phase of the restore, as phase=command (repeatable). phases: pre-truncate, post-refresh. Overrides $CAIN_HOOKS (one per line)")
+	f.StringArrayVar(&r.podHooks, "pod-hook", utils.GetStringArrayEnvVar("CAIN_POD_HOOKS", nil), "shell command to run in the container of each pod at a phase of the restore, as phase=command (repeatable). Overrides $CAIN_POD_HOOKS (one per line)")
 	return cmd
 }
 
 type schemaCmd struct {
-	namespace string
-	selector  string
-	container string
-	keyspace  string
-	sum       bool
+	kubeconfig          string
+	context             string
+	namespace           string
+	selector            string
+	cassandraDatacenter string
+	container           string
+	keyspace            string
+	credentialsSecret   string
+	sum                 bool
 
 	out io.Writer
 }
@@ -226,10 +447,14 @@ func NewSchemaCmd(out io.Writer) *cobra.Command {
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			options := cain.SchemaOptions{
-				Namespace: s.namespace,
-				Selector:  s.selector,
-				Container: s.container,
-				Keyspace:  s.keyspace,
+				Kubeconfig:          s.kubeconfig,
+				Context:             s.context,
+				Namespace:           s.namespace,
+				Selector:            s.selector,
+				CassandraDatacenter: s.cassandraDatacenter,
+				Container:           s.container,
+				Keyspace:            s.keyspace,
+				CredentialsSecret:   s.credentialsSecret,
 			}
 			schema, sum, err := cain.Schema(options)
 			if err != nil {
@@ -245,15 +470,526 @@ func NewSchemaCmd(out io.Writer) *cobra.Command {
 	}
 	f := cmd.Flags()
 
+	f.StringVar(&s.kubeconfig, "kubeconfig", utils.GetStringEnvVar("CAIN_KUBECONFIG", ""), "path to the kubeconfig file of the cassandra cluster. defaults to $KUBECONFIG, ~/.kube/config or in cluster configuration. Overrides $CAIN_KUBECONFIG")
+	f.StringVar(&s.context, "context", utils.GetStringEnvVar("CAIN_CONTEXT", ""), "kubeconfig context of the cassandra cluster. defaults to the current context. Overrides $CAIN_CONTEXT")
 	f.StringVarP(&s.namespace, "namespace", "n", utils.GetStringEnvVar("CAIN_NAMESPACE", "default"), "namespace to find cassandra cluster. Overrides $CAIN_NAMESPACE")
 	f.StringVarP(&s.selector, "selector", "l", utils.GetStringEnvVar("CAIN_SELECTOR", "app=cassandra"), "selector to filter on. Overrides $CAIN_SELECTOR")
+	f.StringVar(&s.cassandraDatacenter, "cassandra-datacenter", utils.GetStringEnvVar("CAIN_CASSANDRA_DATACENTER", ""), "cass-operator CassandraDatacenter to act on, as name or namespace/name. sets the namespace, selector, container and credentials secret. Overrides $CAIN_CASSANDRA_DATACENTER")
 	f.StringVarP(&s.container, "container", "c", utils.GetStringEnvVar("CAIN_CONTAINER", "cassandra"), "container name to act on. Overrides $CAIN_CONTAINER")
 	f.StringVarP(&s.keyspace, "keyspace", "k", utils.GetStringEnvVar("CAIN_KEYSPACE", ""), "keyspace to act on. Overrides $CAIN_KEYSPACE")
+	f.StringVar(&s.credentialsSecret, "credentials-secret", utils.GetStringEnvVar("CAIN_CREDENTIALS_SECRET", ""), "secret to read cassandra credentials from (optional). Overrides $CAIN_CREDENTIALS_SECRET")
 	f.BoolVar(&s.sum, "sum", utils.GetBoolEnvVar("CAIN_SUM", false), "print only checksum. Overrides $CAIN_SUM")
 
 	return cmd
 }
 
+type verifyCmd struct {
+	src              string
+	keyspace         string
+	tag              string
+	schema           string
+	checksum         bool
+	encryptionKey    string
+	s3endpoint       string
+	s3forcePathStyle bool
+	parallel         int
+	kubeconfig       string
+	context          string
+	verbose          bool
+
+	out io.Writer
+}
+
+// NewVerifyCmd validates a backup without restoring it
+func NewVerifyCmd(out io.Writer) *cobra.Command {
+	v := &verifyCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "verify a backup in cloud storage without restoring it",
+		Long:  ``,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if v.src == "" {
+				return errors.New("src can not be empty")
+			}
+			if v.tag == "" {
+				return errors.New("tag can not be empty")
+			}
+			if v.keyspace == "" {
+				return errors.New("keyspace can not be empty")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			options := cain.VerifyOptions{
+				Src:              v.src,
+				Keyspace:         v.keyspace,
+				Tag:              v.tag,
+				Schema:           v.schema,
+				Checksum:         v.checksum,
+				EncryptionKey:    v.encryptionKey,
+				S3Endpoint:       v.s3endpoint,
+				S3ForcePathStyle: v.s3forcePathStyle,
+				Parallel:         v.parallel,
+				Kubeconfig:       v.kubeconfig,
+				Context:          v.context,
+				Verbose:          v.verbose,
+			}
+			if err := cain.Verify(options); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.StringVar(&v.src, "src", utils.GetStringEnvVar("CAIN_SRC", ""), "source to verify. Example: s3://bucket/cassandra/namespace/cluster-name. Overrides $CAIN_SRC")
+	f.StringVarP(&v.keyspace, "keyspace", "k", utils.GetStringEnvVar("CAIN_KEYSPACE", ""), "keyspace to act on. Overrides $CAIN_KEYSPACE")
+	f.StringVarP(&v.tag, "tag", "t", utils.GetStringEnvVar("CAIN_TAG", ""), "tag to verify. Overrides $CAIN_TAG")
+	f.StringVarP(&v.schema, "schema", "s", utils.GetStringEnvVar("CAIN_SCHEMA", ""), "schema version of the backup (optional). Overrides $CAIN_SCHEMA")
+	f.BoolVar(&v.checksum, "checksum", utils.GetBoolEnvVar("CAIN_CHECKSUM", false), "also download all files and verify their sha256 checksums. Overrides $CAIN_CHECKSUM")
+	f.StringVar(&v.encryptionKey, "encryption-key", utils.GetStringEnvVar("CAIN_ENCRYPTION_KEY", ""), "key source to decrypt files with, if the backup is encrypted. Overrides $CAIN_ENCRYPTION_KEY")
+	f.StringVar(&v.s3endpoint, "s3-endpoint", utils.GetStringEnvVar("CAIN_S3_ENDPOINT", ""), "custom s3 endpoint, such as for MinIO or Ceph (optional). Overrides $CAIN_S3_ENDPOINT")
+	f.BoolVar(&v.s3forcePathStyle, "s3-force-path-style", utils.GetBoolEnvVar("CAIN_S3_FORCE_PATH_STYLE", false), "use path-style addressing for s3 (bucket in path instead of host). Overrides $CAIN_S3_FORCE_PATH_STYLE")
+	f.IntVarP(&v.parallel, "parallel", "p", utils.GetIntEnvVar("CAIN_PARALLEL", 1), "number of files to verify in parallel. set this flag to 0 for full parallelism. Overrides $CAIN_PARALLEL")
+	f.StringVar(&v.kubeconfig, "kubeconfig", utils.GetStringEnvVar("CAIN_KUBECONFIG", ""), "path to the kubeconfig file of pvc storage. defaults to $KUBECONFIG, ~/.kube/config or in cluster configuration. Overrides $CAIN_KUBECONFIG")
+	f.StringVar(&v.context, "context", utils.GetStringEnvVar("CAIN_CONTEXT", ""), "kubeconfig context of pvc storage. defaults to the current context. Overrides $CAIN_CONTEXT")
+
+	return cmd
+}
+
+type copyCmd struct {
+	src              string
+	dst              string
+	clusters         []string
+	keyspaces        []string
+	tags             []string
+	allowIncomplete  bool
+	parallel         int
+	bufferSize       float64
+	s3partSize       int64
+	s3maxUploadParts int
+	maxBandwidth     float64
+	s3endpoint       string
+	s3forcePathStyle bool
+	s3storageClass   string
+	s3sse            string
+	s3sseKMSKeyID    string
+	s3acl            string
+	retentionMode    string
+	retentionDays    int
+	retainUntil      string
+	kubeconfig       string
+	context          string
+	verbose          bool
+
+	out io.Writer
+}
+
+// NewCopyCmd copies backups between storage services
+func NewCopyCmd(out io.Writer) *cobra.Command {
+	c := &copyCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "copy",
+		Short: "copy backups between cloud storage services",
+		Long:  ``,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if c.src == "" {
+				return errors.New("src can not be empty")
+			}
+			if c.dst == "" {
+				return errors.New("dst can not be empty")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			options := cain.CopyOptions{
+				Src:                    c.src,
+				Dst:                    c.dst,
+				Clusters:               c.clusters,
+				Keyspaces:              c.keyspaces,
+				Tags:                   c.tags,
+				AllowIncomplete:        c.allowIncomplete,
+				Parallel:               c.parallel,
+				BufferSize:             c.bufferSize,
+				S3PartSize:             c.s3partSize,
+				S3MaxUploadParts:       c.s3maxUploadParts,
+				MaxBandwidth:           c.maxBandwidth,
+				S3Endpoint:             c.s3endpoint,
+				S3ForcePathStyle:       c.s3forcePathStyle,
+				S3StorageClass:         c.s3storageClass,
+				S3ServerSideEncryption: c.s3sse,
+				S3SSEKMSKeyID:          c.s3sseKMSKeyID,
+				S3ACL:                  c.s3acl,
+				RetentionMode:          c.retentionMode,
+				RetentionDays:          c.retentionDays,
+				RetainUntil:            c.retainUntil,
+				Kubeconfig:             c.kubeconfig,
+				Context:                c.context,
+				Verbose:                c.verbose,
+			}
+			if err := cain.Copy(options); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.StringVar(&c.src, "src", utils.GetStringEnvVar("CAIN_SRC", ""), "path backups are stored under to copy from. Example: s3://bucket/cassandra. Overrides $CAIN_SRC")
+	f.StringVar(&c.dst, "dst", utils.GetStringEnvVar("CAIN_DST", ""), "path to copy backups to. Example: abs://my-account/container/cassandra. Overrides $CAIN_DST")
+	f.StringSliceVar(&c.clusters, "cluster", utils.GetStringSliceEnvVar("CAIN_CLUSTER", nil), "clusters to copy, as namespace/cluster-name (optional, repeatable). Overrides $CAIN_CLUSTER")
+	f.StringSliceVarP(&c.keyspaces, "keyspace", "k", utils.GetStringSliceEnvVar("CAIN_KEYSPACE", nil), "keyspaces to copy (optional, repeatable). Overrides $CAIN_KEYSPACE")
+	f.StringSliceVarP(&c.tags, "tag", "t", utils.GetStringSliceEnvVar("CAIN_TAG", nil), "tags to copy (optional, repeatable). Overrides $CAIN_TAG")
+	f.BoolVar(&c.allowIncomplete, "allow-incomplete", utils.GetBoolEnvVar("CAIN_ALLOW_INCOMPLETE", false), "copy backups even if they were not marked as complete. Overrides $CAIN_ALLOW_INCOMPLETE")
+	f.IntVarP(&c.parallel, "parallel", "p", utils.GetIntEnvVar("CAIN_PARALLEL", 1), "number of files to copy in parallel. set this flag to 0 for full parallelism. Overrides $CAIN_PARALLEL")
+	f.Float64VarP(&c.bufferSize, "buffer-size", "b", utils.GetFloat64EnvVar("CAIN_BUFFER_SIZE", 6.75), "in memory buffer size (MB) to use for files copy (buffer per file). Overrides $CAIN_BUFFER_SIZE")
+	f.Float64Var(&c.maxBandwidth, "max-bandwidth", utils.GetFloat64EnvVar("CAIN_MAX_BANDWIDTH", 0), "maximum total bandwidth (MB/s) of all files copy, shared by all parallel copies. 0 means unlimited. Overrides $CAIN_MAX_BANDWIDTH")
+	f.Int64VarP(&c.s3partSize, "s3-part-size", "s", utils.GetInt64EnvVar("CAIN_S3_PART_SIZE", 128*1024*1024), "size of each part in bytes for s3 multipart upload. Overrides $CAIN_S3_PART_SIZE")
+	f.IntVarP(&c.s3maxUploadParts, "s3-max-upload-parts", "m", utils.GetIntEnvVar("CAIN_S3_MAX_UPLOAD_PARTS", 10000), "maximum number of parts to upload in parallel for s3 multipart upload. Overrides $CAIN_S3_MAX_UPLOAD_PARTS")
+	f.StringVar(&c.s3endpoint, "s3-endpoint", utils.GetStringEnvVar("CAIN_S3_ENDPOINT", ""), "custom s3 endpoint, such as for MinIO or Ceph (optional). Overrides $CAIN_S3_ENDPOINT")
+	f.BoolVar(&c.s3forcePathStyle, "s3-force-path-style", utils.GetBoolEnvVar("CAIN_S3_FORCE_PATH_STYLE", false), "use path-style addressing for s3 (bucket in path instead of host). Overrides $CAIN_S3_FORCE_PATH_STYLE")
+	f.StringVar(&c.s3storageClass, "s3-storage-class", utils.GetStringEnvVar("CAIN_S3_STORAGE_CLASS", ""), "s3 storage class of uploaded files (optional). Example: STANDARD_IA. Overrides $CAIN_S3_STORAGE_CLASS")
+	f.StringVar(&c.s3sse, "s3-sse", utils.GetStringEnvVar("CAIN_S3_SSE", ""), "s3 server side encryption of uploaded files (optional). one of: AES256, aws:kms. Overrides $CAIN_S3_SSE")
+	f.StringVar(&c.s3sseKMSKeyID, "s3-sse-kms-key-id", utils.GetStringEnvVar("CAIN_S3_SSE_KMS_KEY_ID", ""), "kms key to use with --s3-sse aws:kms. defaults to the aws managed key. Overrides $CAIN_S3_SSE_KMS_KEY_ID")
+	f.StringVar(&c.s3acl, "s3-acl", utils.GetStringEnvVar("CAIN_S3_ACL", ""), "s3 canned acl of uploaded files (optional). Example: bucket-owner-full-control. Overrides $CAIN_S3_ACL")
+	f.StringVar(&c.retentionMode, "retention-mode", utils.GetStringEnvVar("CAIN_RETENTION_MODE", ""), "make uploaded files immutable with s3 object lock or azure blob immutability policies (optional). one of: governance, compliance. Overrides $CAIN_RETENTION_MODE")
+	f.IntVar(&c.retentionDays, "retention-days", utils.GetIntEnvVar("CAIN_RETENTION_DAYS", 0), "number of days to retain uploaded files for with --retention-mode. Overrides $CAIN_RETENTION_DAYS")
+	f.StringVar(&c.retainUntil, "retain-until", utils.GetStringEnvVar("CAIN_RETAIN_UNTIL", ""), "date to retain uploaded files until with --retention-mode, instead of --retention-days. Example: 2030-01-01. Overrides $CAIN_RETAIN_UNTIL")
+	f.StringVar(&c.kubeconfig, "kubeconfig", utils.GetStringEnvVar("CAIN_KUBECONFIG", ""), "path to the kubeconfig file of pvc storage. defaults to $KUBECONFIG, ~/.kube/config or in cluster configuration. Overrides $CAIN_KUBECONFIG")
+	f.StringVar(&c.context, "context", utils.GetStringEnvVar("CAIN_CONTEXT", ""), "kubeconfig context of pvc storage. defaults to the current context. Overrides $CAIN_CONTEXT")
+
+	return cmd
+}
+
+type tierCmd struct {
+	src              string
+	clusters         []string
+	keyspaces        []string
+	tags             []string
+	olderThanDays    int
+	storageClass     string
+	dryRun           bool
+	parallel         int
+	s3endpoint       string
+	s3forcePathStyle bool
+	s3acl            string
+	verbose          bool
+
+	out io.Writer
+}
+
+// NewTierCmd moves aging backups to a colder storage class
+func NewTierCmd(out io.Writer) *cobra.Command {
+	t := &tierCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "tier",
+		Short: "move backups older than a number of days to a colder storage class",
+		Long:  ``,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if t.src == "" {
+				return errors.New("src can not be empty")
+			}
+			if t.storageClass == "" {
+				return errors.New("storage-class can not be empty")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			options := cain.TierOptions{
+				Src:              t.src,
+				Clusters:         t.clusters,
+				Keyspaces:        t.keyspaces,
+				Tags:             t.tags,
+				OlderThanDays:    t.olderThanDays,
+				StorageClass:     t.storageClass,
+				DryRun:           t.dryRun,
+				Parallel:         t.parallel,
+				S3Endpoint:       t.s3endpoint,
+				S3ForcePathStyle: t.s3forcePathStyle,
+				S3ACL:            t.s3acl,
+				Verbose:          t.verbose,
+			}
+			if err := cain.Tier(options); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.StringVar(&t.src, "src", utils.GetStringEnvVar("CAIN_SRC", ""), "path backups are stored under. Example: s3://bucket/cassandra. Overrides $CAIN_SRC")
+	f.StringSliceVar(&t.clusters, "cluster", utils.GetStringSliceEnvVar("CAIN_CLUSTER", nil), "clusters to tier, as namespace/cluster-name (optional, repeatable). Overrides $CAIN_CLUSTER")
+	f.StringSliceVarP(&t.keyspaces, "keyspace", "k", utils.GetStringSliceEnvVar("CAIN_KEYSPACE", nil), "keyspaces to tier (optional, repeatable). Overrides $CAIN_KEYSPACE")
+	f.StringSliceVarP(&t.tags, "tag", "t", utils.GetStringSliceEnvVar("CAIN_TAG", nil), "tags to tier (optional, repeatable). Overrides $CAIN_TAG")
+	f.IntVar(&t.olderThanDays, "older-than-days", utils.GetIntEnvVar("CAIN_OLDER_THAN_DAYS", 7), "tier backups taken more than this number of days ago. Overrides $CAIN_OLDER_THAN_DAYS")
+	f.StringVar(&t.storageClass, "storage-class", utils.GetStringEnvVar("CAIN_STORAGE_CLASS", ""), "storage class to move backups to. Example: GLACIER, DEEP_ARCHIVE (s3), Cool, Archive (abs). Overrides $CAIN_STORAGE_CLASS")
+	f.BoolVar(&t.dryRun, "dry-run", utils.GetBoolEnvVar("CAIN_DRY_RUN", false), "only print the backups which would be tiered. Overrides $CAIN_DRY_RUN")
+	f.IntVarP(&t.parallel, "parallel", "p", utils.GetIntEnvVar("CAIN_PARALLEL", 1), "number of files to move in parallel. set this flag to 0 for full parallelism. Overrides $CAIN_PARALLEL")
+	f.StringVar(&t.s3endpoint, "s3-endpoint", utils.GetStringEnvVar("CAIN_S3_ENDPOINT", ""), "custom s3 endpoint, such as for MinIO or Ceph (optional). Overrides $CAIN_S3_ENDPOINT")
+	f.BoolVar(&t.s3forcePathStyle, "s3-force-path-style", utils.GetBoolEnvVar("CAIN_S3_FORCE_PATH_STYLE", false), "use path-style addressing for s3 (bucket in path instead of host). Overrides $CAIN_S3_FORCE_PATH_STYLE")
+	f.StringVar(&t.s3acl, "s3-acl", utils.GetStringEnvVar("CAIN_S3_ACL", ""), "s3 canned acl of moved files, s3 does not keep acls of moved files (optional). Example: bucket-owner-full-control. Overrides $CAIN_S3_ACL")
+
+	return cmd
+}
+
+type pruneCmd struct {
+	dst              string
+	clusters         []string
+	keyspaces        []string
+	keepLast         int
+	keepDays         int
+	dryRun           bool
+	parallel         int
+	s3endpoint       string
+	s3forcePathStyle bool
+	kubeconfig       string
+	context          string
+	verbose          bool
+
+	out io.Writer
+}
+
+// NewPruneCmd deletes backups beyond a retention
+func NewPruneCmd(out io.Writer) *cobra.Command {
+	p := &pruneCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "delete backups beyond a number of backups or days to keep",
+		Long:  ``,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if p.dst == "" {
+				return errors.New("dst can not be empty")
+			}
+			if p.keepLast == 0 && p.keepDays == 0 {
+				return errors.New("keep-last or keep-days must be set")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			options := cain.PruneOptions{
+				Dst:              p.dst,
+				Clusters:         p.clusters,
+				Keyspaces:        p.keyspaces,
+				KeepLast:         p.keepLast,
+				KeepDays:         p.keepDays,
+				DryRun:           p.dryRun,
+				Parallel:         p.parallel,
+				S3Endpoint:       p.s3endpoint,
+				S3ForcePathStyle: p.s3forcePathStyle,
+				Kubeconfig:       p.kubeconfig,
+				Context:          p.context,
+				Verbose:          p.verbose,
+			}
+			result, err := cain.Prune(options)
+			if result != nil && len(result.Retained) != 0 {
+				log.Printf("Kept %d retained backups: %s", len(result.Retained), strings.Join(result.Retained, ", "))
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.StringVar(&p.dst, "dst", utils.GetStringEnvVar("CAIN_DST", ""), "path backups are stored under. Example: s3://bucket/cassandra. Overrides $CAIN_DST")
+	f.StringSliceVar(&p.clusters, "cluster", utils.GetStringSliceEnvVar("CAIN_CLUSTER", nil), "clusters to prune, as namespace/cluster-name (optional, repeatable). Overrides $CAIN_CLUSTER")
+	f.StringSliceVarP(&p.keyspaces, "keyspace", "k", utils.GetStringSliceEnvVar("CAIN_KEYSPACE", nil), "keyspaces to prune (optional, repeatable). Overrides $CAIN_KEYSPACE")
+	f.IntVar(&p.keepLast, "keep-last", utils.GetIntEnvVar("CAIN_KEEP_LAST", 0), "number of newest complete backups of every keyspace to keep. Overrides $CAIN_KEEP_LAST")
+	f.IntVar(&p.keepDays, "keep-days", utils.GetIntEnvVar("CAIN_KEEP_DAYS", 0), "keep backups taken in this number of days. Overrides $CAIN_KEEP_DAYS")
+	f.BoolVar(&p.dryRun, "dry-run", utils.GetBoolEnvVar("CAIN_DRY_RUN", false), "only print the backups which would be deleted. Overrides $CAIN_DRY_RUN")
+	f.IntVarP(&p.parallel, "parallel", "p", utils.GetIntEnvVar("CAIN_PARALLEL", 1), "number of files to check and delete in parallel. set this flag to 0 for full parallelism. Overrides $CAIN_PARALLEL")
+	f.StringVar(&p.s3endpoint, "s3-endpoint", utils.GetStringEnvVar("CAIN_S3_ENDPOINT", ""), "custom s3 endpoint, such as for MinIO or Ceph (optional). Overrides $CAIN_S3_ENDPOINT")
+	f.BoolVar(&p.s3forcePathStyle, "s3-force-path-style", utils.GetBoolEnvVar("CAIN_S3_FORCE_PATH_STYLE", false), "use path-style addressing for s3 (bucket in path instead of host). Overrides $CAIN_S3_FORCE_PATH_STYLE")
+	f.StringVar(&p.kubeconfig, "kubeconfig", utils.GetStringEnvVar("CAIN_KUBECONFIG", ""), "path to the kubeconfig file of pvc storage. defaults to $KUBECONFIG, ~/.kube/config or in cluster configuration. Overrides $CAIN_KUBECONFIG")
+	f.StringVar(&p.context, "context", utils.GetStringEnvVar("CAIN_CONTEXT", ""), "kubeconfig context of pvc storage. defaults to the current context. Overrides $CAIN_CONTEXT")
+
+	return cmd
+}
+
+type operatorCmd struct {
+	kubeconfig     string
+	context        string
+	namespace      string
+	interval       time.Duration
+	agentTokenFile string
+	agentCAFile    string
+
+	out io.Writer
+}
+
+// NewOperatorCmd reconciles CassandraBackup, CassandraBackupSchedule and CassandraRestore resources
+func NewOperatorCmd(out io.Writer) *cobra.Command {
+	o := &operatorCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "operator",
+		Short: "reconcile CassandraBackup, CassandraBackupSchedule and CassandraRestore resources",
+		Long:  ``,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if o.interval <= 0 {
+				return errors.New("interval must be positive")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			stop := make(chan struct{})
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-signals
+				close(stop)
+			}()
+
+			options := cain.OperatorOptions{
+				Kubeconfig:     o.kubeconfig,
+				Context:        o.context,
+				Namespace:      o.namespace,
+				Interval:       o.interval,
+				AgentTokenFile: o.agentTokenFile,
+				AgentCAFile:    o.agentCAFile,
+			}
+			if err := cain.RunOperator(options, stop); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.StringVar(&o.kubeconfig, "kubeconfig", utils.GetStringEnvVar("CAIN_KUBECONFIG", ""), "path to the kubeconfig file of the cluster to reconcile resources in. defaults to $KUBECONFIG, ~/.kube/config or in cluster configuration. Overrides $CAIN_KUBECONFIG")
+	f.StringVar(&o.context, "context", utils.GetStringEnvVar("CAIN_CONTEXT", ""), "kubeconfig context of the cluster to reconcile resources in. defaults to the current context. Overrides $CAIN_CONTEXT")
+	f.StringVarP(&o.namespace, "namespace", "n", utils.GetStringEnvVar("CAIN_NAMESPACE", ""), "namespace to reconcile resources in. all namespaces if empty. Overrides $CAIN_NAMESPACE")
+	f.DurationVar(&o.interval, "interval", utils.GetDurationEnvVar("CAIN_INTERVAL", 30*time.Second), "interval between reconciliations. Overrides $CAIN_INTERVAL")
+	f.StringVar(&o.agentTokenFile, "agent-token-file", utils.GetStringEnvVar("CAIN_AGENT_TOKEN_FILE", ""), "path to a file holding the token of the agents of resources with agent set. Overrides $CAIN_AGENT_TOKEN_FILE")
+	f.StringVar(&o.agentCAFile, "agent-ca-file", utils.GetStringEnvVar("CAIN_AGENT_CA_FILE", ""), "path to the ca certificate of the agents, to call them over https (optional). Overrides $CAIN_AGENT_CA_FILE")
+
+	return cmd
+}
+
+type daemonCmd struct {
+	config string
+	listen string
+
+	out io.Writer
+}
+
+// NewDaemonCmd runs backups on cron schedules
+func NewDaemonCmd(out io.Writer) *cobra.Command {
+	d := &daemonCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "run backups on cron schedules",
+		Long:  ``,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if d.config == "" {
+				return errors.New("config can not be empty")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			stop := make(chan struct{})
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-signals
+				close(stop)
+			}()
+
+			options := cain.DaemonOptions{
+				Config: d.config,
+				Listen: d.listen,
+			}
+			if err := cain.RunDaemon(options, stop); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.StringVar(&d.config, "config", utils.GetStringEnvVar("CAIN_CONFIG", ""), "path to a yaml file of schedules. Overrides $CAIN_CONFIG")
+	f.StringVar(&d.listen, "listen", utils.GetStringEnvVar("CAIN_LISTEN", ":8080"), "address to serve the status of schedules on. set this flag to an empty string to disable. Overrides $CAIN_LISTEN")
+
+	return cmd
+}
+
+type agentCmd struct {
+	listen                  string
+	tokenFile               string
+	tlsCertFile             string
+	tlsKeyFile              string
+	insecure                bool
+	cassandraDataDir        string
+	authentication          bool
+	cassandraUsername       string
+	nodetoolCredentialsFile string
+	credentialsDir          string
+
+	out io.Writer
+}
+
+// NewAgentCmd serves backups and restores of the local cassandra node to a coordinating cain
+func NewAgentCmd(out io.Writer) *cobra.Command {
+	a := &agentCmd{out: out}
+
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "run as a sidecar of a cassandra node, coordinated by backup and restore with --agent",
+		Long:  ``,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if a.tokenFile == "" {
+				return errors.New("token-file can not be empty")
+			}
+			if (a.tlsCertFile == "") != (a.tlsKeyFile == "") {
+				return errors.New("tls-cert-file and tls-key-file must be set together")
+			}
+			if a.tlsCertFile == "" && !a.insecure {
+				return errors.New("tls-cert-file and tls-key-file are required, unless insecure is set")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			stop := make(chan struct{})
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-signals
+				close(stop)
+			}()
+
+			options := cain.AgentOptions{
+				Listen:                  a.listen,
+				TokenFile:               a.tokenFile,
+				TLSCertFile:             a.tlsCertFile,
+				TLSKeyFile:              a.tlsKeyFile,
+				Insecure:                a.insecure,
+				CassandraDataDir:        a.cassandraDataDir,
+				Authentication:          a.authentication,
+				CassandraUsername:       a.cassandraUsername,
+				NodetoolCredentialsFile: a.nodetoolCredentialsFile,
+				CredentialsDir:          a.credentialsDir,
+			}
+			if err := cain.RunAgent(options, stop); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	f := cmd.Flags()
+
+	f.StringVar(&a.listen, "listen", utils.GetStringEnvVar("CAIN_LISTEN", fmt.Sprintf(":%d", cain.AgentPort)), "address to serve the agent api on. Overrides $CAIN_LISTEN")
+	f.StringVar(&a.tokenFile, "token-file", utils.GetStringEnvVar("CAIN_AGENT_TOKEN_FILE", ""), "path to a file holding the token requests must present. Overrides $CAIN_AGENT_TOKEN_FILE")
+	f.StringVar(&a.tlsCertFile, "tls-cert-file", utils.GetStringEnvVar("CAIN_TLS_CERT_FILE", ""), "path to a certificate to serve https with, required unless --insecure. Overrides $CAIN_TLS_CERT_FILE")
+	f.StringVar(&a.tlsKeyFile, "tls-key-file", utils.GetStringEnvVar("CAIN_TLS_KEY_FILE", ""), "path to the key of --tls-cert-file. Overrides $CAIN_TLS_KEY_FILE")
+	f.BoolVar(&a.insecure, "insecure", utils.GetBoolEnvVar("CAIN_INSECURE", false), "serve the agent api over plain http without a certificate. only use on trusted networks. Overrides $CAIN_INSECURE")
+	f.StringVar(&a.cassandraDataDir, "cassandra-data-dir", utils.GetStringEnvVar("CAIN_CASSANDRA_DATA_DIR", "/var/lib/cassandra/data"), "cassandra data directory. Overrides $CAIN_CASSANDRA_DATA_DIR")
+	f.BoolVarP(&a.authentication, "authentication", "a", utils.GetBoolEnvVar("CAIN_AUTHENTICATION", false), "use authentication for nodetool and clqsh. Overrides $CAIN_AUTHENTICATION")
+	f.StringVarP(&a.cassandraUsername, "cassandra-username", "u", utils.GetStringEnvVar("CAIN_CASSANDRA_USERNAME", "cain"), "cassandra username. Overrides $CAIN_CASSANDRA_USERNAME")
+	f.StringVar(&a.nodetoolCredentialsFile, "nodetool-credentials-file", utils.GetStringEnvVar("CAIN_NODETOOL_CREDENTIALS_FILE", "/home/cassandra/.nodetool/credentials"), "path to nodetool credentials file. Overrides $CAIN_NODETOOL_CREDENTIALS_FILE")
+	f.StringVar(&a.credentialsDir, "credentials-dir", utils.GetStringEnvVar("CAIN_CREDENTIALS_DIR", ""), "directory of a mounted credentials secret to read cassandra and jmx credentials from, instead of --authentication (optional). Overrides $CAIN_CREDENTIALS_DIR")
+
+	return cmd
+}
+
 var (
 	// GitTag stands for a git tag
 	GitTag string
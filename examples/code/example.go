@@ -23,7 +23,7 @@ func main() {
 			Selector:  selector,
 			Container: container,
 			Keyspace:  keyspace,
-			Dst:       dst,
+			Dsts:      []string{dst},
 			Parallel:  parallel,
 		})
 	if err != nil {
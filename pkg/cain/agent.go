@@ -0,0 +1,562 @@
+package cain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nuvo/cain/pkg/utils"
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// AgentPort is the default port of the agent API
+const AgentPort = 8780
+
+// Paths of the agent API
+const (
+	agentNodetoolPath = "/v1/nodetool"
+	agentCqlshPath    = "/v1/cqlsh"
+	agentBackupPath   = "/v1/backup"
+	agentRestorePath  = "/v1/restore"
+)
+
+// agentNodetoolCommands are the nodetool commands an agent runs
+var agentNodetoolCommands = []string{"describecluster", "info", "snapshot", "clearsnapshot", "refresh"}
+
+// AgentOptions are the options to pass to RunAgent
+type AgentOptions struct {
+	Listen                  string
+	TokenFile               string
+	TLSCertFile             string
+	TLSKeyFile              string
+	Insecure                bool
+	CassandraDataDir        string
+	Authentication          bool
+	CassandraUsername       string
+	NodetoolCredentialsFile string
+	CredentialsDir          string
+}
+
+// AgentCommandRequest runs nodetool with Args, or cqlsh with Statement (cqlsh -e) or Script (cqlsh -f)
+type AgentCommandRequest struct {
+	Args      []string `json:"args,omitempty"`
+	Statement string   `json:"statement,omitempty"`
+	Script    string   `json:"script,omitempty"`
+}
+
+// AgentCommandResponse is the output of a command
+type AgentCommandResponse struct {
+	Output string `json:"output"`
+}
+
+// AgentBackupRequest uploads the files of a snapshot to destinations, under Path/Tag/Pod/table/file
+// Path is the path of the backup relative to the destinations (namespace/cluster/keyspace/sum)
+type AgentBackupRequest struct {
+	Pod              string               `json:"pod"`
+	Keyspace         string               `json:"keyspace"`
+	Tag              string               `json:"tag"`
+	Path             string               `json:"path"`
+	Dsts             []string             `json:"dsts"`
+	Storage          utils.StorageOptions `json:"storage"`
+	Parallel         int                  `json:"parallel"`
+	BufferSize       float64              `json:"bufferSize"`
+	S3PartSize       int64                `json:"s3PartSize"`
+	S3MaxUploadParts int                  `json:"s3MaxUploadParts"`
+	MaxBandwidth     float64              `json:"maxBandwidth,omitempty"`
+	Compression      string               `json:"compression,omitempty"`
+	Encryption       *utils.Encryption    `json:"encryption,omitempty"`
+	EncryptionKey    string               `json:"encryptionKey,omitempty"`
+	Checksum         bool                 `json:"checksum,omitempty"`
+	Verbose          bool                 `json:"verbose,omitempty"`
+}
+
+// AgentBackupResponse holds the uploaded files keyed by their path relative to the tag (pod/table/file),
+// and the errors of destinations which failed
+type AgentBackupResponse struct {
+	Files      map[string]FileInfo `json:"files"`
+	FailedDsts map[string]string   `json:"failedDsts,omitempty"`
+}
+
+// AgentRestoreRequest downloads objects of a backup into the tables of a keyspace
+// Files are the objects to restore relative to Src (keyspace/sum/tag/pod/table/file), Checksums are keyed by Files
+// ValidateOnly checks the storage, the key and the tables of the request without downloading, before tables are truncated
+type AgentRestoreRequest struct {
+	Keyspace           string               `json:"keyspace"`
+	Src                string               `json:"src"`
+	Files              []string             `json:"files"`
+	Checksums          map[string]string    `json:"checksums,omitempty"`
+	Storage            utils.StorageOptions `json:"storage"`
+	Parallel           int                  `json:"parallel"`
+	BufferSize         float64              `json:"bufferSize"`
+	S3PartSize         int64                `json:"s3PartSize"`
+	S3MaxDownloadParts int                  `json:"s3MaxDownloadParts"`
+	MaxBandwidth       float64              `json:"maxBandwidth,omitempty"`
+	Compression        string               `json:"compression,omitempty"`
+	Encryption         *utils.Encryption    `json:"encryption,omitempty"`
+	EncryptionKey      string               `json:"encryptionKey,omitempty"`
+	UserGroup          string               `json:"userGroup,omitempty"`
+	Verbose            bool                 `json:"verbose,omitempty"`
+	ValidateOnly       bool                 `json:"validateOnly,omitempty"`
+}
+
+// AgentRestoreResponse holds the restored tables
+type AgentRestoreResponse struct {
+	Tables []string `json:"tables"`
+}
+
+// RunAgent serves the agent API until stop is closed
+// The API is served over https, or over plain http only if Insecure is set
+func RunAgent(o AgentOptions, stop <-chan struct{}) error {
+	if o.TLSCertFile == "" && !o.Insecure {
+		return fmt.Errorf("agents require a tls certificate, or to be explicitly insecure")
+	}
+	token, err := readAgentToken(o.TokenFile)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(o.CassandraDataDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s does not exist", o.CassandraDataDir)
+	}
+	creds := Credentials{
+		enabled:                 o.Authentication,
+		username:                o.CassandraUsername,
+		nodetoolCredentialsFile: o.NodetoolCredentialsFile,
+	}
+	if o.CredentialsDir != "" {
+		if creds, err = ReadCredentialsDir(o.CredentialsDir); err != nil {
+			return err
+		}
+	}
+
+	agent := NewAgent(token, o.CassandraDataDir, creds)
+	server := &http.Server{Addr: o.Listen, Handler: agent}
+	errc := make(chan error, 1)
+	go func() {
+		log.Println("Agent serving on", o.Listen)
+		if o.TLSCertFile != "" {
+			errc <- server.ListenAndServeTLS(o.TLSCertFile, o.TLSKeyFile)
+		} else {
+			log.Println("WARNING: serving the agent api over plain http, the token and data are not encrypted")
+			errc <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-stop:
+	}
+	log.Println("Waiting for running requests")
+
+	return server.Shutdown(context.Background())
+}
+
+// Agent serves the agent API of a single cassandra node. It runs nodetool and cqlsh locally,
+// and copies files between the data directory of the node and storage services
+type Agent struct {
+	Token   string
+	DataDir string
+	Creds   Credentials
+	// Run runs a local command and returns its output, replaceable for tests
+	Run func(command []string, stdin io.Reader) (string, error)
+}
+
+// NewAgent returns an Agent which authenticates requests by token
+func NewAgent(token, dataDir string, creds Credentials) *Agent {
+	return &Agent{
+		Token:   token,
+		DataDir: dataDir,
+		Creds:   creds,
+		Run:     runCommand,
+	}
+}
+
+// ServeHTTP serves the agent API
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if a.Token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(a.Token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var response interface{}
+	var err error
+	switch r.URL.Path {
+	case agentNodetoolPath, agentCqlshPath:
+		request := AgentCommandRequest{}
+		if !decodeAgentRequest(w, r, &request) {
+			return
+		}
+		if r.URL.Path == agentNodetoolPath {
+			response, err = a.Nodetool(request)
+		} else {
+			response, err = a.Cqlsh(request)
+		}
+	case agentBackupPath:
+		request := AgentBackupRequest{}
+		if !decodeAgentRequest(w, r, &request) {
+			return
+		}
+		response, err = a.Backup(request)
+	case agentRestorePath:
+		request := AgentRestoreRequest{}
+		if !decodeAgentRequest(w, r, &request) {
+			return
+		}
+		response, err = a.Restore(request)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println(r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println(err)
+	}
+}
+
+// Nodetool runs one of the nodetool commands an agent runs
+func (a *Agent) Nodetool(request AgentCommandRequest) (*AgentCommandResponse, error) {
+	if len(request.Args) == 0 || !utils.Contains(agentNodetoolCommands, request.Args[0]) {
+		return nil, fmt.Errorf("nodetool command must be one of: %s", strings.Join(agentNodetoolCommands, ", "))
+	}
+	command, stdin := a.Creds.nodetoolCommand(request.Args)
+	output, err := a.Run(command, stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AgentCommandResponse{Output: output}, nil
+}
+
+// Cqlsh runs a cql statement or script
+func (a *Agent) Cqlsh(request AgentCommandRequest) (*AgentCommandResponse, error) {
+	args := []string{"-e", request.Statement}
+	if request.Script != "" {
+		f, err := ioutil.TempFile("", "cain-*.cql")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(request.Script)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		args = []string{"-f", f.Name()}
+	} else if request.Statement == "" {
+		return nil, fmt.Errorf("cqlsh requires a statement or a script")
+	}
+	command, stdin := a.Creds.cqlshCommand(args)
+	output, err := a.Run(command, stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AgentCommandResponse{Output: string(removeWarning([]byte(output)))}, nil
+}
+
+// Backup uploads the files of a snapshot to the destinations of request
+func (a *Agent) Backup(request AgentBackupRequest) (*AgentBackupResponse, error) {
+	log.Printf("Backing up snapshot %s of keyspace %s", request.Tag, request.Keyspace)
+	if err := testAgentPathComponents(append([]string{request.Pod, request.Keyspace, request.Tag}, strings.Split(request.Path, "/")...)...); err != nil {
+		return nil, err
+	}
+	var dsts []*utils.Destination
+	for _, dst := range request.Dsts {
+		dstPrefix, dstPath, dstOptions, err := utils.SplitDestination(dst, request.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if err := testAgentStorage(dstPrefix); err != nil {
+			return nil, err
+		}
+		dstClient, err := utils.GetClient(dstPrefix, dstPath, dstOptions)
+		if err != nil {
+			return nil, err
+		}
+		dsts = append(dsts, &utils.Destination{Prefix: dstPrefix, Client: dstClient, BasePath: dstPath})
+	}
+
+	files, err := snapshotFiles(a.DataDir, request.Keyspace, request.Tag)
+	if err != nil {
+		return nil, err
+	}
+	response := &AgentBackupResponse{Files: make(map[string]FileInfo), FailedDsts: make(map[string]string)}
+	var fromToPaths []skbn.FromToPair
+	for path, file := range files {
+		info, err := localFileInfo(path, request.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(request.Pod, file)
+		response.Files[file] = info
+		toPath := filepath.Join(request.Path, request.Tag, file) + utils.CompressionSuffix(request.Compression)
+		fromToPaths = append(fromToPaths, skbn.FromToPair{FromPath: path, ToPath: toPath})
+	}
+
+	var encrypt utils.StreamTransform
+	if request.Encryption != nil {
+		key, err := utils.GetDataKey(request.EncryptionKey, request.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		encrypt = utils.NewEncryptTransform(key)
+	}
+	transform := utils.ChainTransforms(utils.NewCompressTransform(request.Compression), encrypt)
+	limiter := utils.NewBandwidthLimiter(request.MaxBandwidth, 0)
+	if err := utils.PerformFanOutCopy("/", "file", dsts, fromToPaths, request.Parallel, request.BufferSize, request.S3PartSize, request.S3MaxUploadParts, transform, limiter, request.Verbose); err != nil {
+		return nil, err
+	}
+	for _, dst := range dsts {
+		if err := dst.Err(); err != nil {
+			response.FailedDsts[dst.String()] = err.Error()
+		}
+	}
+
+	return response, nil
+}
+
+// Restore downloads objects of a backup into the tables of a keyspace, and changes their ownership
+func (a *Agent) Restore(request AgentRestoreRequest) (*AgentRestoreResponse, error) {
+	if !request.ValidateOnly {
+		log.Printf("Restoring %d files of keyspace %s", len(request.Files), request.Keyspace)
+	}
+	if err := testAgentPathComponents(request.Keyspace); err != nil {
+		return nil, err
+	}
+	srcPrefix, srcBasePath := utils.SplitInTwo(request.Src, "://")
+	if err := testAgentStorage(srcPrefix); err != nil {
+		return nil, err
+	}
+	srcClient, err := utils.GetClient(srcPrefix, srcBasePath, request.Storage)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{Compression: request.Compression, Encryption: request.Encryption}
+	transform, err := RestoreTransform(manifest, request.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tableDirs := make(map[string]string)
+	var fromToPaths []skbn.FromToPair
+	for _, file := range request.Files {
+		// keyspace/sum/tag/pod/table/file
+		pSplit := strings.Split(file, "/")
+		if len(pSplit) != 6 || testAgentPathComponents(pSplit...) != nil {
+			return nil, fmt.Errorf("illegal file to restore %s", file)
+		}
+		table := pSplit[4]
+		dir, ok := tableDirs[table]
+		if !ok {
+			if dir, err = localTableDir(a.DataDir, request.Keyspace, table); err != nil {
+				return nil, err
+			}
+			tableDirs[table] = dir
+		}
+		toPath := filepath.Join(dir, manifest.FileName(pSplit[5]))
+		fromToPaths = append(fromToPaths, skbn.FromToPair{FromPath: filepath.Join(srcBasePath, file), ToPath: toPath})
+	}
+	var tables []string
+	for table := range tableDirs {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	if request.ValidateOnly {
+		return &AgentRestoreResponse{Tables: tables}, nil
+	}
+
+	limiter := utils.NewBandwidthLimiter(request.MaxBandwidth, 0)
+	if err := utils.PerformCopy(srcClient, "/", srcPrefix, "file", fromToPaths, request.Parallel, request.BufferSize, request.S3PartSize, request.S3MaxDownloadParts, transform, limiter, request.Verbose); err != nil {
+		return nil, err
+	}
+
+	if len(request.Checksums) != 0 {
+		log.Println("Verifying checksums")
+		var mismatches []string
+		for i, ftp := range fromToPaths {
+			expected := request.Checksums[request.Files[i]]
+			if expected == "" {
+				continue
+			}
+			info, err := localFileInfo(ftp.ToPath, true)
+			if err != nil {
+				return nil, err
+			}
+			if info.Sha256 != expected {
+				mismatches = append(mismatches, request.Files[i])
+			}
+		}
+		if err := checksumError(mismatches); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.UserGroup != "" {
+		log.Println("Changing files ownership")
+		if _, err := a.Run([]string{"chown", "-R", request.UserGroup, a.DataDir}, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return &AgentRestoreResponse{Tables: tables}, nil
+}
+
+// decodeAgentRequest decodes the body of a request, and responds with an error if it can not be decoded
+func decodeAgentRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(request); err != nil {
+		http.Error(w, fmt.Sprintf("could not parse request: %s", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// readAgentToken reads the token of the agent API from a file
+func readAgentToken(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("agents require a token file")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+
+	return token, nil
+}
+
+// testAgentStorage checks that a storage service can be used by an agent
+// Kubernetes based storage requires access to the Kubernetes API, which agents do not have,
+// and file paths would read and write the filesystem of the agent
+func testAgentStorage(prefix string) error {
+	switch prefix {
+	case "k8s", "pvc", "file":
+		return fmt.Errorf("%s is not supported with agents", prefix)
+	default:
+		return utils.TestImplementationsExist(prefix, prefix)
+	}
+}
+
+// testAgentPathComponents checks that names of a request are single path components, which do not leave
+// the data directory of the agent or the path of the backup, and do not match other files when globbed
+func testAgentPathComponents(names ...string) error {
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\*?[`) {
+			return fmt.Errorf("illegal path component %q", name)
+		}
+	}
+	return nil
+}
+
+// snapshotFiles returns the files of a snapshot of a keyspace in a data directory
+// Files are keyed by their local path, values are their path relative to the snapshot (table/file)
+func snapshotFiles(dataDir, keyspace, tag string) (map[string]string, error) {
+	// data-dir/keyspace/table-id/snapshots/tag
+	dirs, err := filepath.Glob(filepath.Join(dataDir, keyspace, "*", "snapshots", tag))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, dir := range dirs {
+		table := strings.Split(filepath.Base(filepath.Dir(filepath.Dir(dir))), "-")[0]
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files[filepath.Join(dir, info.Name())] = filepath.Join(table, info.Name())
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files found in snapshot %s of keyspace %s", tag, keyspace)
+	}
+
+	return files, nil
+}
+
+// localTableDir returns the directory of a table in a data directory
+func localTableDir(dataDir, keyspace, table string) (string, error) {
+	dirs, err := filepath.Glob(filepath.Join(dataDir, keyspace, table+"-*"))
+	if err != nil {
+		return "", err
+	}
+	if len(dirs) != 1 {
+		return "", fmt.Errorf("Error with table %s, found %d directories", table, len(dirs))
+	}
+
+	return dirs[0], nil
+}
+
+// localFileInfo returns the size, and the checksum if requested, of a local file
+func localFileInfo(path string, checksum bool) (FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info := FileInfo{Size: stat.Size()}
+	if checksum {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return FileInfo{}, err
+		}
+		info.Sha256 = fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	return info, nil
+}
+
+// runCommand runs a local command and returns its output, failing if anything is written to stderr
+func runCommand(command []string, stdin io.Reader) (string, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	err := cmd.Run()
+	if stderr.Len() != 0 {
+		return "", fmt.Errorf("STDERR: " + stderr.String())
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,194 @@
+package cain
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+const testAgentToken = "secret"
+
+// testAgent is an agent served over http, which records the commands it runs instead of running them
+type testAgent struct {
+	*Agent
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	commands []string
+}
+
+func newTestAgent(t *testing.T, dataDir string) *testAgent {
+	ta := &testAgent{Agent: NewAgent(testAgentToken, dataDir, Credentials{})}
+	ta.Run = func(command []string, stdin io.Reader) (string, error) {
+		ta.mutex.Lock()
+		defer ta.mutex.Unlock()
+		ta.commands = append(ta.commands, strings.Join(command, " "))
+		return "", nil
+	}
+	ta.server = httptest.NewServer(ta)
+	t.Cleanup(ta.server.Close)
+	return ta
+}
+
+// client returns a client to the agent as the agent of pod
+func (ta *testAgent) client(pod string) *AgentClient {
+	return &AgentClient{Pod: pod, URL: ta.server.URL, Token: testAgentToken, Client: ta.server.Client()}
+}
+
+// ran returns true if the agent ran a command which contains s
+func (ta *testAgent) ran(s string) bool {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	for _, command := range ta.commands {
+		if strings.Contains(command, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// newTestDataDir returns a cassandra data directory with the directories of tables of a keyspace
+func newTestDataDir(t *testing.T, keyspace string, tables ...string) string {
+	dataDir := t.TempDir()
+	for _, table := range tables {
+		if err := os.MkdirAll(filepath.Join(dataDir, keyspace, table+"-0123456789abcdef"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dataDir
+}
+
+// newTestS3 serves objects of buckets to the s3 client, keyed by bucket/key
+func newTestS3(t *testing.T, objects map[string]string) *httptest.Server {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(r.URL.Path, "/")
+		if !strings.Contains(path, "/") {
+			// Listing of a bucket, used to test the connection
+			w.Header().Set("Content-Type", "application/xml")
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>`+path+`</Name></ListBucketResult>`)
+			return
+		}
+		content, ok := objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		io.WriteString(w, content)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAgentRejectsStorage(t *testing.T) {
+	agent := newTestAgent(t, newTestDataDir(t, "keyspace", "table1"))
+	client := agent.client("pod-0")
+	for _, prefix := range []string{"file", "pvc", "k8s"} {
+		t.Run(prefix, func(t *testing.T) {
+			backup := AgentBackupRequest{Pod: "pod-0", Keyspace: "keyspace", Tag: "tag", Path: "ns/cluster/keyspace/sum", Dsts: []string{prefix + "://tmp/backups"}}
+			if err := client.call(agentBackupPath, backup, &AgentBackupResponse{}); err == nil || !strings.Contains(err.Error(), "not supported with agents") {
+				t.Errorf("expected backup to %s to be rejected, got %v", prefix, err)
+			}
+			restore := AgentRestoreRequest{Keyspace: "keyspace", Src: prefix + "://tmp/backups", Files: []string{"keyspace/sum/tag/pod-0/table1/mc-1-big-Data.db"}}
+			if err := client.call(agentRestorePath, restore, &AgentRestoreResponse{}); err == nil || !strings.Contains(err.Error(), "not supported with agents") {
+				t.Errorf("expected restore from %s to be rejected, got %v", prefix, err)
+			}
+		})
+	}
+}
+
+func TestAgentRejectsPaths(t *testing.T) {
+	s3 := newTestS3(t, nil)
+	storage := utils.StorageOptions{S3Endpoint: s3.URL, S3ForcePathStyle: true}
+	agent := newTestAgent(t, newTestDataDir(t, "keyspace", "table1"))
+	client := agent.client("pod-0")
+
+	backups := map[string]AgentBackupRequest{
+		"parent keyspace": {Pod: "pod-0", Keyspace: "..", Tag: "tag", Path: "ns/cluster/keyspace/sum"},
+		"nested tag":      {Pod: "pod-0", Keyspace: "keyspace", Tag: "../../tag", Path: "ns/cluster/keyspace/sum"},
+		"globbed tag":     {Pod: "pod-0", Keyspace: "keyspace", Tag: "*", Path: "ns/cluster/keyspace/sum"},
+		"parent pod":      {Pod: "..", Keyspace: "keyspace", Tag: "tag", Path: "ns/cluster/keyspace/sum"},
+		"parent path":     {Pod: "pod-0", Keyspace: "keyspace", Tag: "tag", Path: "ns/../../sum"},
+	}
+	for name, request := range backups {
+		t.Run(name, func(t *testing.T) {
+			request.Dsts, request.Storage = []string{"s3://bucket/cassandra"}, storage
+			if err := client.call(agentBackupPath, request, &AgentBackupResponse{}); err == nil || !strings.Contains(err.Error(), "illegal") {
+				t.Errorf("expected backup to be rejected, got %v", err)
+			}
+		})
+	}
+
+	restores := map[string]AgentRestoreRequest{
+		"parent keyspace": {Keyspace: "..", Files: []string{"keyspace/sum/tag/pod-0/table1/mc-1-big-Data.db"}},
+		"parent table":    {Keyspace: "keyspace", Files: []string{"keyspace/sum/tag/pod-0/../mc-1-big-Data.db"}},
+		"parent file":     {Keyspace: "keyspace", Files: []string{"keyspace/sum/tag/pod-0/table1/.."}},
+		"globbed table":   {Keyspace: "keyspace", Files: []string{"keyspace/sum/tag/pod-0/*/mc-1-big-Data.db"}},
+		"nested file":     {Keyspace: "keyspace", Files: []string{"keyspace/sum/tag/pod-0/table1/../../../../etc/passwd"}},
+	}
+	for name, request := range restores {
+		t.Run(name, func(t *testing.T) {
+			request.Src, request.Storage = "s3://bucket/cassandra", storage
+			if err := client.call(agentRestorePath, request, &AgentRestoreResponse{}); err == nil || !strings.Contains(err.Error(), "illegal") {
+				t.Errorf("expected restore to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAgentAuthentication(t *testing.T) {
+	agent := newTestAgent(t, newTestDataDir(t, "keyspace"))
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"health without token", http.MethodGet, "/healthz", "", http.StatusOK},
+		{"without token", http.MethodPost, agentNodetoolPath, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, agentNodetoolPath, "wrong", http.StatusUnauthorized},
+		{"token prefix", http.MethodPost, agentNodetoolPath, testAgentToken[:3], http.StatusUnauthorized},
+		{"wrong method", http.MethodGet, agentNodetoolPath, testAgentToken, http.StatusMethodNotAllowed},
+		{"token", http.MethodPost, agentNodetoolPath, testAgentToken, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, agent.server.URL+tt.path, strings.NewReader(`{"args":["info"]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := agent.server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+	if len(agent.commands) != 1 || !agent.ran("nodetool info") {
+		t.Errorf("expected only the authenticated request to run nodetool, ran %v", agent.commands)
+	}
+}
+
+func TestRunAgentRequiresTLS(t *testing.T) {
+	err := RunAgent(AgentOptions{Listen: "127.0.0.1:0", TokenFile: "token"}, make(chan struct{}))
+	if err == nil || !strings.Contains(err.Error(), "tls") {
+		t.Fatalf("expected agent without a certificate to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package cain
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/nuvo/cain/pkg/utils"
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+const (
+	// LayoutFiles stores every file of a snapshot as an object
+	LayoutFiles = "files"
+	// LayoutArchive stores the snapshot of every table in every pod as tar archives
+	LayoutArchive = "archive"
+)
+
+// TestLayout checks that a backup layout is supported
+func TestLayout(layout string) error {
+	switch layout {
+	case "", LayoutFiles, LayoutArchive:
+		return nil
+	default:
+		return fmt.Errorf("layout %s not implemented. must be one of: %s, %s", layout, LayoutFiles, LayoutArchive)
+	}
+}
+
+// BuildArchives groups files by table and pod to archives of up to maxSize bytes (0 for a single archive per table)
+// The archives are added to the manifest, which must already hold the sizes of the files
+func BuildArchives(fromToPaths []skbn.FromToPair, tagPath string, manifest *Manifest, maxSize int64) []utils.Archive {
+	// snapshot directory in pod -> files
+	dirs := make(map[string][]skbn.FromToPair)
+	for _, ftp := range fromToPaths {
+		dir := filepath.Dir(ftp.FromPath)
+		dirs[dir] = append(dirs[dir], ftp)
+	}
+	var sortedDirs []string
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Strings(sortedDirs)
+
+	manifest.Archives = make(map[string]ArchiveInfo)
+	var archives []utils.Archive
+	for _, dir := range sortedDirs {
+		files := dirs[dir]
+		sort.Slice(files, func(i, j int) bool { return files[i].FromPath < files[j].FromPath })
+		// pod/table
+		tableDir := filepath.Dir(utils.RelativePath(files[0].ToPath, tagPath))
+
+		first, size := len(archives), int64(0)
+		for _, ftp := range files {
+			file := utils.RelativePath(ftp.ToPath, tagPath)
+			fileSize := manifest.Files[file].Size
+			last := len(archives) - 1
+			if last < first || (maxSize != 0 && size != 0 && size+fileSize > maxSize) {
+				name := filepath.Join(tableDir, fmt.Sprintf("archive-%d.tar", len(archives)-first))
+				archives = append(archives, utils.Archive{Path: filepath.Join(tagPath, manifest.ObjectName(name)), Dir: dir})
+				last, size = last+1, 0
+			}
+			archives[last].Files = append(archives[last].Files, filepath.Base(ftp.FromPath))
+			name := archiveName(manifest, archives[last].Path, tagPath)
+			info := manifest.Archives[name]
+			info.Files = append(info.Files, file)
+			manifest.Archives[name] = info
+			size += fileSize
+		}
+	}
+
+	return archives
+}
+
+// RecordArchives records the sizes and checksums of copied archives in the manifest
+func RecordArchives(archives []utils.Archive, tagPath string, manifest *Manifest) {
+	for _, archive := range archives {
+		name := archiveName(manifest, archive.Path, tagPath)
+		info := manifest.Archives[name]
+		info.Size = archive.Size
+		info.Sha256 = archive.Sha256
+		manifest.Archives[name] = info
+	}
+}
+
+// ArchivedFiles maps the archives of a restore to the files they hold, to verify the restored files
+func ArchivedFiles(fromToPaths []skbn.FromToPair, srcPath string, manifest *Manifest) []skbn.FromToPair {
+	var files []skbn.FromToPair
+	for _, ftp := range fromToPaths {
+		info := manifest.Archives[archiveName(manifest, ftp.FromPath, srcPath)]
+		for _, file := range info.Files {
+			files = append(files, skbn.FromToPair{
+				FromPath: filepath.Join(srcPath, file),
+				ToPath:   filepath.Join(filepath.Dir(ftp.ToPath), filepath.Base(file)),
+			})
+		}
+	}
+
+	return files
+}
+
+// archiveName returns the name of an archive in the manifest
+func archiveName(manifest *Manifest, path, tagPath string) string {
+	return manifest.FileName(utils.RelativePath(path, tagPath))
+}
@@ -4,9 +4,10 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/nuvo/cain/pkg/utils"
-	"github.com/nuvo/skbn/pkg/skbn"
 )
 
 // Authentication options if cassandra cluster uses authentication
@@ -14,88 +15,416 @@ type Credentials struct {
 	enabled                 bool
 	username                string
 	nodetoolCredentialsFile string
+	// Credentials read from a secret are passed to nodetool and cqlsh through stdin
+	fromSecret  bool
+	password    string
+	jmxUsername string
+	jmxPassword string
 }
 
 // BackupOptions are the options to pass to Backup
 type BackupOptions struct {
-	Namespace               string
-	Selector                string
-	Container               string
-	Keyspace                string
+	Kubeconfig          string
+	Context             string
+	Namespace           string
+	Selector            string
+	StatefulSet         string
+	CassandraDatacenter string
+	UnreadyPods         string
+	UnreadyTimeout      time.Duration
+	Container           string
+	Keyspace            string
+	// Deprecated: Dst is appended to Dsts if it is set, use Dsts instead
 	Dst                     string
+	Dsts                    []string
 	Parallel                int
 	BufferSize              float64
 	S3MaxUploadParts        int
 	S3PartSize              int64
+	MaxBandwidth            float64
+	MaxPodBandwidth         float64
+	S3Endpoint              string
+	S3ForcePathStyle        bool
+	S3StorageClass          string
+	S3ServerSideEncryption  string
+	S3SSEKMSKeyID           string
+	S3ACL                   string
+	RetentionMode           string
+	RetentionDays           int
+	RetainUntil             string
 	CassandraDataDir        string
 	Authentication          bool
 	CassandraUsername       string
 	NodetoolCredentialsFile string
+	CredentialsSecret       string
+	Checksum                bool
+	Compression             string
+	Layout                  string
+	ArchiveMaxSize          int64
+	EncryptionKey           string
+	EncryptionKeyID         string
+	EncryptionKeySecret     string
+	Datacenter              string
+	DatacenterLabel         string
+	RackLabel               string
+	Agent                   bool
+	AgentPort               int
+	AgentTokenFile          string
+	AgentCAFile             string
+	Events                  bool
+	Annotate                bool
+	Hooks                   []Hook
 	Verbose                 bool
 }
 
-// Backup performs backup
+// Backup performs backup and returns its tag
+// Every file is read from the pods once and written to all destinations. A backup which fails in some of the destinations
+// is completed in the rest of them, and an error describing the failed destinations is returned with the tag
 func Backup(o BackupOptions) (string, error) {
-	log.Println("Backup started!")
-	dstPrefix, dstPath := utils.SplitInTwo(o.Dst, "://")
-
-	if err := skbn.TestImplementationsExist("k8s", dstPrefix); err != nil {
+	result, err := BackupWithResult(o)
+	if result == nil {
 		return "", err
 	}
+	return result.Tag, err
+}
+
+// BackupResult describes a backup
+type BackupResult struct {
+	Tag string
+	// Path is the path of the backup tag relative to the destinations (namespace/cluster-name/keyspace/schema/tag)
+	Path  string
+	Files int
+	// Bytes is the total size of the backed up files, StoredBytes is their total size in storage
+	Bytes       int64
+	StoredBytes int64
+	// FailedDsts are the errors of the destinations the backup failed in, keyed by destination
+	FailedDsts map[string]string
+}
+
+// BackupWithResult performs backup and returns its result. The result is returned with the error if the backup
+// failed in some of the destinations
+func BackupWithResult(o BackupOptions) (*BackupResult, error) {
+	if o.Dst != "" {
+		o.Dsts = append(append([]string{}, o.Dsts...), o.Dst)
+		o.Dst = ""
+	}
+	if o.CassandraDatacenter != "" {
+		dc, err := GetCassandraDatacenter(o.Kubeconfig, o.Context, o.Namespace, o.CassandraDatacenter)
+		if err != nil {
+			return nil, err
+		}
+		dc.apply(&o.Namespace, &o.Selector, &o.StatefulSet, &o.Container, &o.CassandraDataDir, &o.CredentialsSecret)
+	}
+	recorder := newEventRecorder(o.Events, o.Annotate, o.Kubeconfig, o.Context, o.Namespace, o.Selector, o.StatefulSet)
+	recorder.backupStarted(o.Keyspace)
+	result, err := runBackup(o)
+	recorder.backupFinished(o.Keyspace, result, err)
+
+	return result, err
+}
+
+func runBackup(o BackupOptions) (*BackupResult, error) {
+	log.Println("Backup started!")
+	if len(o.Dsts) == 0 {
+		return nil, fmt.Errorf("at least one destination is required")
+	}
+	for _, dst := range o.Dsts {
+		dstPrefix, _, _, err := utils.SplitDestination(dst, utils.StorageOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if err := utils.TestImplementationsExist("k8s", dstPrefix); err != nil {
+			return nil, err
+		}
+	}
+	if err := utils.TestCompressionCodec(o.Compression); err != nil {
+		return nil, err
+	}
+	if err := TestLayout(o.Layout); err != nil {
+		return nil, err
+	}
+	if err := TestHooks(o.Hooks, backupHookPhases, o.Agent); err != nil {
+		return nil, err
+	}
+	if o.Agent && o.EncryptionKeySecret != "" {
+		return nil, fmt.Errorf("encryption key secrets are not supported with agents")
+	}
 
 	log.Println("Getting clients")
-	k8sClient, dstClient, err := skbn.GetClients("k8s", dstPrefix, "", dstPath)
+	retainUntil, err := utils.GetRetainUntil(o.RetainUntil, o.RetentionDays)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	storageOptions := utils.StorageOptions{
+		S3Endpoint:             o.S3Endpoint,
+		S3ForcePathStyle:       o.S3ForcePathStyle,
+		S3StorageClass:         o.S3StorageClass,
+		S3ServerSideEncryption: o.S3ServerSideEncryption,
+		S3SSEKMSKeyID:          o.S3SSEKMSKeyID,
+		S3ACL:                  o.S3ACL,
+		RetentionMode:          o.RetentionMode,
+		RetainUntil:            retainUntil,
+		Kubeconfig:             o.Kubeconfig,
+		KubeContext:            o.Context,
+	}
+	if o.RetentionMode != "" {
+		log.Printf("Objects will be retained in %s mode until %s", o.RetentionMode, retainUntil.Format(time.RFC3339))
+	}
+	k8sClient, err := utils.GetClientToK8s(o.Kubeconfig, o.Context)
+	if err != nil {
+		return nil, err
+	}
+	var dsts []*utils.Destination
+	for _, dst := range o.Dsts {
+		dstPrefix, dstPath, dstOptions, _ := utils.SplitDestination(dst, storageOptions)
+		dstClient, err := utils.GetClient(dstPrefix, dstPath, dstOptions)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", dst, err)
+		}
+		dsts = append(dsts, &utils.Destination{Prefix: dstPrefix, Client: dstClient, BasePath: dstPath})
 	}
 
 	log.Println("Getting pods")
-	pods, err := utils.GetPods(k8sClient, o.Namespace, o.Selector)
+	pods, err := utils.GetReadyPods(k8sClient, o.Namespace, o.Selector, o.StatefulSet, o.UnreadyPods, o.UnreadyTimeout)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if o.Agent {
+		return backupWithAgents(o, k8sClient, pods, dsts, storageOptions)
+	}
+	creds, err := GetCredentials(k8sClient, o.Namespace, o.CredentialsSecret, o.Authentication, o.CassandraUsername, o.NodetoolCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// The topology is only required to back up a single datacenter, it is recorded in the manifest if it is found
+	log.Println("Getting datacenters and racks")
+	topology, err := GetTopology(k8sClient, o.Namespace, o.Container, pods, o.DatacenterLabel, o.RackLabel, creds)
+	if err != nil {
+		if o.Datacenter != "" {
+			return nil, err
+		}
+		log.Println("WARNING:", err)
+	}
+	if o.Datacenter != "" {
+		pods, err = FilterPodsByDatacenter(pods, topology, o.Datacenter)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Backing up %d pods in datacenter %s", len(pods), o.Datacenter)
 	}
 
 	log.Println("Testing existence of data dir")
 	if err := utils.TestK8sDirectory(k8sClient, pods, o.Namespace, o.Container, o.CassandraDataDir); err != nil {
-		return "", err
+		return nil, err
 	}
-	creds := Credentials{
-		enabled:                 o.Authentication,
-		username:                o.CassandraUsername,
-		nodetoolCredentialsFile: o.NodetoolCredentialsFile,
-	}
-	if o.Authentication {
+	if o.Authentication && o.CredentialsSecret == "" {
 		log.Println("Testing existence of nodetool credentials file")
 		if err := utils.TestK8sDirectory(k8sClient, pods, o.Namespace, o.Container, o.NodetoolCredentialsFile); err != nil {
-			return "", err
+			return nil, err
+		}
+	}
+
+	keys, err := getEncryptionKeys(k8sClient, o.Namespace, o.EncryptionKey, o.EncryptionKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	var encryptionKey []byte
+	var encryption *utils.Encryption
+	if keys.enabled() {
+		log.Println("Getting encryption key")
+		encryptionKey, encryption, err = keys.newDataKey(o.EncryptionKeyID)
+		if err != nil {
+			return nil, err
 		}
+		log.Println("Encrypting with key", encryption.KeyID)
 	}
 
 	log.Println("Backing up schema")
-	dstBasePath, err := BackupKeyspaceSchema(k8sClient, dstClient, o.Namespace, pods[0], o.Container, o.Keyspace, dstPrefix, dstPath, creds, o.S3MaxUploadParts, o.S3PartSize, o.Verbose)
+	schema, backupPath, err := GetKeyspaceSchema(k8sClient, o.Namespace, pods[0], o.Container, o.Keyspace, creds)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	for _, dst := range dsts {
+		if err := UploadKeyspaceSchema(dst.Client, dst.Prefix, filepath.Join(dst.BasePath, backupPath), schema, o.S3MaxUploadParts, o.S3PartSize, o.Verbose); err != nil {
+			dst.Fail(err)
+		}
+	}
+	if err := destinationsError(dsts, false); err != nil {
+		return nil, err
+	}
+
+	hc := HookContext{Phase: HookPreSnapshot, Namespace: o.Namespace, Keyspace: o.Keyspace, Pods: pods}
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return nil, err
 	}
 
 	log.Println("Taking snapshots")
 	tag := TakeSnapshots(k8sClient, pods, o.Namespace, o.Container, o.Keyspace, creds)
+	// Snapshots are cleared whether the backup succeeds or not
+	defer func() {
+		log.Println("Clearing snapshots")
+		ClearSnapshots(k8sClient, pods, o.Namespace, o.Container, o.Keyspace, tag, creds)
+	}()
+	hc.Phase, hc.Tag = HookPostSnapshot, tag
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return nil, err
+	}
 
 	log.Println("Calculating paths. This may take a while...")
-	fromToPathsAllPods, err := utils.GetFromAndToPathsFromK8s(k8sClient, pods, o.Namespace, o.Container, o.Keyspace, tag, dstBasePath, o.CassandraDataDir)
+	// Paths are relative to the destinations
+	fromToPathsAllPods, err := utils.GetFromAndToPathsFromK8s(k8sClient, pods, o.Namespace, o.Container, o.Keyspace, tag, backupPath, o.CassandraDataDir)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	log.Println("Building manifest")
+	tagPath := filepath.Join(backupPath, tag)
+	manifest, err := BuildManifest(k8sClient, o.Keyspace, filepath.Base(backupPath), tag, tagPath, fromToPathsAllPods, o.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Compression = o.Compression
+	manifest.Encryption = encryption
+	manifest.Layout = o.Layout
+	manifest.Datacenter = o.Datacenter
+	if topology != nil {
+		manifest.Topology = make(map[string]NodeTopology)
+		for _, pod := range pods {
+			manifest.Topology[pod] = topology[pod]
+		}
+	}
+	var archives []utils.Archive
+	if o.Layout == LayoutArchive {
+		archives = BuildArchives(fromToPathsAllPods, tagPath, manifest, o.ArchiveMaxSize*1024*1024)
+		log.Printf("Archiving %d files to %d archives", len(fromToPathsAllPods), len(archives))
+	}
+	for i := range fromToPathsAllPods {
+		fromToPathsAllPods[i].ToPath = manifest.ObjectName(fromToPathsAllPods[i].ToPath)
+	}
+
+	var encrypt, decrypt utils.StreamTransform
+	if encryptionKey != nil {
+		encrypt, decrypt = utils.NewEncryptTransform(encryptionKey), utils.NewDecryptTransform(encryptionKey)
 	}
+	// Compress before encrypting, encrypted data does not compress
+	transform := utils.ChainTransforms(utils.NewCompressTransform(o.Compression), encrypt)
+	verifyTransform := utils.ChainTransforms(decrypt, utils.NewDecompressTransform(o.Compression))
 
 	log.Println("Starting files copy")
-	if err := skbn.PerformCopy(k8sClient, dstClient, "k8s", dstPrefix, fromToPathsAllPods, o.Parallel, o.BufferSize, o.S3PartSize, o.S3MaxUploadParts, o.Verbose); err != nil {
-		return "", err
+	limiter := utils.NewBandwidthLimiter(o.MaxBandwidth, o.MaxPodBandwidth)
+	if o.Layout == LayoutArchive {
+		err = utils.PerformArchiveFanOutCopy(k8sClient, dsts, archives, o.Parallel, o.BufferSize, o.S3PartSize, o.S3MaxUploadParts, transform, limiter, o.Verbose)
+	} else {
+		err = utils.PerformFanOutCopy(k8sClient, "k8s", dsts, fromToPathsAllPods, o.Parallel, o.BufferSize, o.S3PartSize, o.S3MaxUploadParts, transform, limiter, o.Verbose)
+	}
+	if err != nil {
+		if dstsErr := destinationsError(dsts, false); dstsErr != nil {
+			return nil, dstsErr
+		}
+		return nil, err
+	}
+	if o.Layout == LayoutArchive {
+		RecordArchives(archives, tagPath, manifest)
+	}
+
+	for _, dst := range dsts {
+		if dst.Err() != nil {
+			continue
+		}
+		if err := completeBackup(dst, tagPath, manifest, transform != nil, verifyTransform, o); err != nil {
+			dst.Fail(err)
+		}
 	}
+	hc.Phase = HookPostUpload
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return nil, err
+	}
+
+	return backupResult(tag, tagPath, manifest, dsts)
+}
 
-	log.Println("Clearing snapshots")
-	ClearSnapshots(k8sClient, pods, o.Namespace, o.Container, o.Keyspace, tag, creds)
+// backupResult returns the result of a backup, and an error describing the destinations it failed in
+func backupResult(tag, tagPath string, manifest *Manifest, dsts []*utils.Destination) (*BackupResult, error) {
+	result := &BackupResult{
+		Tag:        tag,
+		Path:       tagPath,
+		Files:      len(manifest.Files),
+		FailedDsts: make(map[string]string),
+	}
+	for _, info := range manifest.Files {
+		result.Bytes += info.Size
+	}
+	for _, info := range manifest.Objects() {
+		result.StoredBytes += info.storedSize()
+	}
+	for _, dst := range dsts {
+		if err := dst.Err(); err != nil {
+			result.FailedDsts[dst.String()] = err.Error()
+		}
+	}
+	if err := destinationsError(dsts, true); err != nil {
+		return result, err
+	}
 
 	log.Println("All done!")
-	return tag, nil
+	return result, nil
+}
+
+// completeBackup records and verifies the files of a backup in a destination, and marks the backup as complete
+func completeBackup(dst *utils.Destination, tagPath string, manifest *Manifest, transformed bool, verifyTransform utils.StreamTransform, o BackupOptions) error {
+	dstTagPath := filepath.Join(dst.BasePath, tagPath)
+
+	if transformed {
+		log.Println("Recording sizes of stored files in", dst)
+		if err := RecordStoredSizes(dst.Client, dst.Prefix, dstTagPath, manifest); err != nil {
+			return err
+		}
+	}
+
+	if o.Checksum {
+		log.Println("Verifying checksums of uploaded files in", dst)
+		if err := VerifyUploadedFiles(dst.Client, dst.Prefix, dstTagPath, manifest, o.Parallel, verifyTransform, o.Verbose); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Uploading manifest to", dst)
+	if err := UploadManifest(dst.Client, dst.Prefix, dstTagPath, manifest, o.S3MaxUploadParts, o.S3PartSize, o.Verbose); err != nil {
+		return err
+	}
+
+	log.Println("Marking backup as complete in", dst)
+	return WriteCompletionMarker(dst.Client, dst.Prefix, dstTagPath, o.S3MaxUploadParts, o.S3PartSize, o.Verbose)
+}
+
+// destinationsError returns an error describing the failed destinations of a backup
+// If partial is false, an error is only returned if all destinations failed
+// If partial is true, the result of every destination is logged if there are several destinations
+func destinationsError(dsts []*utils.Destination, partial bool) error {
+	var failed []string
+	for _, dst := range dsts {
+		err := dst.Err()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", dst, err))
+		}
+		if !partial || len(dsts) == 1 {
+			continue
+		}
+		if err != nil {
+			log.Println("FAILED:", dst, err)
+		} else {
+			log.Println("SUCCEEDED:", dst)
+		}
+	}
+	if len(failed) == 0 || (!partial && len(failed) != len(dsts)) {
+		return nil
+	}
+	if len(dsts) == 1 {
+		return dsts[0].Err()
+	}
+
+	return fmt.Errorf("backup failed in %d of %d destinations: %s", len(failed), len(dsts), strings.Join(failed, "; "))
 }
 
 // RestoreOptions are the options to pass to Restore
@@ -104,122 +433,310 @@ type RestoreOptions struct {
 	Keyspace                string
 	Tag                     string
 	Schema                  string
+	SrcKubeconfig           string
+	SrcContext              string
+	Kubeconfig              string
+	Context                 string
 	Namespace               string
 	Selector                string
+	StatefulSet             string
+	CassandraDatacenter     string
+	UnreadyPods             string
+	UnreadyTimeout          time.Duration
 	Container               string
 	Parallel                int
 	BufferSize              float64
 	S3MaxDownloadParts      int
 	S3PartSize              int64
+	MaxBandwidth            float64
+	MaxPodBandwidth         float64
+	S3Endpoint              string
+	S3ForcePathStyle        bool
 	UserGroup               string
 	CassandraDataDir        string
 	Authentication          bool
 	CassandraUsername       string
 	NodetoolCredentialsFile string
+	CredentialsSecret       string
+	AllowIncomplete         bool
+	Checksum                bool
+	EncryptionKey           string
+	EncryptionKeySecret     string
+	Rehydrate               bool
+	RehydrateDays           int
+	Datacenter              string
+	DatacenterLabel         string
+	RackLabel               string
+	Agent                   bool
+	AgentPort               int
+	AgentTokenFile          string
+	AgentCAFile             string
+	Events                  bool
+	Hooks                   []Hook
 	Verbose                 bool
 }
 
 // Restore performs restore
 func Restore(o RestoreOptions) error {
+	_, err := RestoreWithResult(o)
+	return err
+}
+
+// RestoreResult describes a restore
+type RestoreResult struct {
+	Files int
+	// Bytes is the total size of the restored files, known only if the backup has a manifest
+	Bytes int64
+}
+
+// RestoreWithResult performs restore and returns its result
+func RestoreWithResult(o RestoreOptions) (*RestoreResult, error) {
+	if o.CassandraDatacenter != "" {
+		dc, err := GetCassandraDatacenter(o.Kubeconfig, o.Context, o.Namespace, o.CassandraDatacenter)
+		if err != nil {
+			return nil, err
+		}
+		dc.apply(&o.Namespace, &o.Selector, &o.StatefulSet, &o.Container, &o.CassandraDataDir, &o.CredentialsSecret)
+	}
+	recorder := newEventRecorder(o.Events, false, o.Kubeconfig, o.Context, o.Namespace, o.Selector, o.StatefulSet)
+	recorder.restoreStarted(o.Keyspace, o.Tag)
+	result, err := runRestore(o)
+	recorder.restoreFinished(o.Keyspace, o.Tag, result, err)
+
+	return result, err
+}
+
+func runRestore(o RestoreOptions) (*RestoreResult, error) {
 	log.Println("Restore started!")
 	srcPrefix, srcBasePath := utils.SplitInTwo(o.Src, "://")
 
+	if err := utils.TestImplementationsExist(srcPrefix, "k8s"); err != nil {
+		return nil, err
+	}
+	if err := TestHooks(o.Hooks, restoreHookPhases, o.Agent); err != nil {
+		return nil, err
+	}
+	if o.Agent && o.EncryptionKeySecret != "" {
+		return nil, fmt.Errorf("encryption key secrets are not supported with agents")
+	}
+
 	log.Println("Getting clients")
-	srcClient, k8sClient, err := skbn.GetClients(srcPrefix, "k8s", srcBasePath, "")
+	// A backup in a pvc may be read from another cluster than the one restored to
+	storageOptions := utils.StorageOptions{
+		S3Endpoint:       o.S3Endpoint,
+		S3ForcePathStyle: o.S3ForcePathStyle,
+		Kubeconfig:       stringOrDefault(o.SrcKubeconfig, o.Kubeconfig),
+		KubeContext:      stringOrDefault(o.SrcContext, o.Context),
+	}
+	srcClient, err := utils.GetClient(srcPrefix, srcBasePath, storageOptions)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	k8sClient, err := utils.GetClientToK8s(o.Kubeconfig, o.Context)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Println("Getting pods")
-	existingPods, err := utils.GetPods(k8sClient, o.Namespace, o.Selector)
+	existingPods, err := utils.GetReadyPods(k8sClient, o.Namespace, o.Selector, o.StatefulSet, o.UnreadyPods, o.UnreadyTimeout)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if o.Agent {
+		return restoreWithAgents(o, srcClient, k8sClient, srcPrefix, srcBasePath, storageOptions, existingPods)
+	}
+	creds, err := GetCredentials(k8sClient, o.Namespace, o.CredentialsSecret, o.Authentication, o.CassandraUsername, o.NodetoolCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Datacenter != "" {
+		log.Println("Getting datacenters and racks")
+		topology, err := GetTopology(k8sClient, o.Namespace, o.Container, existingPods, o.DatacenterLabel, o.RackLabel, creds)
+		if err != nil {
+			return nil, err
+		}
+		existingPods, err = FilterPodsByDatacenter(existingPods, topology, o.Datacenter)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Restoring %d pods in datacenter %s", len(existingPods), o.Datacenter)
 	}
 
 	log.Println("Testing existence of data dir")
 	if err := utils.TestK8sDirectory(k8sClient, existingPods, o.Namespace, o.Container, o.CassandraDataDir); err != nil {
-		return err
+		return nil, err
 	}
-	creds := Credentials{
-		enabled:                 o.Authentication,
-		username:                o.CassandraUsername,
-		nodetoolCredentialsFile: o.NodetoolCredentialsFile,
-	}
-	if o.Authentication {
+	if o.Authentication && o.CredentialsSecret == "" {
 		log.Println("Testing existence of nodetool credentials file")
 		if err := utils.TestK8sDirectory(k8sClient, existingPods, o.Namespace, o.Container, o.NodetoolCredentialsFile); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	log.Println("Getting current schema")
-	_, sum, err := DescribeKeyspaceSchema(k8sClient, o.Namespace, existingPods[0], o.Container, o.Keyspace)
+	_, sum, err := DescribeKeyspaceSchema(k8sClient, o.Namespace, existingPods[0], o.Container, o.Keyspace, creds)
 	if err != nil {
 		if o.Schema == "" {
-			return err
+			return nil, err
 		}
 		log.Println("Schema not found, restoring schema", o.Schema)
-		sum, err = RestoreKeyspaceSchema(srcClient, k8sClient, srcPrefix, srcBasePath, o.Namespace, existingPods[0], o.Container, o.Keyspace, o.Schema, o.Parallel, o.BufferSize, o.S3MaxDownloadParts, o.S3PartSize, o.Verbose)
+		sum, err = RestoreKeyspaceSchema(srcClient, k8sClient, srcPrefix, srcBasePath, o.Namespace, existingPods[0], o.Container, o.Keyspace, o.Schema, creds, o.Parallel, o.BufferSize, o.S3MaxDownloadParts, o.S3PartSize, o.Verbose)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		log.Println("Restored schema:", sum)
 	}
 
 	if o.Schema != "" && sum != o.Schema {
-		return fmt.Errorf("specified schema %s is not the same as found schema %s", o.Schema, sum)
+		return nil, fmt.Errorf("specified schema %s is not the same as found schema %s", o.Schema, sum)
 	}
 
 	log.Println("Found schema:", sum)
 
-	log.Println("Calculating paths. This may take a while...")
 	srcPath := filepath.Join(srcBasePath, o.Keyspace, sum, o.Tag)
-	fromToPaths, podsToBeRestored, tablesToRefresh, err := utils.GetFromAndToPathsSrcToK8s(srcClient, k8sClient, srcPrefix, srcPath, srcBasePath, o.Namespace, o.Container, o.CassandraDataDir)
+	log.Println("Testing backup completeness")
+	if err := TestBackupComplete(srcClient, srcPrefix, srcPath, o.AllowIncomplete); err != nil {
+		return nil, err
+	}
+
+	log.Println("Testing rehydration of archived files")
+	if err := TestRehydration(srcClient, srcPrefix, srcPath, o.Rehydrate, o.RehydrateDays, o.Verbose); err != nil {
+		return nil, err
+	}
+
+	log.Println("Reading manifest")
+	manifest, err := ReadManifest(srcClient, srcPrefix, srcPath, o.Verbose)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if manifest == nil && o.Checksum {
+		log.Println("WARNING: backup has no manifest, checksums will not be verified")
+	}
+	keys, err := getEncryptionKeys(k8sClient, o.Namespace, o.EncryptionKey, o.EncryptionKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	transform, err := restoreTransform(manifest, keys)
+	if err != nil {
+		return nil, err
+	}
+	suffix := ""
+	if manifest != nil {
+		suffix = utils.CompressionSuffix(manifest.Compression)
+	}
+
+	log.Println("Calculating paths. This may take a while...")
+	var selectedPods []string
+	if o.Datacenter != "" {
+		selectedPods = datacenterPodsToRestore(manifest, existingPods, o.Datacenter)
+		if len(selectedPods) == 0 {
+			return nil, fmt.Errorf("backup has no pods in datacenter %s", o.Datacenter)
+		}
+	}
+	fromToPaths, podsToBeRestored, tablesToRefresh, err := utils.GetFromAndToPathsSrcToK8s(srcClient, k8sClient, srcPrefix, srcPath, srcBasePath, o.Namespace, o.Container, o.CassandraDataDir, suffix, selectedPods)
+	if err != nil {
+		return nil, err
+	}
+	if len(fromToPaths) == 0 {
+		if o.Datacenter != "" {
+			return nil, fmt.Errorf("no files found to restore in datacenter %s", o.Datacenter)
+		}
+		return nil, fmt.Errorf("no files found to restore")
 	}
 
 	log.Println("Validating pods match restore")
 	if err := utils.SliceContainsSlice(podsToBeRestored, existingPods); err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Println("Getting materialized views to exclude")
-	materializedViews, err := GetMaterializedViews(k8sClient, o.Namespace, o.Container, existingPods[0], o.Keyspace)
+	materializedViews, err := GetMaterializedViews(k8sClient, o.Namespace, o.Container, existingPods[0], o.Keyspace, creds)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	hc := HookContext{Phase: HookPreTruncate, Namespace: o.Namespace, Keyspace: o.Keyspace, Tag: o.Tag, Pods: existingPods}
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return nil, err
 	}
 
 	log.Println("Truncating tables")
-	TruncateTables(k8sClient, o.Namespace, o.Container, o.Keyspace, existingPods, tablesToRefresh, materializedViews)
+	TruncateTables(k8sClient, o.Namespace, o.Container, o.Keyspace, existingPods, tablesToRefresh, materializedViews, creds)
 
 	log.Println("Starting files copy")
-	if err := skbn.PerformCopy(srcClient, k8sClient, srcPrefix, "k8s", fromToPaths, o.Parallel, o.BufferSize, o.S3PartSize, o.S3MaxDownloadParts, o.Verbose); err != nil {
-		return err
+	limiter := utils.NewBandwidthLimiter(o.MaxBandwidth, o.MaxPodBandwidth)
+	archived := manifest != nil && manifest.Layout == LayoutArchive
+	if archived {
+		if err := utils.PerformArchiveRestore(srcClient, k8sClient, srcPrefix, fromToPaths, o.Parallel, o.BufferSize, transform, limiter, o.Verbose); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := utils.PerformCopy(srcClient, k8sClient, srcPrefix, "k8s", fromToPaths, o.Parallel, o.BufferSize, o.S3PartSize, o.S3MaxDownloadParts, transform, limiter, o.Verbose); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.Checksum && manifest != nil {
+		log.Println("Verifying checksums of restored files")
+		restoredFiles := fromToPaths
+		if archived {
+			restoredFiles = ArchivedFiles(fromToPaths, srcPath, manifest)
+		}
+		if err := VerifyRestoredFiles(k8sClient, srcPath, restoredFiles, manifest); err != nil {
+			return nil, err
+		}
 	}
 
 	log.Println("Changing files ownership")
 	if err := utils.ChangeFilesOwnership(k8sClient, existingPods, o.Namespace, o.Container, o.UserGroup, o.CassandraDataDir); err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Println("Refreshing tables")
 	RefreshTables(k8sClient, o.Namespace, o.Container, o.Keyspace, podsToBeRestored, tablesToRefresh, creds)
+	hc.Phase, hc.Pods = HookPostRefresh, podsToBeRestored
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return nil, err
+	}
+
+	result := &RestoreResult{Files: len(fromToPaths)}
+	if manifest != nil {
+		restoredFiles := fromToPaths
+		if archived {
+			restoredFiles = ArchivedFiles(fromToPaths, srcPath, manifest)
+		}
+		result.Files = len(restoredFiles)
+		for _, ftp := range restoredFiles {
+			result.Bytes += manifest.Files[manifest.FileName(utils.RelativePath(ftp.FromPath, srcPath))].Size
+		}
+	}
 
 	log.Println("All done!")
-	return nil
+	return result, nil
 }
 
 // SchemaOptions are the options to pass to Schema
 type SchemaOptions struct {
-	Namespace string
-	Selector  string
-	Container string
-	Keyspace  string
+	Kubeconfig          string
+	Context             string
+	Namespace           string
+	Selector            string
+	CassandraDatacenter string
+	Container           string
+	Keyspace            string
+	CredentialsSecret   string
 }
 
 // Schema gets the schema of the cassandra cluster
 func Schema(o SchemaOptions) ([]byte, string, error) {
-	k8sClient, err := skbn.GetClientToK8s()
+	if o.CassandraDatacenter != "" {
+		dc, err := GetCassandraDatacenter(o.Kubeconfig, o.Context, o.Namespace, o.CassandraDatacenter)
+		if err != nil {
+			return nil, "", err
+		}
+		dc.apply(&o.Namespace, &o.Selector, nil, &o.Container, nil, &o.CredentialsSecret)
+	}
+	k8sClient, err := utils.GetClientToK8s(o.Kubeconfig, o.Context)
 	if err != nil {
 		return nil, "", err
 	}
@@ -227,7 +744,11 @@ func Schema(o SchemaOptions) ([]byte, string, error) {
 	if err != nil {
 		return nil, "", err
 	}
-	schema, sum, err := DescribeKeyspaceSchema(k8sClient, o.Namespace, pods[0], o.Container, o.Keyspace)
+	creds, err := GetCredentials(k8sClient, o.Namespace, o.CredentialsSecret, false, "", "")
+	if err != nil {
+		return nil, "", err
+	}
+	schema, sum, err := DescribeKeyspaceSchema(k8sClient, o.Namespace, pods[0], o.Container, o.Keyspace, creds)
 	if err != nil {
 		return nil, "", err
 	}
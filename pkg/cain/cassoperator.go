@@ -0,0 +1,117 @@
+package cain
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/nuvo/cain/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// CassandraDatacenterResource is the resource of cass-operator (K8ssandra) datacenters
+var CassandraDatacenterResource = schema.GroupVersionResource{Group: "cassandra.datastax.com", Version: "v1beta1", Resource: "cassandradatacenters"}
+
+// Conventions of pods managed by cass-operator
+const (
+	CassOperatorClusterLabel    = "cassandra.datastax.com/cluster"
+	CassOperatorDatacenterLabel = "cassandra.datastax.com/datacenter"
+	CassOperatorContainer       = "cassandra"
+	CassOperatorDataDir         = "/var/lib/cassandra/data"
+)
+
+// CassandraDatacenter holds the fields cain reads from a cass-operator CassandraDatacenter
+type CassandraDatacenter struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              CassandraDatacenterSpec `json:"spec"`
+}
+
+// CassandraDatacenterSpec holds the fields cain reads from the spec of a CassandraDatacenter
+type CassandraDatacenterSpec struct {
+	ClusterName         string `json:"clusterName"`
+	DatacenterName      string `json:"datacenterName,omitempty"`
+	SuperuserSecretName string `json:"superuserSecretName,omitempty"`
+}
+
+// GetCassandraDatacenter gets a CassandraDatacenter by reference, "name" in namespace or "namespace/name"
+func GetCassandraDatacenter(kubeconfig, context, namespace, reference string) (*CassandraDatacenter, error) {
+	if split := strings.SplitN(reference, "/", 2); len(split) == 2 {
+		namespace, reference = split[0], split[1]
+	}
+	k8sClient, err := utils.GetClientToK8s(kubeconfig, context)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(k8sClient.Config)
+	if err != nil {
+		return nil, err
+	}
+	u, err := client.Resource(CassandraDatacenterResource).Namespace(namespace).Get(reference, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get CassandraDatacenter %s/%s: %s", namespace, reference, err)
+	}
+	dc := &CassandraDatacenter{}
+	if err := fromUnstructured(u, dc); err != nil {
+		return nil, err
+	}
+	if dc.Spec.ClusterName == "" {
+		return nil, fmt.Errorf("CassandraDatacenter %s/%s has no cluster name", namespace, reference)
+	}
+
+	return dc, nil
+}
+
+// Selector returns the selector of the cassandra pods of the datacenter
+func (dc *CassandraDatacenter) Selector() string {
+	datacenter := dc.Spec.DatacenterName
+	if datacenter == "" {
+		datacenter = dc.Name
+	}
+	return fmt.Sprintf("%s=%s,%s=%s", CassOperatorClusterLabel, cleanLabelValue(dc.Spec.ClusterName), CassOperatorDatacenterLabel, cleanLabelValue(datacenter))
+}
+
+// SuperuserSecret returns the name of the secret holding the superuser credentials of the cluster
+func (dc *CassandraDatacenter) SuperuserSecret() string {
+	if dc.Spec.SuperuserSecretName != "" {
+		return dc.Spec.SuperuserSecretName
+	}
+	return cleanupForKubernetes(dc.Spec.ClusterName) + "-superuser"
+}
+
+// apply sets the namespace, selector, container, data dir and credentials secret of cain options to those of the datacenter
+// Pods are found by selector, since cass-operator creates a statefulset per rack. A credentials secret which is set is kept
+func (dc *CassandraDatacenter) apply(namespace, selector, statefulSet, container, cassandraDataDir, credentialsSecret *string) {
+	log.Printf("Found CassandraDatacenter %s/%s of cluster %s", dc.Namespace, dc.Name, dc.Spec.ClusterName)
+	*namespace = dc.Namespace
+	*selector = dc.Selector()
+	if statefulSet != nil {
+		*statefulSet = ""
+	}
+	*container = CassOperatorContainer
+	if cassandraDataDir != nil {
+		*cassandraDataDir = CassOperatorDataDir
+	}
+	if *credentialsSecret == "" {
+		*credentialsSecret = dc.SuperuserSecret()
+	}
+}
+
+var (
+	invalidLabelValueChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+	invalidNameChars       = regexp.MustCompile(`[^a-z0-9.-]`)
+)
+
+// cleanLabelValue removes the characters cass-operator removes from label values
+func cleanLabelValue(value string) string {
+	return strings.TrimLeft(invalidLabelValueChars.ReplaceAllString(value, ""), "_.-")
+}
+
+// cleanupForKubernetes converts a cluster name to a resource name, as cass-operator does for the names of its resources
+func cleanupForKubernetes(name string) string {
+	return invalidNameChars.ReplaceAllString(strings.ToLower(name), "")
+}
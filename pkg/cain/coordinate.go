@@ -0,0 +1,668 @@
+package cain
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+// AgentClient calls the agent API of a single pod
+type AgentClient struct {
+	Pod    string
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// GetAgentClients returns clients to the agents of pods, keyed by pod. Agents are reached at the IPs of the pods,
+// over https if caFile is set. Certificates of agents are verified against the CA, not against the IPs
+func GetAgentClients(iK8sClient interface{}, namespace string, pods []string, port int, tokenFile, caFile string) (map[string]*AgentClient, error) {
+	token, err := readAgentToken(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := utils.GetPodIPs(iK8sClient, namespace, pods)
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		port = AgentPort
+	}
+
+	scheme := "http"
+	client := &http.Client{}
+	if caFile != "" {
+		tlsConfig, err := agentTLSConfig(caFile)
+		if err != nil {
+			return nil, err
+		}
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	agents := make(map[string]*AgentClient)
+	for _, pod := range pods {
+		agents[pod] = &AgentClient{
+			Pod:    pod,
+			URL:    fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(ips[pod], strconv.Itoa(port))),
+			Token:  token,
+			Client: client,
+		}
+	}
+
+	return agents, nil
+}
+
+// Nodetool runs nodetool in the pod of the agent
+func (c *AgentClient) Nodetool(args ...string) (string, error) {
+	response := &AgentCommandResponse{}
+	if err := c.call(agentNodetoolPath, AgentCommandRequest{Args: args}, response); err != nil {
+		return "", err
+	}
+	return response.Output, nil
+}
+
+// Cqlsh runs a cql statement in the pod of the agent
+func (c *AgentClient) Cqlsh(statement string) ([]byte, error) {
+	response := &AgentCommandResponse{}
+	if err := c.call(agentCqlshPath, AgentCommandRequest{Statement: statement}, response); err != nil {
+		return nil, err
+	}
+	return []byte(response.Output), nil
+}
+
+// CqlshScript runs a cql script in the pod of the agent
+func (c *AgentClient) CqlshScript(script string) ([]byte, error) {
+	response := &AgentCommandResponse{}
+	if err := c.call(agentCqlshPath, AgentCommandRequest{Script: script}, response); err != nil {
+		return nil, err
+	}
+	return []byte(response.Output), nil
+}
+
+// call posts a request to the agent and decodes its response
+func (c *AgentClient) call(path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("agent of pod %s: %s", c.Pod, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return fmt.Errorf("agent of pod %s: %s", c.Pod, strings.TrimSpace(string(b)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// agentTLSConfig returns a tls configuration which trusts certificates signed by the CA in caFile
+// Host names are not verified, since agents are reached by the IPs of their pods
+func agentTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("agent presented no certificate")
+			}
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates})
+			return err
+		},
+	}, nil
+}
+
+// forEachAgent runs f on the agents of pods in parallel
+func forEachAgent(agents map[string]*AgentClient, pods []string, f func(agent *AgentClient) error) error {
+	errc := make(chan error, len(pods))
+	bwg := utils.NewBoundedWaitGroup(len(pods))
+	for _, pod := range pods {
+		bwg.Add(1)
+
+		go func(agent *AgentClient) {
+			defer bwg.Done()
+			if err := f(agent); err != nil {
+				errc <- err
+			}
+		}(agents[pod])
+	}
+	bwg.Wait()
+	close(errc)
+
+	return <-errc
+}
+
+// agentBandwidth returns the bandwidth limit of each agent, 0 if unlimited
+// The total limit is divided between the agents, since each agent limits its own copy
+func agentBandwidth(maxBandwidth, maxPodBandwidth float64, agents int) float64 {
+	bandwidth := maxPodBandwidth
+	if maxBandwidth > 0 && agents > 0 {
+		if share := maxBandwidth / float64(agents); bandwidth == 0 || share < bandwidth {
+			bandwidth = share
+		}
+	}
+	return bandwidth
+}
+
+// getAgentsTopology gets the datacenter and rack of pods, from labels if datacenterLabel is set and from their agents otherwise
+func getAgentsTopology(iK8sClient interface{}, namespace string, agents map[string]*AgentClient, pods []string, datacenterLabel, rackLabel string) (map[string]NodeTopology, error) {
+	if datacenterLabel != "" {
+		return GetTopology(iK8sClient, namespace, "", pods, datacenterLabel, rackLabel, Credentials{})
+	}
+
+	topology := make(map[string]NodeTopology)
+	var mutex sync.Mutex
+	err := forEachAgent(agents, pods, func(agent *AgentClient) error {
+		output, err := agent.Nodetool("info")
+		if err != nil {
+			return err
+		}
+		node, err := parseNodeTopology(output)
+		if err != nil {
+			return fmt.Errorf("%s: %s", agent.Pod, err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		topology[agent.Pod] = node
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get datacenter and rack of pods: %s", err)
+	}
+
+	return topology, nil
+}
+
+// describeKeyspaceSchemaWithAgent describes the schema of the keyspace using an agent
+func describeKeyspaceSchemaWithAgent(agent *AgentClient, keyspace string) ([]byte, string, error) {
+	schema, err := agent.Cqlsh(fmt.Sprintf("DESC %s;", keyspace))
+	if err != nil {
+		return nil, "", fmt.Errorf("Could not describe schema. make sure a schema exists for keyspace \"%s\" or restore it using \"--schema\". %s", keyspace, err)
+	}
+
+	return schema, schemaSum(schema), nil
+}
+
+// backupWithAgents performs backup of pods by their agents, which upload the files of their snapshots directly
+func backupWithAgents(o BackupOptions, k8sClient interface{}, pods []string, dsts []*utils.Destination, storageOptions utils.StorageOptions) (*BackupResult, error) {
+	if o.Layout == LayoutArchive {
+		return nil, fmt.Errorf("%s layout is not supported with agents", LayoutArchive)
+	}
+	for _, dst := range dsts {
+		if err := testAgentStorage(dst.Prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Println("Getting agents")
+	agents, err := GetAgentClients(k8sClient, o.Namespace, pods, o.AgentPort, o.AgentTokenFile, o.AgentCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// The topology is only required to back up a single datacenter, it is recorded in the manifest if it is found
+	log.Println("Getting datacenters and racks")
+	topology, err := getAgentsTopology(k8sClient, o.Namespace, agents, pods, o.DatacenterLabel, o.RackLabel)
+	if err != nil {
+		if o.Datacenter != "" {
+			return nil, err
+		}
+		log.Println("WARNING:", err)
+	}
+	if o.Datacenter != "" {
+		pods, err = FilterPodsByDatacenter(pods, topology, o.Datacenter)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Backing up %d pods in datacenter %s", len(pods), o.Datacenter)
+	}
+
+	var encryptionKey []byte
+	var encryption *utils.Encryption
+	if o.EncryptionKey != "" {
+		log.Println("Getting encryption key")
+		encryptionKey, encryption, err = utils.NewDataKey(o.EncryptionKey, o.EncryptionKeyID)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Encrypting with key", encryption.KeyID)
+	}
+
+	log.Println("Backing up schema")
+	output, err := agents[pods[0]].Nodetool("describecluster")
+	if err != nil {
+		return nil, err
+	}
+	schema, sum, err := describeKeyspaceSchemaWithAgent(agents[pods[0]], o.Keyspace)
+	if err != nil {
+		return nil, err
+	}
+	backupPath := filepath.Join(o.Namespace, parseClusterName(output), o.Keyspace, sum)
+	for _, dst := range dsts {
+		if err := UploadKeyspaceSchema(dst.Client, dst.Prefix, filepath.Join(dst.BasePath, backupPath), schema, o.S3MaxUploadParts, o.S3PartSize, o.Verbose); err != nil {
+			dst.Fail(err)
+		}
+	}
+	if err := destinationsError(dsts, false); err != nil {
+		return nil, err
+	}
+
+	hc := HookContext{Phase: HookPreSnapshot, Namespace: o.Namespace, Keyspace: o.Keyspace, Pods: pods}
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return nil, err
+	}
+
+	log.Println("Taking snapshots")
+	tag := utils.GetTimeStamp()
+	err = forEachAgent(agents, pods, func(agent *AgentClient) error {
+		log.Println(agent.Pod, "Taking snapshot of keyspace", o.Keyspace)
+		output, err := agent.Nodetool("snapshot", "-t", tag, o.Keyspace)
+		printOutput(output, agent.Pod)
+		return err
+	})
+	// Snapshots are cleared whether the backup succeeds or not, including those taken before a pod failed
+	defer func() {
+		log.Println("Clearing snapshots")
+		err := forEachAgent(agents, pods, func(agent *AgentClient) error {
+			log.Println(agent.Pod, "Clearing snapshot of keyspace", o.Keyspace)
+			output, err := agent.Nodetool("clearsnapshot", "-t", tag, o.Keyspace)
+			printOutput(output, agent.Pod)
+			return err
+		})
+		if err != nil {
+			log.Println("WARNING: could not clear snapshots:", err)
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	hc.Phase, hc.Tag = HookPostSnapshot, tag
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return nil, err
+	}
+
+	log.Println("Starting files copy")
+	tagPath := filepath.Join(backupPath, tag)
+	manifest := &Manifest{
+		Keyspace:    o.Keyspace,
+		Schema:      sum,
+		Tag:         tag,
+		Compression: o.Compression,
+		Encryption:  encryption,
+		Layout:      o.Layout,
+		Datacenter:  o.Datacenter,
+		Files:       make(map[string]FileInfo),
+	}
+	if topology != nil {
+		manifest.Topology = make(map[string]NodeTopology)
+		for _, pod := range pods {
+			manifest.Topology[pod] = topology[pod]
+		}
+	}
+	bandwidth := agentBandwidth(o.MaxBandwidth, o.MaxPodBandwidth, len(pods))
+	var mutex sync.Mutex
+	err = forEachAgent(agents, pods, func(agent *AgentClient) error {
+		// Destinations which failed in other agents are skipped
+		var agentDsts []string
+		mutex.Lock()
+		for i, dst := range dsts {
+			if dst.Err() == nil {
+				agentDsts = append(agentDsts, o.Dsts[i])
+			}
+		}
+		mutex.Unlock()
+		if len(agentDsts) == 0 {
+			return destinationsError(dsts, false)
+		}
+
+		log.Println(agent.Pod, "Uploading snapshot")
+		response := &AgentBackupResponse{}
+		err := agent.call(agentBackupPath, AgentBackupRequest{
+			Pod:              agent.Pod,
+			Keyspace:         o.Keyspace,
+			Tag:              tag,
+			Path:             backupPath,
+			Dsts:             agentDsts,
+			Storage:          storageOptions,
+			Parallel:         o.Parallel,
+			BufferSize:       o.BufferSize,
+			S3PartSize:       o.S3PartSize,
+			S3MaxUploadParts: o.S3MaxUploadParts,
+			MaxBandwidth:     bandwidth,
+			Compression:      o.Compression,
+			Encryption:       encryption,
+			EncryptionKey:    o.EncryptionKey,
+			Checksum:         o.Checksum,
+			Verbose:          o.Verbose,
+		}, response)
+		if err != nil {
+			return err
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		for file, info := range response.Files {
+			manifest.Files[file] = info
+		}
+		for _, dst := range dsts {
+			if msg, ok := response.FailedDsts[dst.String()]; ok && dst.Err() == nil {
+				dst.Fail(fmt.Errorf("%s: %s", agent.Pod, msg))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if dstsErr := destinationsError(dsts, false); dstsErr != nil {
+			return nil, dstsErr
+		}
+		return nil, err
+	}
+
+	var encrypt, decrypt utils.StreamTransform
+	if encryptionKey != nil {
+		encrypt, decrypt = utils.NewEncryptTransform(encryptionKey), utils.NewDecryptTransform(encryptionKey)
+	}
+	transform := utils.ChainTransforms(utils.NewCompressTransform(o.Compression), encrypt)
+	verifyTransform := utils.ChainTransforms(decrypt, utils.NewDecompressTransform(o.Compression))
+	for _, dst := range dsts {
+		if dst.Err() != nil {
+			continue
+		}
+		if err := completeBackup(dst, tagPath, manifest, transform != nil, verifyTransform, o); err != nil {
+			dst.Fail(err)
+		}
+	}
+	hc.Phase = HookPostUpload
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return nil, err
+	}
+
+	return backupResult(tag, tagPath, manifest, dsts)
+}
+
+// restoreWithAgents performs restore to pods by their agents, which download the files of the backup directly
+func restoreWithAgents(o RestoreOptions, srcClient, k8sClient interface{}, srcPrefix, srcBasePath string, storageOptions utils.StorageOptions, existingPods []string) (*RestoreResult, error) {
+	if err := testAgentStorage(srcPrefix); err != nil {
+		return nil, err
+	}
+
+	log.Println("Getting agents")
+	agents, err := GetAgentClients(k8sClient, o.Namespace, existingPods, o.AgentPort, o.AgentTokenFile, o.AgentCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Datacenter != "" {
+		log.Println("Getting datacenters and racks")
+		topology, err := getAgentsTopology(k8sClient, o.Namespace, agents, existingPods, o.DatacenterLabel, o.RackLabel)
+		if err != nil {
+			return nil, err
+		}
+		existingPods, err = FilterPodsByDatacenter(existingPods, topology, o.Datacenter)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Restoring %d pods in datacenter %s", len(existingPods), o.Datacenter)
+	}
+
+	log.Println("Getting current schema")
+	first := agents[existingPods[0]]
+	_, sum, err := describeKeyspaceSchemaWithAgent(first, o.Keyspace)
+	if err != nil {
+		if o.Schema == "" {
+			return nil, err
+		}
+		log.Println("Schema not found, restoring schema", o.Schema)
+		schema := new(bytes.Buffer)
+		if err := utils.Download(srcClient, srcPrefix, filepath.Join(srcBasePath, o.Keyspace, o.Schema, "schema.cql"), schema, o.Verbose); err != nil {
+			return nil, err
+		}
+		if _, err := first.CqlshScript(schema.String()); err != nil {
+			return nil, err
+		}
+		if _, sum, err = describeKeyspaceSchemaWithAgent(first, o.Keyspace); err != nil {
+			return nil, err
+		}
+		log.Println("Restored schema:", sum)
+	}
+
+	if o.Schema != "" && sum != o.Schema {
+		return nil, fmt.Errorf("specified schema %s is not the same as found schema %s", o.Schema, sum)
+	}
+
+	log.Println("Found schema:", sum)
+
+	srcPath := filepath.Join(srcBasePath, o.Keyspace, sum, o.Tag)
+	log.Println("Testing backup completeness")
+	if err := TestBackupComplete(srcClient, srcPrefix, srcPath, o.AllowIncomplete); err != nil {
+		return nil, err
+	}
+
+	log.Println("Testing rehydration of archived files")
+	if err := TestRehydration(srcClient, srcPrefix, srcPath, o.Rehydrate, o.RehydrateDays, o.Verbose); err != nil {
+		return nil, err
+	}
+
+	log.Println("Reading manifest")
+	manifest, err := ReadManifest(srcClient, srcPrefix, srcPath, o.Verbose)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil && o.Checksum {
+		log.Println("WARNING: backup has no manifest, checksums will not be verified")
+	}
+	if manifest != nil && manifest.Layout == LayoutArchive {
+		return nil, fmt.Errorf("%s layout is not supported with agents", LayoutArchive)
+	}
+	restoreManifest := manifest
+	if restoreManifest == nil {
+		restoreManifest = &Manifest{}
+	}
+
+	log.Println("Calculating paths. This may take a while...")
+	var selectedPods []string
+	if o.Datacenter != "" {
+		selectedPods = datacenterPodsToRestore(manifest, existingPods, o.Datacenter)
+		if len(selectedPods) == 0 {
+			return nil, fmt.Errorf("backup has no pods in datacenter %s", o.Datacenter)
+		}
+	}
+	files, err := utils.GetListOfFiles(srcClient, srcPrefix, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	// Files of each pod are relative to the base path (keyspace/sum/tag/pod/table/file)
+	podFiles := make(map[string][]string)
+	checksums := make(map[string]string)
+	result := &RestoreResult{}
+	for _, file := range files {
+		// Skip backup metadata such as the completion marker
+		if !utils.IsTableFile(file) {
+			continue
+		}
+		// pod/table/file
+		pod := strings.Split(file, "/")[0]
+		if selectedPods != nil && !utils.Contains(selectedPods, pod) {
+			continue
+		}
+		relativePath := filepath.Join(o.Keyspace, sum, o.Tag, file)
+		podFiles[pod] = append(podFiles[pod], relativePath)
+		result.Files++
+		if manifest != nil {
+			info := manifest.Files[manifest.FileName(file)]
+			result.Bytes += info.Size
+			if o.Checksum && info.Sha256 != "" {
+				checksums[relativePath] = info.Sha256
+			}
+		}
+	}
+	if result.Files == 0 {
+		return nil, fmt.Errorf("No files found to restore")
+	}
+	var podsToBeRestored []string
+	for pod := range podFiles {
+		podsToBeRestored = append(podsToBeRestored, pod)
+	}
+	utils.SortPods(podsToBeRestored)
+
+	log.Println("Validating pods match restore")
+	if err := utils.SliceContainsSlice(podsToBeRestored, existingPods); err != nil {
+		return nil, err
+	}
+
+	if err := restoreFilesWithAgents(o, k8sClient, agents, existingPods, podsToBeRestored, restoreManifest, podFiles, checksums, storageOptions); err != nil {
+		return nil, err
+	}
+
+	log.Println("All done!")
+	return result, nil
+}
+
+// restoreFilesWithAgents truncates the tables of the backup and restores their files by the agents of pods, then refreshes them
+// Agents validate their requests before any table is truncated
+func restoreFilesWithAgents(o RestoreOptions, k8sClient interface{}, agents map[string]*AgentClient, existingPods, podsToBeRestored []string, manifest *Manifest, podFiles map[string][]string, checksums map[string]string, storageOptions utils.StorageOptions) error {
+	if manifest.Encryption != nil && o.EncryptionKey == "" {
+		return fmt.Errorf("backup is encrypted with key %s. use \"--encryption-key\" to provide the key source", manifest.Encryption.KeyID)
+	}
+	bandwidth := agentBandwidth(o.MaxBandwidth, o.MaxPodBandwidth, len(podsToBeRestored))
+	restoreRequest := func(pod string) AgentRestoreRequest {
+		request := AgentRestoreRequest{
+			Keyspace:           o.Keyspace,
+			Src:                o.Src,
+			Files:              podFiles[pod],
+			Checksums:          make(map[string]string),
+			Storage:            storageOptions,
+			Parallel:           o.Parallel,
+			BufferSize:         o.BufferSize,
+			S3PartSize:         o.S3PartSize,
+			S3MaxDownloadParts: o.S3MaxDownloadParts,
+			MaxBandwidth:       bandwidth,
+			Compression:        manifest.Compression,
+			Encryption:         manifest.Encryption,
+			EncryptionKey:      o.EncryptionKey,
+			UserGroup:          o.UserGroup,
+			Verbose:            o.Verbose,
+		}
+		for _, file := range request.Files {
+			if sum, ok := checksums[file]; ok {
+				request.Checksums[file] = sum
+			}
+		}
+		return request
+	}
+
+	log.Println("Validating restore requests")
+	err := forEachAgent(agents, podsToBeRestored, func(agent *AgentClient) error {
+		request := restoreRequest(agent.Pod)
+		request.ValidateOnly = true
+		return agent.call(agentRestorePath, request, &AgentRestoreResponse{})
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("Getting materialized views to exclude")
+	output, err := agents[existingPods[0]].Cqlsh(fmt.Sprintf("SELECT view_name FROM system_schema.views WHERE keyspace_name='%s';", o.Keyspace))
+	if err != nil {
+		return err
+	}
+	materializedViews := parseMaterializedViews(output)
+
+	tables := make(map[string]bool)
+	for _, files := range podFiles {
+		for _, file := range files {
+			tables[strings.Split(file, "/")[4]] = true
+		}
+	}
+	hc := HookContext{Phase: HookPreTruncate, Namespace: o.Namespace, Keyspace: o.Keyspace, Tag: o.Tag, Pods: existingPods}
+	if err := runHooks(o.Hooks, k8sClient, o.Container, hc); err != nil {
+		return err
+	}
+
+	log.Println("Truncating tables")
+	err = forEachAgent(agents, existingPods, func(agent *AgentClient) error {
+		for table := range tables {
+			if utils.Contains(materializedViews, table) {
+				log.Println(agent.Pod, "Skipping materialized view", table, "in keyspace", o.Keyspace)
+				continue
+			}
+			log.Println(agent.Pod, "Truncating table", table, "in keyspace", o.Keyspace)
+			if _, err := agent.Cqlsh(fmt.Sprintf("TRUNCATE %s.%s;", o.Keyspace, table)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("Starting files copy")
+	err = forEachAgent(agents, podsToBeRestored, func(agent *AgentClient) error {
+		request := restoreRequest(agent.Pod)
+
+		log.Println(agent.Pod, "Restoring files")
+		response := &AgentRestoreResponse{}
+		if err := agent.call(agentRestorePath, request, response); err != nil {
+			return err
+		}
+
+		for _, table := range response.Tables {
+			log.Println(agent.Pod, "Refreshing table", table, "in keyspace", o.Keyspace)
+			output, err := agent.Nodetool("refresh", o.Keyspace, table)
+			if err != nil {
+				return err
+			}
+			printOutput(output, agent.Pod)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	hc.Phase, hc.Pods = HookPostRefresh, podsToBeRestored
+
+	return runHooks(o.Hooks, k8sClient, o.Container, hc)
+}
@@ -0,0 +1,75 @@
+package cain
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+func TestRestoreFilesWithAgents(t *testing.T) {
+	file := "keyspace/sum/tag/pod-0/table1/mc-1-big-Data.db"
+	tests := []struct {
+		name          string
+		file          string
+		encryption    *utils.Encryption
+		encryptionKey string
+		wantErr       string
+	}{
+		{"restore", file, nil, "", ""},
+		{"encrypted without key", file, &utils.Encryption{Algorithm: utils.EncryptionAlgorithm, KeyID: "key"}, "", "--encryption-key"},
+		{"key not found", file, &utils.Encryption{Algorithm: utils.EncryptionAlgorithm, KeyID: "key"}, "file:///does/not/exist", "does/not/exist"},
+		{"table not found", "keyspace/sum/tag/pod-0/table2/mc-1-big-Data.db", nil, "", "table2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := newTestS3(t, map[string]string{"bucket/cassandra/" + tt.file: "data"})
+			dataDir := newTestDataDir(t, "keyspace", "table1")
+			agent := newTestAgent(t, dataDir)
+			truncating := false
+			o := RestoreOptions{
+				Src:           "s3://bucket/cassandra",
+				Keyspace:      "keyspace",
+				Tag:           "tag",
+				Parallel:      1,
+				BufferSize:    1,
+				EncryptionKey: tt.encryptionKey,
+				Hooks: []Hook{{Phase: HookPreTruncate, Func: func(HookContext) error {
+					truncating = true
+					return nil
+				}}},
+			}
+			agents := map[string]*AgentClient{"pod-0": agent.client("pod-0")}
+			pods := []string{"pod-0"}
+			manifest := &Manifest{Encryption: tt.encryption}
+			storage := utils.StorageOptions{S3Endpoint: s3.URL, S3ForcePathStyle: true}
+
+			err := restoreFilesWithAgents(o, nil, agents, pods, pods, manifest, map[string][]string{"pod-0": {tt.file}}, nil, storage)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				if truncating || agent.ran("TRUNCATE") {
+					t.Fatal("expected tables not to be truncated")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !truncating || !agent.ran("TRUNCATE keyspace.table1;") || !agent.ran("nodetool refresh keyspace table1") {
+				t.Fatalf("expected table1 to be truncated and refreshed, ran %v", agent.commands)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dataDir, "keyspace", "table1-0123456789abcdef", "mc-1-big-Data.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "data" {
+				t.Fatalf("expected restored file to contain %q, got %q", "data", b)
+			}
+		})
+	}
+}
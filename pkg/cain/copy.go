@@ -0,0 +1,213 @@
+package cain
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nuvo/cain/pkg/utils"
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// CopyOptions are the options to pass to Copy
+type CopyOptions struct {
+	Src                    string
+	Dst                    string
+	Clusters               []string
+	Keyspaces              []string
+	Tags                   []string
+	AllowIncomplete        bool
+	Parallel               int
+	BufferSize             float64
+	S3MaxUploadParts       int
+	S3PartSize             int64
+	MaxBandwidth           float64
+	S3Endpoint             string
+	S3ForcePathStyle       bool
+	S3StorageClass         string
+	S3ServerSideEncryption string
+	S3SSEKMSKeyID          string
+	S3ACL                  string
+	RetentionMode          string
+	RetentionDays          int
+	RetainUntil            string
+	Kubeconfig             string
+	Context                string
+	Verbose                bool
+}
+
+// Copy copies backups between storage services, keeping their layout
+// Src and Dst are the paths backups are stored under (the dst of backup)
+// Objects that already exist in Dst with the same size are skipped
+func Copy(o CopyOptions) error {
+	log.Println("Copy started!")
+	srcPrefix, srcBasePath := utils.SplitInTwo(o.Src, "://")
+	dstPrefix, dstBasePath := utils.SplitInTwo(o.Dst, "://")
+
+	if srcPrefix == "k8s" || dstPrefix == "k8s" {
+		return fmt.Errorf("copy is only supported between storage services")
+	}
+	if err := utils.TestImplementationsExist(srcPrefix, dstPrefix); err != nil {
+		return err
+	}
+
+	log.Println("Getting clients")
+	retainUntil, err := utils.GetRetainUntil(o.RetainUntil, o.RetentionDays)
+	if err != nil {
+		return err
+	}
+	storageOptions := utils.StorageOptions{
+		S3Endpoint:             o.S3Endpoint,
+		S3ForcePathStyle:       o.S3ForcePathStyle,
+		S3StorageClass:         o.S3StorageClass,
+		S3ServerSideEncryption: o.S3ServerSideEncryption,
+		S3SSEKMSKeyID:          o.S3SSEKMSKeyID,
+		S3ACL:                  o.S3ACL,
+		RetentionMode:          o.RetentionMode,
+		RetainUntil:            retainUntil,
+		Kubeconfig:             o.Kubeconfig,
+		KubeContext:            o.Context,
+	}
+	if o.RetentionMode != "" {
+		log.Printf("Objects will be retained in %s mode until %s", o.RetentionMode, retainUntil.Format(time.RFC3339))
+	}
+	srcClient, dstClient, err := utils.GetClients(srcPrefix, dstPrefix, srcBasePath, dstBasePath, storageOptions)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Listing source files")
+	srcFiles, err := utils.GetListOfFilesWithSizes(srcClient, srcPrefix, srcBasePath)
+	if err != nil {
+		return err
+	}
+	var srcPaths []string
+	for file := range srcFiles {
+		srcPaths = append(srcPaths, file)
+	}
+	files := selectBackupFiles(srcPaths, o.Clusters, o.Keyspaces, o.Tags, o.AllowIncomplete)
+	if len(files) == 0 {
+		return fmt.Errorf("No files found to copy")
+	}
+
+	log.Println("Listing destination files")
+	dstFiles, err := utils.GetListOfFilesWithSizes(dstClient, dstPrefix, dstBasePath)
+	if err != nil {
+		return err
+	}
+
+	// Completion markers are copied last, so incomplete copies are not mistaken for complete backups
+	var fromToPaths, markers []skbn.FromToPair
+	skipped := 0
+	for _, file := range files {
+		if size, ok := dstFiles[file]; ok && size == srcFiles[file] {
+			skipped++
+			continue
+		}
+		ftp := skbn.FromToPair{FromPath: filepath.Join(srcBasePath, file), ToPath: filepath.Join(dstBasePath, file)}
+		if isCompletionMarker(file) {
+			markers = append(markers, ftp)
+		} else {
+			fromToPaths = append(fromToPaths, ftp)
+		}
+	}
+	log.Printf("Copying %d files, skipping %d existing files", len(fromToPaths)+len(markers), skipped)
+
+	limiter := utils.NewBandwidthLimiter(o.MaxBandwidth, 0)
+	if err := utils.PerformCopy(srcClient, dstClient, srcPrefix, dstPrefix, fromToPaths, o.Parallel, o.BufferSize, o.S3PartSize, o.S3MaxUploadParts, nil, limiter, o.Verbose); err != nil {
+		return err
+	}
+
+	log.Println("Verifying sizes of copied files")
+	if err := verifyCopiedSizes(dstClient, dstPrefix, dstBasePath, srcFiles, fromToPaths); err != nil {
+		return err
+	}
+
+	log.Println("Copying completion markers")
+	if err := utils.PerformCopy(srcClient, dstClient, srcPrefix, dstPrefix, markers, o.Parallel, o.BufferSize, o.S3PartSize, o.S3MaxUploadParts, nil, limiter, o.Verbose); err != nil {
+		return err
+	}
+
+	log.Println("All done!")
+	return nil
+}
+
+// selectBackupFiles selects files of backups by cluster (namespace/cluster-name), keyspace and tag. Empty filters select all
+// files are keyed by their path relative to the backups base path (namespace/cluster/keyspace/sum/...)
+// Tags without a completion marker are skipped, unless incomplete backups are allowed
+func selectBackupFiles(files []string, clusters, keyspaces, tags []string, allowIncomplete bool) []string {
+	// namespace/cluster/keyspace/sum/tag -> files
+	tagFiles := make(map[string][]string)
+	// namespace/cluster/keyspace/sum -> schema file
+	schemas := make(map[string]string)
+	markers := completeTags(files)
+	for _, file := range files {
+		pSplit := strings.Split(file, "/")
+		if len(pSplit) < 5 {
+			continue
+		}
+		if len(clusters) != 0 && !utils.Contains(clusters, filepath.Join(pSplit[0], pSplit[1])) {
+			continue
+		}
+		if len(keyspaces) != 0 && !utils.Contains(keyspaces, pSplit[2]) {
+			continue
+		}
+		sumPath := filepath.Join(pSplit[:4]...)
+		if len(pSplit) == 5 {
+			schemas[sumPath] = file
+			continue
+		}
+		if len(tags) != 0 && !utils.Contains(tags, pSplit[4]) {
+			continue
+		}
+		tagPath := filepath.Join(sumPath, pSplit[4])
+		tagFiles[tagPath] = append(tagFiles[tagPath], file)
+	}
+
+	var selected []string
+	sums := make(map[string]string)
+	for tagPath, tFiles := range tagFiles {
+		if !markers[tagPath] {
+			if !allowIncomplete {
+				log.Println("WARNING: skipping incomplete backup", tagPath)
+				continue
+			}
+			log.Println("WARNING: backup", tagPath, "is incomplete")
+		}
+		selected = append(selected, tFiles...)
+		sums[filepath.Dir(tagPath)] = "hello there!"
+	}
+	// Schemas of copied tags, or of all matching keyspaces if no tags were selected
+	for sumPath, schema := range schemas {
+		if _, ok := sums[sumPath]; ok || len(tags) == 0 {
+			selected = append(selected, schema)
+		}
+	}
+	sort.Strings(selected)
+
+	return selected
+}
+
+// verifyCopiedSizes checks that every copied file exists in the destination with the size of the source file
+func verifyCopiedSizes(iDstClient interface{}, dstPrefix, dstBasePath string, srcFiles map[string]int64, fromToPaths []skbn.FromToPair) error {
+	dstFiles, err := utils.GetListOfFilesWithSizes(iDstClient, dstPrefix, dstBasePath)
+	if err != nil {
+		return err
+	}
+	var mismatches []string
+	for _, ftp := range fromToPaths {
+		file := utils.RelativePath(ftp.ToPath, dstBasePath)
+		if size, ok := dstFiles[file]; !ok || size != srcFiles[file] {
+			mismatches = append(mismatches, file)
+		}
+	}
+	if len(mismatches) != 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("size mismatch in %d copied files: %s", len(mismatches), strings.Join(mismatches, ", "))
+	}
+
+	return nil
+}
@@ -14,61 +14,80 @@ import (
 
 // BackupKeyspaceSchema gets the schema of the keyspace and backs it up
 func BackupKeyspaceSchema(iK8sClient, iDstClient interface{}, namespace, pod, container, keyspace, dstPrefix, dstPath string, creds Credentials, s3maxUploadParts int, s3partSize int64, verbose bool) (string, error) {
-	clusterName, err := GetClusterName(iK8sClient, namespace, pod, container, creds)
+	schema, backupPath, err := GetKeyspaceSchema(iK8sClient, namespace, pod, container, keyspace, creds)
 	if err != nil {
 		return "", err
 	}
 
-	schema, sum, err := DescribeKeyspaceSchema(iK8sClient, namespace, pod, container, keyspace)
-	if err != nil {
+	dstBasePath := filepath.Join(dstPath, backupPath)
+	if err := UploadKeyspaceSchema(iDstClient, dstPrefix, dstBasePath, schema, s3maxUploadParts, s3partSize, verbose); err != nil {
 		return "", err
 	}
 
-	dstBasePath := filepath.Join(dstPath, namespace, clusterName, keyspace, sum)
-	schemaToPath := filepath.Join(dstBasePath, "schema.cql")
+	return dstBasePath, nil
+}
 
-	reader := bytes.NewReader(schema)
-	if err := skbn.Upload(iDstClient, dstPrefix, schemaToPath, "", reader, s3partSize, s3maxUploadParts, verbose); err != nil {
-		return "", err
+// GetKeyspaceSchema gets the schema of the keyspace, and the path of its backups relative to the destination (namespace/cluster/keyspace/sum)
+func GetKeyspaceSchema(iK8sClient interface{}, namespace, pod, container, keyspace string, creds Credentials) ([]byte, string, error) {
+	clusterName, err := GetClusterName(iK8sClient, namespace, pod, container, creds)
+	if err != nil {
+		return nil, "", err
 	}
 
-	return dstBasePath, nil
+	schema, sum, err := DescribeKeyspaceSchema(iK8sClient, namespace, pod, container, keyspace, creds)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return schema, filepath.Join(namespace, clusterName, keyspace, sum), nil
+}
+
+// UploadKeyspaceSchema uploads the schema of the keyspace to the base path of its backups
+func UploadKeyspaceSchema(iDstClient interface{}, dstPrefix, dstBasePath string, schema []byte, s3maxUploadParts int, s3partSize int64, verbose bool) error {
+	schemaToPath := filepath.Join(dstBasePath, "schema.cql")
+	reader := bytes.NewReader(schema)
+
+	return utils.Upload(iDstClient, dstPrefix, schemaToPath, "", reader, s3partSize, s3maxUploadParts, verbose)
 }
 
 // DescribeKeyspaceSchema describes the schema of the keyspace
-func DescribeKeyspaceSchema(iK8sClient interface{}, namespace, pod, container, keyspace string) ([]byte, string, error) {
+func DescribeKeyspaceSchema(iK8sClient interface{}, namespace, pod, container, keyspace string, creds Credentials) ([]byte, string, error) {
 	command := []string{fmt.Sprintf("DESC %s;", keyspace)}
-	schema, err := Cqlsh(iK8sClient, namespace, pod, container, command)
+	schema, err := Cqlsh(iK8sClient, namespace, pod, container, command, creds)
 	if err != nil {
 		return nil, "", fmt.Errorf("Could not describe schema. make sure a schema exists for keyspace \"%s\" or restore it using \"--schema\". %s", keyspace, err)
 	}
+
+	return schema, schemaSum(schema), nil
+}
+
+// schemaSum returns the checksum of a schema, which is part of the path of its backups
+func schemaSum(schema []byte) string {
 	h := sha256.New()
 	h.Write(schema)
-	sum := fmt.Sprintf("%x", h.Sum(nil))[0:6]
-
-	return schema, sum, nil
+	return fmt.Sprintf("%x", h.Sum(nil))[0:6]
 }
 
 // RestoreKeyspaceSchema restores a keyspace schema
-func RestoreKeyspaceSchema(srcClient, iK8sClient interface{}, srcPrefix, srcPath, namespace, pod, container, keyspace, schema string, parallel int, bufferSize float64, s3maxUploadParts int, s3partSize int64, verbose bool) (string, error) {
+func RestoreKeyspaceSchema(srcClient, iK8sClient interface{}, srcPrefix, srcPath, namespace, pod, container, keyspace, schema string, creds Credentials, parallel int, bufferSize float64, s3maxUploadParts int, s3partSize int64, verbose bool) (string, error) {
 	schemaTmpFile := fmt.Sprintf("/tmp/%s/schema.cql", keyspace)
 	fromTo := skbn.FromToPair{
 		FromPath: filepath.Join(srcPath, keyspace, schema, "schema.cql"),
 		ToPath:   filepath.Join(namespace, pod, container, schemaTmpFile),
 	}
-	if err := skbn.PerformCopy(srcClient, iK8sClient, srcPrefix, "k8s", []skbn.FromToPair{fromTo}, parallel, bufferSize, s3partSize, s3maxUploadParts, verbose); err != nil {
+	if err := utils.PerformCopy(srcClient, iK8sClient, srcPrefix, "k8s", []skbn.FromToPair{fromTo}, parallel, bufferSize, s3partSize, s3maxUploadParts, nil, nil, verbose); err != nil {
 		return "", err
 	}
-	if _, err := CqlshF(iK8sClient, namespace, pod, container, schemaTmpFile); err != nil {
+	if _, err := CqlshF(iK8sClient, namespace, pod, container, schemaTmpFile, creds); err != nil {
 		return "", err
 	}
-	_, sum, err := DescribeKeyspaceSchema(iK8sClient, namespace, pod, container, keyspace)
+	_, sum, err := DescribeKeyspaceSchema(iK8sClient, namespace, pod, container, keyspace, creds)
 
 	return sum, err
 }
 
 // TruncateTables truncates the provided tables in all pods
-func TruncateTables(iK8sClient interface{}, namespace, container, keyspace string, pods, tables, materializedViews []string) {
+func TruncateTables(iK8sClient interface{}, namespace, container, keyspace string, pods, tables, materializedViews []string, creds Credentials) {
 	bwgSize := len(pods)
 	bwg := utils.NewBoundedWaitGroup(bwgSize)
 	for _, pod := range pods {
@@ -82,7 +101,7 @@ func TruncateTables(iK8sClient interface{}, namespace, container, keyspace strin
 				}
 				log.Println(pod, "Truncating table", table, "in keyspace", keyspace)
 				command := []string{fmt.Sprintf("TRUNCATE %s.%s;", keyspace, table)}
-				_, err := Cqlsh(iK8sClient, namespace, pod, container, command)
+				_, err := Cqlsh(iK8sClient, namespace, pod, container, command, creds)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -95,14 +114,19 @@ func TruncateTables(iK8sClient interface{}, namespace, container, keyspace strin
 }
 
 // GetMaterializedViews gets all materialized views to avoid truncate and refresh
-func GetMaterializedViews(iK8sClient interface{}, namespace, container, pod, keyspace string) ([]string, error) {
+func GetMaterializedViews(iK8sClient interface{}, namespace, container, pod, keyspace string, creds Credentials) ([]string, error) {
 
 	command := []string{fmt.Sprintf("SELECT view_name FROM system_schema.views WHERE keyspace_name='%s';", keyspace)}
-	output, err := Cqlsh(iK8sClient, namespace, pod, container, command)
+	output, err := Cqlsh(iK8sClient, namespace, pod, container, command, creds)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	return parseMaterializedViews(output), nil
+}
+
+// parseMaterializedViews parses the names of materialized views from the output of a cqlsh query
+func parseMaterializedViews(output []byte) []string {
 	var views []string
 	headerPassed := false
 	for _, line := range strings.Split((string)(output), "\n") {
@@ -120,16 +144,16 @@ func GetMaterializedViews(iK8sClient interface{}, namespace, container, pod, key
 		}
 	}
 
-	return views, nil
+	return views
 }
 
 // Cqlsh executes cqlsh -e 'command' in a given pod
-func Cqlsh(iK8sClient interface{}, namespace, pod, container string, command []string) ([]byte, error) {
+func Cqlsh(iK8sClient interface{}, namespace, pod, container string, command []string, creds Credentials) ([]byte, error) {
 	k8sClient := iK8sClient.(*skbn.K8sClient)
 
-	command = append([]string{"cqlsh", "-e"}, command...)
+	command, stdin := creds.cqlshCommand(append([]string{"-e"}, command...))
 	stdout := new(bytes.Buffer)
-	stderr, err := skbn.Exec(*k8sClient, namespace, pod, container, command, nil, stdout)
+	stderr, err := skbn.Exec(*k8sClient, namespace, pod, container, command, stdin, stdout)
 
 	if len(stderr) != 0 {
 		return nil, fmt.Errorf("STDERR: " + (string)(stderr))
@@ -142,12 +166,12 @@ func Cqlsh(iK8sClient interface{}, namespace, pod, container string, command []s
 }
 
 // CqlshF executes cqlsh -f file in a given pod
-func CqlshF(iK8sClient interface{}, namespace, pod, container string, file string) ([]byte, error) {
+func CqlshF(iK8sClient interface{}, namespace, pod, container string, file string, creds Credentials) ([]byte, error) {
 	k8sClient := iK8sClient.(*skbn.K8sClient)
 
-	command := []string{"cqlsh", "-f", file}
+	command, stdin := creds.cqlshCommand([]string{"-f", file})
 	stdout := new(bytes.Buffer)
-	stderr, err := skbn.Exec(*k8sClient, namespace, pod, container, command, nil, stdout)
+	stderr, err := skbn.Exec(*k8sClient, namespace, pod, container, command, stdin, stdout)
 	if len(stderr) != 0 {
 		return nil, fmt.Errorf("STDERR: " + (string)(stderr))
 	}
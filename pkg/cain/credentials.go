@@ -0,0 +1,117 @@
+package cain
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+// Keys of a credentials secret
+const (
+	SecretUsernameKey    = "username"
+	SecretPasswordKey    = "password"
+	SecretJMXUsernameKey = "jmx-username"
+	SecretJMXPasswordKey = "jmx-password"
+)
+
+// credentialsFileScript runs a command with a temporary file holding its stdin, which is removed when the command exits
+// Arguments are the flag of the file, the command and its arguments. Credentials are passed through stdin and the file,
+// so they do not appear in the arguments of any process
+const credentialsFileScript = `f=$(mktemp) && trap 'rm -f "$f"' EXIT && cat > "$f" && flag=$1 && program=$2 && shift 2 && "$program" "$flag" "$f" "$@"`
+
+// GetCredentials returns the credentials to run nodetool and cqlsh with
+// If secret is set, the cassandra and JMX credentials are read from the kubernetes secret in namespace. JMX credentials
+// default to the cassandra credentials
+func GetCredentials(iK8sClient interface{}, namespace, secret string, authentication bool, username, nodetoolCredentialsFile string) (Credentials, error) {
+	creds := Credentials{
+		enabled:                 authentication,
+		username:                username,
+		nodetoolCredentialsFile: nodetoolCredentialsFile,
+	}
+	if secret == "" {
+		return creds, nil
+	}
+
+	log.Println("Reading credentials from secret", secret)
+	data, err := utils.GetSecretData(iK8sClient, namespace, secret)
+	if err != nil {
+		return creds, err
+	}
+
+	return credentialsFromSecretData("secret "+secret, data)
+}
+
+// ReadCredentialsDir reads credentials from a directory with a file per key of a credentials secret, such as a mounted secret
+func ReadCredentialsDir(dir string) (Credentials, error) {
+	data := make(map[string][]byte)
+	for _, key := range []string{SecretUsernameKey, SecretPasswordKey, SecretJMXUsernameKey, SecretJMXPasswordKey} {
+		value, err := ioutil.ReadFile(filepath.Join(dir, key))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Credentials{}, err
+		}
+		data[key] = bytes.TrimRight(value, "\n")
+	}
+
+	return credentialsFromSecretData("credentials directory "+dir, data)
+}
+
+// credentialsFromSecretData returns the credentials held by the data of a credentials secret
+func credentialsFromSecretData(source string, data map[string][]byte) (Credentials, error) {
+	creds := Credentials{
+		enabled:     true,
+		fromSecret:  true,
+		username:    string(data[SecretUsernameKey]),
+		password:    string(data[SecretPasswordKey]),
+		jmxUsername: string(data[SecretJMXUsernameKey]),
+		jmxPassword: string(data[SecretJMXPasswordKey]),
+	}
+	if creds.jmxPassword == "" {
+		creds.jmxUsername, creds.jmxPassword = creds.username, creds.password
+	}
+	if creds.password == "" && creds.jmxPassword == "" {
+		return creds, fmt.Errorf("%s has no %s or %s", source, SecretPasswordKey, SecretJMXPasswordKey)
+	}
+	if (creds.password != "" && creds.username == "") || creds.jmxUsername == "" {
+		return creds, fmt.Errorf("%s has a password without a username", source)
+	}
+
+	return creds, nil
+}
+
+// nodetoolCommand returns the command to run nodetool with args, and its stdin
+func (c Credentials) nodetoolCommand(args []string) ([]string, io.Reader) {
+	switch {
+	case c.jmxPassword != "":
+		passwordFile := fmt.Sprintf("%s %s\n", c.jmxUsername, c.jmxPassword)
+		return credentialsFileCommand("nodetool", "-pwf", append([]string{"-u", c.jmxUsername}, args...)), strings.NewReader(passwordFile)
+	case c.enabled && !c.fromSecret:
+		return append([]string{"nodetool", "-u", c.username, "-pwf", c.nodetoolCredentialsFile}, args...), nil
+	default:
+		return append([]string{"nodetool"}, args...), nil
+	}
+}
+
+// cqlshCommand returns the command to run cqlsh with args, and its stdin
+func (c Credentials) cqlshCommand(args []string) ([]string, io.Reader) {
+	if c.password == "" {
+		return append([]string{"cqlsh"}, args...), nil
+	}
+	cqlshrc := new(bytes.Buffer)
+	fmt.Fprintf(cqlshrc, "[authentication]\nusername = %s\npassword = %s\n", c.username, c.password)
+
+	return credentialsFileCommand("cqlsh", "--cqlshrc", args), cqlshrc
+}
+
+func credentialsFileCommand(command, flag string, args []string) []string {
+	return append([]string{"sh", "-c", credentialsFileScript, "sh", flag, command}, args...)
+}
@@ -0,0 +1,492 @@
+package cain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuvo/cain/pkg/utils"
+	"github.com/robfig/cron/v3"
+	"sigs.k8s.io/yaml"
+)
+
+// daemonInterval is the interval between checks of schedules, cron expressions have a resolution of minutes
+const daemonInterval = 10 * time.Second
+
+// DaemonOptions are the options to pass to RunDaemon
+type DaemonOptions struct {
+	Config string
+	Listen string
+}
+
+// DaemonConfig is the configuration of the daemon
+type DaemonConfig struct {
+	// Defaults are backup options of all schedules, see DaemonBackupSpec
+	Defaults json.RawMessage `json:"defaults,omitempty"`
+	// Retention is the default retention of all schedules
+	Retention *Retention `json:"retention,omitempty"`
+	// MaintenanceWindows are the times backups may start in, any time if empty
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+	Schedules          []DaemonSchedule    `json:"schedules"`
+}
+
+// DaemonSchedule is a backup on a cron schedule
+type DaemonSchedule struct {
+	Name      string     `json:"name"`
+	Schedule  string     `json:"schedule"`
+	Retention *Retention `json:"retention,omitempty"`
+	// Backup are backup options which override the defaults, see DaemonBackupSpec
+	Backup json.RawMessage `json:"backup"`
+}
+
+// DaemonBackupSpec are the backup options of a schedule, as in the spec of a CassandraBackup
+// The configuration of the daemon is trusted, so it may also select the cluster and namespace, and local key files
+type DaemonBackupSpec struct {
+	CassandraBackupSpec `json:",inline"`
+	// Kubeconfig and Context select the kubernetes cluster of the cassandra cluster, defaults to the cluster of cain
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+	// Namespace of the cassandra cluster, defaults to "default"
+	Namespace      string `json:"namespace,omitempty"`
+	EncryptionKey  string `json:"encryptionKey,omitempty"`
+	AgentTokenFile string `json:"agentTokenFile,omitempty"`
+	AgentCAFile    string `json:"agentCaFile,omitempty"`
+}
+
+// BackupOptions returns the options of a backup by its spec, with the defaults of the backup command
+func (s DaemonBackupSpec) BackupOptions() BackupOptions {
+	options := s.CassandraBackupSpec.BackupOptions(stringOrDefault(s.Namespace, "default"))
+	options.Kubeconfig, options.Context = s.Kubeconfig, s.Context
+	options.EncryptionKey = s.EncryptionKey
+	options.AgentTokenFile, options.AgentCAFile = s.AgentTokenFile, s.AgentCAFile
+	return options
+}
+
+// Retention is the number of backups and days to keep backups of a keyspace for, see Prune
+type Retention struct {
+	KeepLast int `json:"keepLast,omitempty"`
+	KeepDays int `json:"keepDays,omitempty"`
+}
+
+// MaintenanceWindow is a daily time range, in local time. A window which ends before it starts ends on the next day
+type MaintenanceWindow struct {
+	// Days are the days the window starts on (Mon, Tue...), every day if empty
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// ScheduleStatus is the state of a schedule, as reported by the daemon
+type ScheduleStatus struct {
+	Name     string    `json:"name"`
+	Keyspace string    `json:"keyspace"`
+	Schedule string    `json:"schedule"`
+	NextRun  time.Time `json:"nextRun"`
+	// Pending is true if a run is due and waits for a maintenance window
+	Pending bool `json:"pending"`
+	Running bool `json:"running"`
+	// Skipped is the number of runs skipped since a backup of the keyspace was still running
+	Skipped     int        `json:"skipped"`
+	LastRun     *RunStatus `json:"lastRun,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// RunStatus is the result of a single run of a schedule
+type RunStatus struct {
+	Phase          string            `json:"phase"`
+	Tag            string            `json:"tag,omitempty"`
+	Path           string            `json:"path,omitempty"`
+	Files          int               `json:"files,omitempty"`
+	Bytes          int64             `json:"bytes,omitempty"`
+	StoredBytes    int64             `json:"storedBytes,omitempty"`
+	Pruned         []string          `json:"pruned,omitempty"`
+	Retained       []string          `json:"retained,omitempty"`
+	FailedDsts     map[string]string `json:"failedDestinations,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	StartTime      time.Time         `json:"startTime"`
+	CompletionTime *time.Time        `json:"completionTime,omitempty"`
+}
+
+// RunDaemon runs backups on the schedules of a configuration file until stop is closed
+// The status of the schedules is served over HTTP on Listen, unless it is empty
+func RunDaemon(o DaemonOptions, stop <-chan struct{}) error {
+	config, err := ReadDaemonConfig(o.Config)
+	if err != nil {
+		return err
+	}
+	d, err := NewDaemon(config)
+	if err != nil {
+		return err
+	}
+
+	var server *http.Server
+	if o.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/status", d)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "ok")
+		})
+		server = &http.Server{Addr: o.Listen, Handler: mux}
+		go func() {
+			log.Println("Serving status on", o.Listen)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	d.Run(stop)
+	log.Println("Waiting for running backups")
+	d.Wait()
+	if server != nil {
+		server.Close()
+	}
+
+	return nil
+}
+
+// ReadDaemonConfig reads a yaml configuration file of the daemon
+func ReadDaemonConfig(path string) (*DaemonConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &DaemonConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+// Daemon runs backups on cron schedules, and prunes old backups after each run
+// Backups of the same keyspace never overlap, a run which is due while the keyspace is backed up is skipped
+type Daemon struct {
+	// Backup, Prune and Now are replaceable for tests
+	Backup func(BackupOptions) (*BackupResult, error)
+	Prune  func(PruneOptions) (*PruneResult, error)
+	Now    func() time.Time
+
+	schedules []*daemonSchedule
+	windows   []maintenanceWindow
+	// running are the keyspaces being backed up, as namespace/keyspace
+	running map[string]bool
+	mutex   sync.Mutex
+	wg      sync.WaitGroup
+}
+
+type daemonSchedule struct {
+	cron      cron.Schedule
+	options   BackupOptions
+	retention *Retention
+	status    ScheduleStatus
+}
+
+type maintenanceWindow struct {
+	days       map[time.Weekday]bool
+	start, end int
+}
+
+// NewDaemon returns a Daemon which runs the schedules of a configuration
+func NewDaemon(config *DaemonConfig) (*Daemon, error) {
+	d := &Daemon{
+		Backup:  BackupWithResult,
+		Prune:   Prune,
+		Now:     time.Now,
+		running: make(map[string]bool),
+	}
+
+	for _, w := range config.MaintenanceWindows {
+		window, err := parseMaintenanceWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		d.windows = append(d.windows, window)
+	}
+
+	if len(config.Schedules) == 0 {
+		return nil, fmt.Errorf("no schedules configured")
+	}
+	names := make(map[string]bool)
+	now := d.Now()
+	for _, s := range config.Schedules {
+		if s.Name == "" {
+			return nil, fmt.Errorf("schedule name can not be empty")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("schedule %s is configured more than once", s.Name)
+		}
+		names[s.Name] = true
+
+		cronSchedule, err := cron.ParseStandard(s.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("illegal schedule of %s: %s", s.Name, err)
+		}
+		// Schedules override the defaults field by field
+		spec := DaemonBackupSpec{}
+		for _, raw := range []json.RawMessage{config.Defaults, s.Backup} {
+			if len(raw) == 0 {
+				continue
+			}
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&spec); err != nil {
+				return nil, fmt.Errorf("illegal backup options of %s: %s", s.Name, err)
+			}
+		}
+		if spec.Keyspace == "" {
+			return nil, fmt.Errorf("keyspace of %s can not be empty", s.Name)
+		}
+		if len(spec.Dst) == 0 {
+			return nil, fmt.Errorf("dst of %s can not be empty", s.Name)
+		}
+		retention := config.Retention
+		if s.Retention != nil {
+			retention = s.Retention
+		}
+		if retention != nil && (retention.KeepLast < 0 || retention.KeepDays < 0) {
+			return nil, fmt.Errorf("retention of %s must be positive", s.Name)
+		}
+
+		d.schedules = append(d.schedules, &daemonSchedule{
+			cron:      cronSchedule,
+			options:   spec.BackupOptions(),
+			retention: retention,
+			status: ScheduleStatus{
+				Name:     s.Name,
+				Keyspace: spec.Keyspace,
+				Schedule: s.Schedule,
+				NextRun:  cronSchedule.Next(now),
+			},
+		})
+	}
+
+	return d, nil
+}
+
+// Run checks the schedules until stop is closed
+func (d *Daemon) Run(stop <-chan struct{}) {
+	log.Printf("Daemon started with %d schedules!", len(d.schedules))
+	ticker := time.NewTicker(daemonInterval)
+	defer ticker.Stop()
+	for {
+		d.Tick()
+		select {
+		case <-stop:
+			log.Println("Daemon stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick starts the backups which are due. Backups run in the background, use Wait to wait for them
+func (d *Daemon) Tick() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.Now()
+	inWindow := d.inMaintenanceWindow(now)
+	for _, s := range d.schedules {
+		if !now.Before(s.status.NextRun) {
+			s.status.Pending = true
+			s.status.NextRun = s.cron.Next(now)
+		}
+		if !s.status.Pending || !inWindow {
+			continue
+		}
+		s.status.Pending = false
+
+		key := s.options.Namespace + "/" + s.options.Keyspace
+		if d.running[key] {
+			log.Printf("Skipping backup of %s, keyspace %s is still being backed up", s.status.Name, key)
+			s.status.Skipped++
+			continue
+		}
+		d.running[key] = true
+		s.status.Running = true
+		s.status.LastRun = &RunStatus{Phase: PhaseRunning, StartTime: now}
+		log.Println("Starting backup of", s.status.Name)
+
+		d.wg.Add(1)
+		go func(s *daemonSchedule, key string) {
+			defer d.wg.Done()
+			run := d.run(s)
+
+			d.mutex.Lock()
+			defer d.mutex.Unlock()
+			delete(d.running, key)
+			s.status.Running = false
+			s.status.LastRun = run
+			if run.Phase == PhaseSucceeded {
+				s.status.LastSuccess = run.CompletionTime
+			}
+		}(s, key)
+	}
+}
+
+// Wait waits for the running backups to end
+func (d *Daemon) Wait() {
+	d.wg.Wait()
+}
+
+// Status returns the status of all schedules, sorted by name
+func (d *Daemon) Status() []ScheduleStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var statuses []ScheduleStatus
+	for _, s := range d.schedules {
+		status := s.status
+		if status.LastRun != nil {
+			run := *status.LastRun
+			status.LastRun = &run
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+// ServeHTTP serves the status of all schedules as json
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(d.Status()); err != nil {
+		log.Println(err)
+	}
+}
+
+// run performs a single backup of a schedule, and prunes the destinations it succeeded in
+func (d *Daemon) run(s *daemonSchedule) *RunStatus {
+	run := &RunStatus{Phase: PhaseSucceeded, StartTime: d.Now()}
+	result, err := d.Backup(s.options)
+	if result != nil {
+		run.Tag = result.Tag
+		run.Path = result.Path
+		run.Files = result.Files
+		run.Bytes = result.Bytes
+		run.StoredBytes = result.StoredBytes
+		run.FailedDsts = result.FailedDsts
+	}
+	var errs []string
+	if err != nil {
+		run.Phase = PhaseFailed
+		errs = append(errs, err.Error())
+	}
+
+	if result != nil && s.retention != nil && (s.retention.KeepLast != 0 || s.retention.KeepDays != 0) {
+		// namespace/cluster-name/keyspace/schema/tag
+		pSplit := strings.Split(result.Path, "/")
+		for _, dst := range s.options.Dsts {
+			// Failed destinations are keyed without their query parameters, as prefix://path
+			dstPrefix, dstPath, _, _ := utils.SplitDestination(dst, utils.StorageOptions{})
+			dstURL := strings.TrimSuffix(dstPrefix+"://"+dstPath, "/")
+			if _, ok := result.FailedDsts[dstPrefix+"://"+dstPath]; ok || len(pSplit) < 2 {
+				continue
+			}
+			pruneResult, err := d.Prune(PruneOptions{
+				Dst:              dst,
+				Clusters:         []string{pSplit[0] + "/" + pSplit[1]},
+				Keyspaces:        []string{s.options.Keyspace},
+				KeepLast:         s.retention.KeepLast,
+				KeepDays:         s.retention.KeepDays,
+				Parallel:         s.options.Parallel,
+				S3Endpoint:       s.options.S3Endpoint,
+				S3ForcePathStyle: s.options.S3ForcePathStyle,
+				Kubeconfig:       s.options.Kubeconfig,
+				Context:          s.options.Context,
+				Verbose:          s.options.Verbose,
+			})
+			if pruneResult != nil {
+				for _, tagPath := range pruneResult.Pruned {
+					run.Pruned = append(run.Pruned, dstURL+"/"+tagPath)
+				}
+				for _, tagPath := range pruneResult.Retained {
+					run.Retained = append(run.Retained, dstURL+"/"+tagPath)
+				}
+			}
+			if err != nil {
+				run.Phase = PhaseFailed
+				errs = append(errs, fmt.Sprintf("could not prune %s: %s", dst, err))
+			}
+		}
+	}
+
+	completionTime := d.Now()
+	run.CompletionTime = &completionTime
+	run.Error = strings.Join(errs, "; ")
+	log.Printf("Backup of %s %s", s.status.Name, run.Phase)
+
+	return run
+}
+
+// inMaintenanceWindow returns true if t is in any of the maintenance windows, or if there are none
+func (d *Daemon) inMaintenanceWindow(t time.Time) bool {
+	if len(d.windows) == 0 {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range d.windows {
+		if w.start <= w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseMaintenanceWindow parses the days and times of a maintenance window
+func parseMaintenanceWindow(w MaintenanceWindow) (maintenanceWindow, error) {
+	window := maintenanceWindow{days: make(map[time.Weekday]bool)}
+	for _, day := range w.Days {
+		found := false
+		for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+			if len(day) >= 3 && strings.HasPrefix(strings.ToLower(weekday.String()), strings.ToLower(day)) {
+				window.days[weekday] = true
+				found = true
+			}
+		}
+		if !found {
+			return window, fmt.Errorf("illegal day %s in maintenance window", day)
+		}
+	}
+	if len(w.Days) == 0 {
+		for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+			window.days[weekday] = true
+		}
+	}
+
+	for _, t := range []struct {
+		value  string
+		minute *int
+	}{{w.Start, &window.start}, {w.End, &window.end}} {
+		parsed, err := time.Parse("15:04", t.value)
+		if err != nil {
+			return window, fmt.Errorf("illegal time %s in maintenance window, expected HH:MM", t.value)
+		}
+		*t.minute = parsed.Hour()*60 + parsed.Minute()
+	}
+	if window.start == window.end {
+		return window, fmt.Errorf("maintenance window from %s to %s is empty", w.Start, w.End)
+	}
+
+	return window, nil
+}
@@ -0,0 +1,145 @@
+package cain
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInMaintenanceWindow(t *testing.T) {
+	// 2020-01-06 is a Monday
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2020, 1, 6, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name    string
+		windows []MaintenanceWindow
+		t       time.Time
+		want    bool
+	}{
+		{"no windows", nil, monday(12, 0), true},
+		{"in window", []MaintenanceWindow{{Start: "01:00", End: "05:00"}}, monday(1, 0), true},
+		{"before window", []MaintenanceWindow{{Start: "01:00", End: "05:00"}}, monday(0, 59), false},
+		{"end of window", []MaintenanceWindow{{Start: "01:00", End: "05:00"}}, monday(5, 0), false},
+		{"on day", []MaintenanceWindow{{Days: []string{"Mon"}, Start: "01:00", End: "05:00"}}, monday(2, 0), true},
+		{"on other day", []MaintenanceWindow{{Days: []string{"Tue", "sunday"}, Start: "01:00", End: "05:00"}}, monday(2, 0), false},
+		{"overnight before midnight", []MaintenanceWindow{{Days: []string{"Mon"}, Start: "22:00", End: "02:00"}}, monday(23, 0), true},
+		{"overnight after midnight", []MaintenanceWindow{{Days: []string{"Sun"}, Start: "22:00", End: "02:00"}}, monday(1, 0), true},
+		{"overnight after midnight of other day", []MaintenanceWindow{{Days: []string{"Mon"}, Start: "22:00", End: "02:00"}}, monday(1, 0), false},
+		{"second window", []MaintenanceWindow{{Start: "01:00", End: "02:00"}, {Start: "12:00", End: "13:00"}}, monday(12, 30), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Daemon{}
+			for _, w := range tt.windows {
+				window, err := parseMaintenanceWindow(w)
+				if err != nil {
+					t.Fatal(err)
+				}
+				d.windows = append(d.windows, window)
+			}
+			if got := d.inMaintenanceWindow(tt.t); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindowErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+	}{
+		{"illegal day", MaintenanceWindow{Days: []string{"Mo"}, Start: "01:00", End: "02:00"}},
+		{"illegal start", MaintenanceWindow{Start: "1am", End: "02:00"}},
+		{"illegal end", MaintenanceWindow{Start: "01:00", End: "25:00"}},
+		{"empty window", MaintenanceWindow{Start: "01:00", End: "01:00"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseMaintenanceWindow(tt.window); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestDaemonTick(t *testing.T) {
+	config := &DaemonConfig{
+		Defaults:           json.RawMessage(`{"namespace": "cassandra", "keyspace": "keyspace", "dst": ["s3://bucket/cassandra?endpoint=http://minio:9000", "s3://failed"]}`),
+		Retention:          &Retention{KeepLast: 2},
+		MaintenanceWindows: []MaintenanceWindow{{Start: "01:00", End: "05:00"}},
+		Schedules:          []DaemonSchedule{{Name: "hourly", Schedule: "0 * * * *", Backup: json.RawMessage(`{}`)}},
+	}
+	d, err := NewDaemon(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var backups int
+	var prunedDsts []string
+	d.Backup = func(o BackupOptions) (*BackupResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		backups++
+		if o.Namespace != "cassandra" || o.Keyspace != "keyspace" || len(o.Dsts) != 2 {
+			t.Errorf("unexpected backup options %+v", o)
+		}
+		return &BackupResult{
+			Tag:        "20990101020000",
+			Path:       "default/cluster/keyspace/sum/20990101020000",
+			FailedDsts: map[string]string{"s3://failed": "upload failed"},
+		}, nil
+	}
+	d.Prune = func(o PruneOptions) (*PruneResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		prunedDsts = append(prunedDsts, o.Dst)
+		if !reflect.DeepEqual(o.Clusters, []string{"default/cluster"}) || o.KeepLast != 2 {
+			t.Errorf("unexpected prune options %+v", o)
+		}
+		return &PruneResult{
+			Pruned:   []string{"default/cluster/keyspace/sum/20990101000000"},
+			Retained: []string{"default/cluster/keyspace/sum/20990101010000"},
+		}, nil
+	}
+
+	// Due outside of the maintenance window, the run waits for the window
+	d.Now = func() time.Time { return time.Date(2099, 1, 1, 12, 0, 0, 0, time.Local) }
+	d.Tick()
+	d.Wait()
+	status := d.Status()[0]
+	if backups != 0 || !status.Pending || status.LastRun != nil {
+		t.Fatalf("expected a pending run outside of the maintenance window, got %d backups and status %+v", backups, status)
+	}
+
+	// In the window, the pending run starts once
+	d.Now = func() time.Time { return time.Date(2099, 1, 2, 2, 0, 30, 0, time.Local) }
+	d.Tick()
+	d.Wait()
+	status = d.Status()[0]
+	if backups != 1 || status.Pending || status.LastRun == nil || status.LastRun.Phase != PhaseSucceeded {
+		t.Fatalf("expected a successful run in the maintenance window, got %d backups and status %+v", backups, status)
+	}
+	if !reflect.DeepEqual(prunedDsts, []string{"s3://bucket/cassandra?endpoint=http://minio:9000"}) {
+		t.Errorf("expected to prune only the destination which succeeded, pruned %v", prunedDsts)
+	}
+	if want := []string{"s3://bucket/cassandra/default/cluster/keyspace/sum/20990101000000"}; !reflect.DeepEqual(status.LastRun.Pruned, want) {
+		t.Errorf("got pruned %v, want %v", status.LastRun.Pruned, want)
+	}
+	if want := []string{"s3://bucket/cassandra/default/cluster/keyspace/sum/20990101010000"}; !reflect.DeepEqual(status.LastRun.Retained, want) {
+		t.Errorf("got retained %v, want %v", status.LastRun.Retained, want)
+	}
+
+	// Nothing is due until the next hour
+	d.Tick()
+	d.Wait()
+	if backups != 1 {
+		t.Errorf("expected a single run, got %d", backups)
+	}
+}
@@ -0,0 +1,109 @@
+package cain
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nuvo/cain/pkg/utils"
+	core_v1 "k8s.io/api/core/v1"
+)
+
+// Reasons of the events of backups and restores
+const (
+	ReasonBackupStarted    = "BackupStarted"
+	ReasonBackupSucceeded  = "BackupSucceeded"
+	ReasonBackupFailed     = "BackupFailed"
+	ReasonRestoreStarted   = "RestoreStarted"
+	ReasonRestoreSucceeded = "RestoreSucceeded"
+	ReasonRestoreFailed    = "RestoreFailed"
+)
+
+// LastBackupAnnotationPrefix is the prefix of the annotations of the last successful backup of each keyspace:
+// <prefix>/<keyspace>.tag, <prefix>/<keyspace>.time and <prefix>/<keyspace>.bytes
+const LastBackupAnnotationPrefix = "last-backup.cain.nuvo.io"
+
+// eventRecorder records events of backups and restores on the statefulset (or the first pod) of a cassandra cluster,
+// and annotates the statefulset with the last successful backup of each keyspace
+// A nil eventRecorder records nothing. Failures to record are logged, they do not fail backups and restores
+type eventRecorder struct {
+	client   interface{}
+	object   *core_v1.ObjectReference
+	events   bool
+	annotate bool
+}
+
+// newEventRecorder returns an eventRecorder, or nil if events and annotations are disabled or the object to record them on is not found
+func newEventRecorder(events, annotate bool, kubeconfig, context, namespace, selector, statefulSet string) *eventRecorder {
+	if !events && !annotate {
+		return nil
+	}
+	client, err := utils.GetClientToK8s(kubeconfig, context)
+	if err != nil {
+		log.Println("WARNING: events will not be recorded:", err)
+		return nil
+	}
+	object, err := utils.GetEventTarget(client, namespace, selector, statefulSet)
+	if err != nil {
+		log.Println("WARNING: events will not be recorded:", err)
+		return nil
+	}
+	if annotate && object.Kind != "StatefulSet" {
+		log.Printf("WARNING: pods are not owned by a statefulset, backups will not be annotated")
+		annotate = false
+	}
+
+	return &eventRecorder{client: client, object: object, events: events, annotate: annotate}
+}
+
+// backupStarted records the start of a backup
+func (r *eventRecorder) backupStarted(keyspace string) {
+	r.record(core_v1.EventTypeNormal, ReasonBackupStarted, "Backup of keyspace %s started", keyspace)
+}
+
+// backupFinished records the result of a backup, and annotates the statefulset if it succeeded
+func (r *eventRecorder) backupFinished(keyspace string, result *BackupResult, err error) {
+	if r == nil {
+		return
+	}
+	if err != nil {
+		r.record(core_v1.EventTypeWarning, ReasonBackupFailed, "Backup of keyspace %s failed: %s", keyspace, err)
+		return
+	}
+	r.record(core_v1.EventTypeNormal, ReasonBackupSucceeded, "Backup %s of keyspace %s succeeded: %d files, %d bytes", result.Tag, keyspace, result.Files, result.Bytes)
+	if !r.annotate {
+		return
+	}
+
+	annotations := map[string]string{
+		fmt.Sprintf("%s/%s.tag", LastBackupAnnotationPrefix, keyspace):   result.Tag,
+		fmt.Sprintf("%s/%s.time", LastBackupAnnotationPrefix, keyspace):  time.Now().UTC().Format(time.RFC3339),
+		fmt.Sprintf("%s/%s.bytes", LastBackupAnnotationPrefix, keyspace): fmt.Sprint(result.Bytes),
+	}
+	if err := utils.AnnotateStatefulSet(r.client, r.object.Namespace, r.object.Name, annotations); err != nil {
+		log.Println("WARNING: could not annotate statefulset:", err)
+	}
+}
+
+// restoreStarted records the start of a restore
+func (r *eventRecorder) restoreStarted(keyspace, tag string) {
+	r.record(core_v1.EventTypeNormal, ReasonRestoreStarted, "Restore of backup %s of keyspace %s started", tag, keyspace)
+}
+
+// restoreFinished records the result of a restore
+func (r *eventRecorder) restoreFinished(keyspace, tag string, result *RestoreResult, err error) {
+	if err != nil {
+		r.record(core_v1.EventTypeWarning, ReasonRestoreFailed, "Restore of backup %s of keyspace %s failed: %s", tag, keyspace, err)
+		return
+	}
+	r.record(core_v1.EventTypeNormal, ReasonRestoreSucceeded, "Restore of backup %s of keyspace %s succeeded: %d files", tag, keyspace, result.Files)
+}
+
+func (r *eventRecorder) record(eventType, reason, format string, args ...interface{}) {
+	if r == nil || !r.events {
+		return
+	}
+	if err := utils.CreateEvent(r.client, r.object, eventType, reason, fmt.Sprintf(format, args...)); err != nil {
+		log.Println("WARNING: could not record event:", err)
+	}
+}
@@ -0,0 +1,151 @@
+package cain
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nuvo/cain/pkg/utils"
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// Phases of backups and restores hooks run at
+const (
+	HookPreSnapshot  = "pre-snapshot"
+	HookPostSnapshot = "post-snapshot"
+	HookPostUpload   = "post-upload"
+	HookPreTruncate  = "pre-truncate"
+	HookPostRefresh  = "post-refresh"
+)
+
+// Phases of backups and of restores
+var (
+	backupHookPhases  = []string{HookPreSnapshot, HookPostSnapshot, HookPostUpload}
+	restoreHookPhases = []string{HookPreTruncate, HookPostRefresh}
+)
+
+// Hook is an action run at a phase of a backup or restore. A hook which fails aborts the backup or restore
+// Command is a shell command, run locally or in the container of each pod if InPods is set. Func is called instead
+// of Command if it is set, for library use
+type Hook struct {
+	Phase   string   `json:"phase"`
+	Command string   `json:"command,omitempty"`
+	InPods  bool     `json:"inPods,omitempty"`
+	Func    HookFunc `json:"-"`
+}
+
+// HookFunc is called at a phase of a backup or restore
+type HookFunc func(hc HookContext) error
+
+// HookContext describes the backup or restore a hook runs in
+// Commands get it as the environment variables CAIN_HOOK_PHASE, CAIN_HOOK_NAMESPACE, CAIN_HOOK_KEYSPACE,
+// CAIN_HOOK_TAG and CAIN_HOOK_PODS (comma separated), and CAIN_HOOK_POD in pods
+type HookContext struct {
+	Phase     string
+	Namespace string
+	Keyspace  string
+	// Tag is empty before the snapshot of a backup
+	Tag  string
+	Pods []string
+}
+
+// ParseHooks parses hooks from phase=command values, of commands run locally and of commands run in pods
+func ParseHooks(commands, podCommands []string) ([]Hook, error) {
+	var hooks []Hook
+	for i, value := range append(append([]string{}, commands...), podCommands...) {
+		split := strings.SplitN(value, "=", 2)
+		if len(split) != 2 || strings.TrimSpace(split[1]) == "" {
+			return nil, fmt.Errorf("illegal hook %s. must be phase=command", value)
+		}
+		hooks = append(hooks, Hook{Phase: split[0], Command: split[1], InPods: i >= len(commands)})
+	}
+	return hooks, nil
+}
+
+// TestHooks checks that hooks run at supported phases and have an action
+func TestHooks(hooks []Hook, phases []string, agent bool) error {
+	for _, hook := range hooks {
+		if !utils.Contains(phases, hook.Phase) {
+			return fmt.Errorf("illegal hook phase %s. must be one of: %s", hook.Phase, strings.Join(phases, ", "))
+		}
+		if hook.Func == nil && hook.Command == "" {
+			return fmt.Errorf("%s hook has no command", hook.Phase)
+		}
+		if hook.Func == nil && hook.InPods && agent {
+			return fmt.Errorf("%s hook can not run in pods with agents", hook.Phase)
+		}
+	}
+	return nil
+}
+
+// runHooks runs the hooks of a phase in order, and returns the error of the first hook which fails
+func runHooks(hooks []Hook, iK8sClient interface{}, container string, hc HookContext) error {
+	for _, hook := range hooks {
+		if hook.Phase != hc.Phase {
+			continue
+		}
+		log.Printf("Running %s hook", hc.Phase)
+		var err error
+		switch {
+		case hook.Func != nil:
+			err = hook.Func(hc)
+		case hook.InPods:
+			err = runPodsHook(iK8sClient, container, hook.Command, hc)
+		default:
+			err = runLocalHook(hook.Command, hc)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook failed: %s", hc.Phase, err)
+		}
+	}
+	return nil
+}
+
+// runLocalHook runs the command of a hook locally
+func runLocalHook(command string, hc HookContext) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), hookEnv(hc)...)
+	output, err := cmd.CombinedOutput()
+	printOutput(string(output), hc.Phase)
+
+	return err
+}
+
+// runPodsHook runs the command of a hook in the container of all pods in parallel
+func runPodsHook(iK8sClient interface{}, container, command string, hc HookContext) error {
+	k8sClient := iK8sClient.(*skbn.K8sClient)
+	errc := make(chan error, len(hc.Pods))
+	bwg := utils.NewBoundedWaitGroup(len(hc.Pods))
+	for _, pod := range hc.Pods {
+		bwg.Add(1)
+
+		go func(pod string) {
+			defer bwg.Done()
+			env := append(hookEnv(hc), "CAIN_HOOK_POD="+pod)
+			podCommand := append(append([]string{"env"}, env...), "sh", "-c", command)
+			stdout := new(bytes.Buffer)
+			stderr, err := skbn.Exec(*k8sClient, hc.Namespace, pod, container, podCommand, nil, stdout)
+			printOutput(stdout.String()+string(stderr), pod)
+			if err != nil {
+				errc <- fmt.Errorf("%s: %s", pod, err)
+			}
+		}(pod)
+	}
+	bwg.Wait()
+	close(errc)
+
+	return <-errc
+}
+
+func hookEnv(hc HookContext) []string {
+	return []string{
+		"CAIN_HOOK_PHASE=" + hc.Phase,
+		"CAIN_HOOK_NAMESPACE=" + hc.Namespace,
+		"CAIN_HOOK_KEYSPACE=" + hc.Keyspace,
+		"CAIN_HOOK_TAG=" + hc.Tag,
+		"CAIN_HOOK_PODS=" + strings.Join(hc.Pods, ","),
+	}
+}
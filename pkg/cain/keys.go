@@ -0,0 +1,63 @@
+package cain
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+// SecretKeyringKey is the key of an encryption key secret holding the keyring, in the format of a keyring file
+const SecretKeyringKey = "keyring"
+
+// encryptionKeys are the keys backups are encrypted with, from a key source or from the keyring of a secret
+type encryptionKeys struct {
+	source  string
+	secret  string
+	keyring []byte
+}
+
+// getEncryptionKeys returns the keys of a key source, or reads the keyring of a secret in namespace
+func getEncryptionKeys(iK8sClient interface{}, namespace, keySource, secret string) (encryptionKeys, error) {
+	keys := encryptionKeys{source: keySource, secret: secret}
+	if secret == "" {
+		return keys, nil
+	}
+	if keySource != "" {
+		return keys, fmt.Errorf("encryption key and encryption key secret are mutually exclusive")
+	}
+
+	log.Println("Reading encryption keys from secret", secret)
+	data, err := utils.GetSecretData(iK8sClient, namespace, secret)
+	if err != nil {
+		return keys, err
+	}
+	keyring, ok := data[SecretKeyringKey]
+	if !ok {
+		return keys, fmt.Errorf("secret %s has no %s key", secret, SecretKeyringKey)
+	}
+	keys.keyring = keyring
+
+	return keys, nil
+}
+
+// enabled returns true if keys were provided
+func (k encryptionKeys) enabled() bool {
+	return k.source != "" || k.secret != ""
+}
+
+// newDataKey gets a key to encrypt a backup with, see utils.NewDataKey
+func (k encryptionKeys) newDataKey(keyID string) ([]byte, *utils.Encryption, error) {
+	if k.secret != "" {
+		return utils.NewDataKeyFromKeyring(k.keyring, "secret "+k.secret, keyID)
+	}
+	return utils.NewDataKey(k.source, keyID)
+}
+
+// getDataKey gets the key a backup was encrypted with, see utils.GetDataKey
+func (k encryptionKeys) getDataKey(encryption *utils.Encryption) ([]byte, error) {
+	if k.secret != "" {
+		return utils.GetDataKeyFromKeyring(k.keyring, "secret "+k.secret, encryption)
+	}
+	return utils.GetDataKey(k.source, encryption)
+}
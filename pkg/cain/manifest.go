@@ -0,0 +1,341 @@
+package cain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nuvo/cain/pkg/utils"
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// ManifestFile is the name of the object holding the metadata of a backup tag
+const ManifestFile = "_MANIFEST.json"
+
+// Manifest holds the metadata of a backup tag
+type Manifest struct {
+	Keyspace    string            `json:"keyspace"`
+	Schema      string            `json:"schema"`
+	Tag         string            `json:"tag"`
+	Compression string            `json:"compression,omitempty"`
+	Encryption  *utils.Encryption `json:"encryption,omitempty"`
+	Layout      string            `json:"layout,omitempty"`
+	// Datacenter is set if only the pods of a single datacenter were backed up
+	Datacenter string `json:"datacenter,omitempty"`
+	// Topology is the datacenter and rack of the backed up pods, keyed by pod
+	Topology map[string]NodeTopology `json:"topology,omitempty"`
+	Files    map[string]FileInfo     `json:"files"`
+	// Archives are the objects of the archive layout, keyed by their path relative to the tag (pod/table/archive)
+	Archives map[string]ArchiveInfo `json:"archives,omitempty"`
+}
+
+// FileInfo holds the metadata of a single backed up file
+type FileInfo struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256,omitempty"`
+	// StoredSize is the size of the object in storage, if it differs from the size of the file (compressed or encrypted files)
+	StoredSize int64 `json:"storedSize,omitempty"`
+}
+
+// storedSize returns the size of the object in storage
+func (f FileInfo) storedSize() int64 {
+	if f.StoredSize != 0 {
+		return f.StoredSize
+	}
+	return f.Size
+}
+
+// ArchiveInfo holds the metadata of a single archive
+type ArchiveInfo struct {
+	FileInfo
+	// Files are the archived files, keyed in Manifest.Files
+	Files []string `json:"files"`
+}
+
+// Objects returns the metadata of the objects of a backup, which are the files or the archives of the backup
+// Objects are keyed by their path relative to the tag, without compression suffix
+func (m *Manifest) Objects() map[string]FileInfo {
+	if m.Layout != LayoutArchive {
+		return m.Files
+	}
+	objects := make(map[string]FileInfo)
+	for archive, info := range m.Archives {
+		objects[archive] = info.FileInfo
+	}
+	return objects
+}
+
+// setStoredSize sets the size in storage of an object
+func (m *Manifest) setStoredSize(object string, size int64) {
+	if m.Layout != LayoutArchive {
+		info := m.Files[object]
+		info.StoredSize = size
+		m.Files[object] = info
+		return
+	}
+	info := m.Archives[object]
+	info.StoredSize = size
+	m.Archives[object] = info
+}
+
+// ObjectName returns the name of a file in storage
+func (m *Manifest) ObjectName(file string) string {
+	return file + utils.CompressionSuffix(m.Compression)
+}
+
+// FileName returns the name of the file stored as an object
+func (m *Manifest) FileName(object string) string {
+	return strings.TrimSuffix(object, utils.CompressionSuffix(m.Compression))
+}
+
+// BuildManifest gets the size (and checksum if requested) of all files to be backed up
+// Files are keyed by their path relative to the tag (pod/table/file)
+func BuildManifest(iK8sClient interface{}, keyspace, schema, tag, tagPath string, fromToPaths []skbn.FromToPair, checksum bool) (*Manifest, error) {
+	manifest := &Manifest{
+		Keyspace: keyspace,
+		Schema:   schema,
+		Tag:      tag,
+		Files:    make(map[string]FileInfo),
+	}
+
+	var mutex sync.Mutex
+	err := forEachPod(fromToPaths, true, func(namespace, pod, container string, fromToPaths []skbn.FromToPair, paths []string) error {
+		sizes, err := utils.GetSizesFromK8s(iK8sClient, namespace, pod, container, paths)
+		if err != nil {
+			return err
+		}
+		var sums map[string]string
+		if checksum {
+			log.Println(pod, "Calculating checksums")
+			sums, err = utils.GetChecksumsFromK8s(iK8sClient, namespace, pod, container, paths)
+			if err != nil {
+				return err
+			}
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i, ftp := range fromToPaths {
+			size, ok := sizes[paths[i]]
+			if !ok {
+				return fmt.Errorf("could not get size of file %s in pod %s", paths[i], pod)
+			}
+			manifest.Files[utils.RelativePath(ftp.ToPath, tagPath)] = FileInfo{Size: size, Sha256: sums[paths[i]]}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// UploadManifest uploads the manifest of a backup tag
+func UploadManifest(iDstClient interface{}, dstPrefix, tagPath string, manifest *Manifest, s3maxUploadParts int, s3partSize int64, verbose bool) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(tagPath, ManifestFile)
+
+	return utils.Upload(iDstClient, dstPrefix, manifestPath, "", bytes.NewReader(b), s3partSize, s3maxUploadParts, verbose)
+}
+
+// ReadManifest reads the manifest of a backup tag. Returns nil if the backup has no manifest
+func ReadManifest(iSrcClient interface{}, srcPrefix, tagPath string, verbose bool) (*Manifest, error) {
+	manifestPath := filepath.Join(tagPath, ManifestFile)
+	exists, err := objectExists(iSrcClient, srcPrefix, manifestPath)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	b := new(bytes.Buffer)
+	if err := utils.Download(iSrcClient, srcPrefix, manifestPath, b, verbose); err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(b.Bytes(), manifest); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %s", manifestPath, err)
+	}
+
+	return manifest, nil
+}
+
+// RecordStoredSizes lists the backed up objects and records their size in storage in the manifest
+func RecordStoredSizes(iDstClient interface{}, dstPrefix, tagPath string, manifest *Manifest) error {
+	sizes, err := utils.GetListOfFilesWithSizes(iDstClient, dstPrefix, tagPath)
+	if err != nil {
+		return err
+	}
+	for object := range manifest.Objects() {
+		size, ok := sizes[manifest.ObjectName(object)]
+		if !ok {
+			return fmt.Errorf("%s not found after upload", manifest.ObjectName(object))
+		}
+		manifest.setStoredSize(object, size)
+	}
+
+	return nil
+}
+
+// VerifyUploadedFiles downloads the backed up objects and compares their checksums to the manifest
+// transform is applied to the downloaded objects before calculating their checksums
+func VerifyUploadedFiles(iDstClient interface{}, dstPrefix, tagPath string, manifest *Manifest, parallel int, transform utils.StreamTransform, verbose bool) error {
+	objects := manifest.Objects()
+	var files []string
+	for file, info := range objects {
+		if info.Sha256 != "" {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if parallel == 0 || parallel > len(files) {
+		parallel = len(files)
+	}
+
+	var mismatches []string
+	var mutex sync.Mutex
+	bwg := utils.NewBoundedWaitGroup(parallel)
+	for _, file := range files {
+		bwg.Add(1)
+
+		go func(file string) {
+			defer bwg.Done()
+			h := sha256.New()
+			err := utils.DownloadTransformed(iDstClient, dstPrefix, filepath.Join(tagPath, manifest.ObjectName(file)), h, transform, verbose)
+			sum := fmt.Sprintf("%x", h.Sum(nil))
+			if err == nil && sum == objects[file].Sha256 {
+				return
+			}
+			if err != nil {
+				log.Println(file, err)
+			}
+			mutex.Lock()
+			mismatches = append(mismatches, file)
+			mutex.Unlock()
+		}(file)
+	}
+	bwg.Wait()
+
+	return checksumError(mismatches)
+}
+
+// VerifyRestoredFiles calculates the checksums of the restored files and compares them to the manifest
+func VerifyRestoredFiles(iK8sClient interface{}, srcPath string, fromToPaths []skbn.FromToPair, manifest *Manifest) error {
+	var mismatches []string
+	var mutex sync.Mutex
+	err := forEachPod(fromToPaths, false, func(namespace, pod, container string, fromToPaths []skbn.FromToPair, paths []string) error {
+		log.Println(pod, "Verifying checksums")
+		sums, err := utils.GetChecksumsFromK8s(iK8sClient, namespace, pod, container, paths)
+		if err != nil {
+			return err
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i, ftp := range fromToPaths {
+			file := manifest.FileName(utils.RelativePath(ftp.FromPath, srcPath))
+			expected := manifest.Files[file].Sha256
+			if expected != "" && sums[paths[i]] != expected {
+				mismatches = append(mismatches, file)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return checksumError(mismatches)
+}
+
+// RestoreTransform returns a StreamTransform to decrypt and decompress the files of a backup,
+// or nil if the backup is neither encrypted nor compressed
+func RestoreTransform(manifest *Manifest, keySource string) (utils.StreamTransform, error) {
+	return restoreTransform(manifest, encryptionKeys{source: keySource})
+}
+
+// restoreTransform returns the StreamTransform of a backup, with keys from a key source or from a secret
+func restoreTransform(manifest *Manifest, keys encryptionKeys) (utils.StreamTransform, error) {
+	if manifest == nil {
+		return nil, nil
+	}
+	var decrypt utils.StreamTransform
+	if manifest.Encryption != nil {
+		if !keys.enabled() {
+			return nil, fmt.Errorf("backup is encrypted with key %s. use \"--encryption-key\" or \"--encryption-key-secret\" to provide the key", manifest.Encryption.KeyID)
+		}
+		key, err := keys.getDataKey(manifest.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		decrypt = utils.NewDecryptTransform(key)
+	}
+
+	return utils.ChainTransforms(decrypt, utils.NewDecompressTransform(manifest.Compression)), nil
+}
+
+// podFunc acts on the files of a single pod
+// paths are the paths inside the container, in the same order as fromToPaths
+type podFunc func(namespace, pod, container string, fromToPaths []skbn.FromToPair, paths []string) error
+
+// forEachPod groups pairs by pod and runs f on all pods in parallel
+// k8sIsSrc states whether the Kubernetes side of the pairs is FromPath (backup) or ToPath (restore)
+func forEachPod(fromToPaths []skbn.FromToPair, k8sIsSrc bool, f podFunc) error {
+	type podFiles struct {
+		namespace   string
+		container   string
+		fromToPaths []skbn.FromToPair
+		paths       []string
+	}
+	pods := make(map[string]*podFiles)
+	for _, ftp := range fromToPaths {
+		k8sPath := ftp.ToPath
+		if k8sIsSrc {
+			k8sPath = ftp.FromPath
+		}
+		namespace, pod, container, path := utils.SplitK8sPath(k8sPath)
+		if _, ok := pods[pod]; !ok {
+			pods[pod] = &podFiles{namespace: namespace, container: container}
+		}
+		pods[pod].fromToPaths = append(pods[pod].fromToPaths, ftp)
+		pods[pod].paths = append(pods[pod].paths, path)
+	}
+	if len(pods) == 0 {
+		return nil
+	}
+
+	errc := make(chan error, len(pods))
+	bwg := utils.NewBoundedWaitGroup(len(pods))
+	for pod, pf := range pods {
+		bwg.Add(1)
+
+		go func(pod string, pf *podFiles) {
+			defer bwg.Done()
+			if err := f(pf.namespace, pod, pf.container, pf.fromToPaths, pf.paths); err != nil {
+				errc <- err
+			}
+		}(pod, pf)
+	}
+	bwg.Wait()
+	close(errc)
+
+	return <-errc
+}
+
+func checksumError(mismatches []string) error {
+	if len(mismatches) == 0 {
+		return nil
+	}
+	sort.Strings(mismatches)
+	return fmt.Errorf("checksum mismatch in %d files: %s", len(mismatches), strings.Join(mismatches, ", "))
+}
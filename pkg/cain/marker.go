@@ -0,0 +1,68 @@
+package cain
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+// CompletionMarker is the name of the object written last to mark a backup tag as complete
+const CompletionMarker = "_COMPLETE"
+
+// WriteCompletionMarker marks a backup tag as complete
+func WriteCompletionMarker(iDstClient interface{}, dstPrefix, tagPath string, s3maxUploadParts int, s3partSize int64, verbose bool) error {
+	reader := bytes.NewReader([]byte(utils.GetTimeStamp()))
+
+	return utils.Upload(iDstClient, dstPrefix, completionMarkerPath(tagPath), "", reader, s3partSize, s3maxUploadParts, verbose)
+}
+
+// TestBackupComplete returns an error if a backup tag is incomplete, unless incomplete backups are allowed
+func TestBackupComplete(iSrcClient interface{}, srcPrefix, tagPath string, allowIncomplete bool) error {
+	complete, err := objectExists(iSrcClient, srcPrefix, completionMarkerPath(tagPath))
+	if err != nil {
+		return err
+	}
+	if complete {
+		return nil
+	}
+	if !allowIncomplete {
+		return fmt.Errorf("backup %s is incomplete (%s not found). use \"--allow-incomplete\" to restore it anyway", tagPath, CompletionMarker)
+	}
+	log.Println("WARNING: backup", tagPath, "is incomplete")
+
+	return nil
+}
+
+// completeTags returns the tags which have a completion marker, of files listed under a common path
+// Tags are keyed by their path relative to the listed path, as files are
+func completeTags(files []string) map[string]bool {
+	tags := make(map[string]bool)
+	for _, file := range files {
+		if isCompletionMarker(file) {
+			tags[filepath.Dir(file)] = true
+		}
+	}
+	return tags
+}
+
+// isCompletionMarker returns true if file is the completion marker of a tag
+func isCompletionMarker(file string) bool {
+	return filepath.Base(file) == CompletionMarker
+}
+
+func completionMarkerPath(tagPath string) string {
+	return filepath.Join(tagPath, CompletionMarker)
+}
+
+// objectExists checks if a single object exists in storage
+func objectExists(iClient interface{}, prefix, path string) (bool, error) {
+	files, err := utils.GetListOfFiles(iClient, prefix, path)
+	if err != nil {
+		return false, err
+	}
+
+	return len(files) != 0, nil
+}
@@ -78,6 +78,11 @@ func GetClusterName(iClient interface{}, namespace, pod, container string, creds
 		return "", err
 	}
 
+	return parseClusterName(output), nil
+}
+
+// parseClusterName parses the name of the cassandra cluster from the output of nodetool describecluster
+func parseClusterName(output string) string {
 	subStr := "Name:"
 	for _, line := range strings.Split(output, "\n") {
 		if strings.Contains(line, subStr) {
@@ -86,7 +91,7 @@ func GetClusterName(iClient interface{}, namespace, pod, container string, creds
 		}
 	}
 
-	return output, nil
+	return output
 }
 
 func takeSnapshot(k8sClient *skbn.K8sClient, namespace, pod, container, keyspace, tag string, creds Credentials) error {
@@ -123,14 +128,9 @@ func refreshTable(k8sClient *skbn.K8sClient, namespace, pod, container, keyspace
 }
 
 func nodetool(k8sClient *skbn.K8sClient, namespace, pod, container string, args []string, creds Credentials) (string, error) {
-	var command []string
-	if creds.enabled {
-		command = append([]string{"nodetool", "-u", creds.username, "-pwf", creds.nodetoolCredentialsFile}, args...)
-	} else {
-		command = append([]string{"nodetool"}, args...)
-	}
+	command, stdin := creds.nodetoolCommand(args)
 	stdout := new(bytes.Buffer)
-	stderr, err := skbn.Exec(*k8sClient, namespace, pod, container, command, nil, stdout)
+	stderr, err := skbn.Exec(*k8sClient, namespace, pod, container, command, stdin, stdout)
 	if len(stderr) != 0 {
 		return "", fmt.Errorf("STDERR: " + (string)(stderr))
 	}
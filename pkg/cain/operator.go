@@ -0,0 +1,464 @@
+package cain
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuvo/cain/pkg/utils"
+	"github.com/robfig/cron/v3"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// OperatorOptions are the options to pass to RunOperator
+type OperatorOptions struct {
+	Kubeconfig     string
+	Context        string
+	Namespace      string
+	Interval       time.Duration
+	AgentTokenFile string
+	AgentCAFile    string
+}
+
+// RunOperator reconciles cain resources in the cluster of Kubeconfig and Context until stop is closed
+func RunOperator(o OperatorOptions, stop <-chan struct{}) error {
+	log.Println("Getting clients")
+	k8sClient, err := utils.GetClientToK8s(o.Kubeconfig, o.Context)
+	if err != nil {
+		return err
+	}
+	client, err := dynamic.NewForConfig(k8sClient.Config)
+	if err != nil {
+		return err
+	}
+
+	op := NewOperator(client, o.Namespace)
+	op.Kubeconfig, op.Context = o.Kubeconfig, o.Context
+	op.AgentTokenFile, op.AgentCAFile = o.AgentTokenFile, o.AgentCAFile
+	op.Run(o.Interval, stop)
+	log.Println("Waiting for running backups and restores")
+	op.Wait()
+
+	return nil
+}
+
+// Operator reconciles CassandraBackup, CassandraBackupSchedule and CassandraRestore resources
+// Resources are read and updated through a dynamic client, so the operator can be tested with a fake dynamic client
+// Backups and restores act on the namespace of their resource, those which reach other namespaces or local files fail
+type Operator struct {
+	Client dynamic.Interface
+	// Namespace to reconcile resources in, all namespaces if empty
+	Namespace string
+	// Kubeconfig and Context are the cluster of all backups and restores
+	Kubeconfig string
+	Context    string
+	// AgentTokenFile and AgentCAFile are used to call the agents of backups and restores with agent set
+	AgentTokenFile string
+	AgentCAFile    string
+	// Backup, Restore and Now are replaceable for tests
+	Backup  func(BackupOptions) (*BackupResult, error)
+	Restore func(RestoreOptions) (*RestoreResult, error)
+	Now     func() time.Time
+
+	// running are the backups and restores started by this operator, keyed by resource/namespace/name
+	running map[string]bool
+	mutex   sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// NewOperator returns an Operator which performs backups and restores with Backup and Restore
+func NewOperator(client dynamic.Interface, namespace string) *Operator {
+	return &Operator{
+		Client:    client,
+		Namespace: namespace,
+		Backup:    BackupWithResult,
+		Restore:   RestoreWithResult,
+		Now:       time.Now,
+		running:   make(map[string]bool),
+	}
+}
+
+// Run reconciles resources every interval until stop is closed
+func (op *Operator) Run(interval time.Duration, stop <-chan struct{}) {
+	log.Println("Operator started!")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := op.Reconcile(); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-stop:
+			log.Println("Operator stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile reconciles all resources once. Backups and restores run in the background, use Wait to wait for them
+func (op *Operator) Reconcile() error {
+	var errs []string
+	for _, reconcile := range []func() error{op.reconcileSchedules, op.reconcileBackups, op.reconcileRestores} {
+		if err := reconcile(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Wait waits for the backups and restores started by the operator to end
+func (op *Operator) Wait() {
+	op.wg.Wait()
+}
+
+// reconcileBackups starts new backups, and fails backups which were running when the operator stopped
+func (op *Operator) reconcileBackups() error {
+	list, err := op.Client.Resource(CassandraBackupResource).Namespace(op.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list backups: %s", err)
+	}
+	for _, item := range list.Items {
+		backup := &CassandraBackup{}
+		if err := fromUnstructured(&item, backup); err != nil {
+			log.Println(err)
+			continue
+		}
+		key := resourceKey(CassandraBackupResource, backup.Namespace, backup.Name)
+
+		switch backup.Status.Phase {
+		case "", PhasePending:
+			if err := backup.Spec.test(backup.Namespace); err != nil {
+				log.Println("Backup", key, "is invalid:", err)
+				status := CassandraBackupStatus{Phase: PhaseFailed, Error: err.Error(), CompletionTime: op.now()}
+				if err := op.updateStatus(CassandraBackupResource, backup.Namespace, backup.Name, &status); err != nil {
+					log.Println(key, err)
+				}
+				continue
+			}
+			status := CassandraBackupStatus{Phase: PhaseRunning, StartTime: op.now()}
+			if err := op.updateStatus(CassandraBackupResource, backup.Namespace, backup.Name, &status); err != nil {
+				log.Println(key, err)
+				continue
+			}
+			log.Println("Starting backup", key)
+			op.start(key, func() {
+				options := backup.Spec.BackupOptions(backup.Namespace)
+				options.Kubeconfig, options.Context = op.Kubeconfig, op.Context
+				options.AgentTokenFile, options.AgentCAFile = op.AgentTokenFile, op.AgentCAFile
+				result, err := op.Backup(options)
+				status.CompletionTime = op.now()
+				status.Phase = PhaseSucceeded
+				if result != nil {
+					status.Tag = result.Tag
+					status.Path = result.Path
+					status.Files = result.Files
+					status.Bytes = result.Bytes
+					status.StoredBytes = result.StoredBytes
+					status.FailedDestinations = result.FailedDsts
+				}
+				if err != nil {
+					status.Phase = PhaseFailed
+					status.Error = err.Error()
+				}
+				log.Println("Backup", key, status.Phase)
+				if err := op.updateStatus(CassandraBackupResource, backup.Namespace, backup.Name, &status); err != nil {
+					log.Println(key, err)
+				}
+			})
+		case PhaseRunning:
+			if op.isRunning(key) {
+				continue
+			}
+			status := backup.Status
+			status.Phase = PhaseFailed
+			status.Error = "backup was interrupted"
+			status.CompletionTime = op.now()
+			if err := op.updateStatus(CassandraBackupResource, backup.Namespace, backup.Name, &status); err != nil {
+				log.Println(key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// reconcileRestores starts new restores, and fails restores which were running when the operator stopped
+func (op *Operator) reconcileRestores() error {
+	list, err := op.Client.Resource(CassandraRestoreResource).Namespace(op.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list restores: %s", err)
+	}
+	for _, item := range list.Items {
+		restore := &CassandraRestore{}
+		if err := fromUnstructured(&item, restore); err != nil {
+			log.Println(err)
+			continue
+		}
+		key := resourceKey(CassandraRestoreResource, restore.Namespace, restore.Name)
+
+		switch restore.Status.Phase {
+		case "", PhasePending:
+			if err := restore.Spec.test(restore.Namespace); err != nil {
+				log.Println("Restore", key, "is invalid:", err)
+				status := CassandraRestoreStatus{Phase: PhaseFailed, Error: err.Error(), CompletionTime: op.now()}
+				if err := op.updateStatus(CassandraRestoreResource, restore.Namespace, restore.Name, &status); err != nil {
+					log.Println(key, err)
+				}
+				continue
+			}
+			status := CassandraRestoreStatus{Phase: PhaseRunning, StartTime: op.now()}
+			if err := op.updateStatus(CassandraRestoreResource, restore.Namespace, restore.Name, &status); err != nil {
+				log.Println(key, err)
+				continue
+			}
+			log.Println("Starting restore", key)
+			op.start(key, func() {
+				options := restore.Spec.RestoreOptions(restore.Namespace)
+				options.Kubeconfig, options.Context = op.Kubeconfig, op.Context
+				options.AgentTokenFile, options.AgentCAFile = op.AgentTokenFile, op.AgentCAFile
+				result, err := op.Restore(options)
+				status.CompletionTime = op.now()
+				status.Phase = PhaseSucceeded
+				if result != nil {
+					status.Files = result.Files
+					status.Bytes = result.Bytes
+				}
+				if err != nil {
+					status.Phase = PhaseFailed
+					status.Error = err.Error()
+				}
+				log.Println("Restore", key, status.Phase)
+				if err := op.updateStatus(CassandraRestoreResource, restore.Namespace, restore.Name, &status); err != nil {
+					log.Println(key, err)
+				}
+			})
+		case PhaseRunning:
+			if op.isRunning(key) {
+				continue
+			}
+			status := restore.Status
+			status.Phase = PhaseFailed
+			status.Error = "restore was interrupted"
+			status.CompletionTime = op.now()
+			if err := op.updateStatus(CassandraRestoreResource, restore.Namespace, restore.Name, &status); err != nil {
+				log.Println(key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// reconcileSchedules creates the backups of schedules which are due, and removes backups beyond the history limits
+// Runs which are missed while the operator is down are not made up for, and a schedule never has two backups running
+func (op *Operator) reconcileSchedules() error {
+	list, err := op.Client.Resource(CassandraBackupScheduleResource).Namespace(op.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list backup schedules: %s", err)
+	}
+	for _, item := range list.Items {
+		schedule := &CassandraBackupSchedule{}
+		if err := fromUnstructured(&item, schedule); err != nil {
+			log.Println(err)
+			continue
+		}
+		key := resourceKey(CassandraBackupScheduleResource, schedule.Namespace, schedule.Name)
+		if err := op.reconcileSchedule(schedule); err != nil {
+			log.Println(key, err)
+		}
+	}
+
+	return nil
+}
+
+// reconcileSchedule reconciles a single schedule
+func (op *Operator) reconcileSchedule(schedule *CassandraBackupSchedule) error {
+	status := schedule.Status
+	cronSchedule, err := cron.ParseStandard(schedule.Spec.Schedule)
+	if err == nil {
+		err = schedule.Spec.Backup.test(schedule.Namespace)
+	}
+	if err != nil {
+		if status.Error == err.Error() {
+			return nil
+		}
+		status.Error = err.Error()
+		return op.updateStatus(CassandraBackupScheduleResource, schedule.Namespace, schedule.Name, &status)
+	}
+	status.Error = ""
+
+	backups, err := op.scheduledBackups(schedule)
+	if err != nil {
+		return err
+	}
+	if err := op.removeOldBackups(schedule, backups); err != nil {
+		return err
+	}
+	if schedule.Spec.Suspend {
+		return nil
+	}
+
+	last := schedule.CreationTimestamp.Time
+	if status.LastScheduleTime != nil {
+		last = status.LastScheduleTime.Time
+	}
+	now := op.Now()
+	if cronSchedule.Next(last).After(now) {
+		return nil
+	}
+
+	status.LastScheduleTime = &metav1.Time{Time: now}
+	for _, backup := range backups {
+		if phase := backup.Status.Phase; phase == "" || phase == PhasePending || phase == PhaseRunning {
+			log.Printf("Skipping scheduled backup of %s/%s, backup %s is still running", schedule.Namespace, schedule.Name, backup.Name)
+			return op.updateStatus(CassandraBackupScheduleResource, schedule.Namespace, schedule.Name, &status)
+		}
+	}
+
+	backup := &CassandraBackup{
+		TypeMeta: metav1.TypeMeta{APIVersion: ResourceGroup + "/" + ResourceVersion, Kind: "CassandraBackup"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", schedule.Name, now.Unix()),
+			Namespace: schedule.Namespace,
+			Labels:    map[string]string{ScheduleLabel: schedule.Name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: ResourceGroup + "/" + ResourceVersion,
+				Kind:       "CassandraBackupSchedule",
+				Name:       schedule.Name,
+				UID:        schedule.UID,
+			}},
+		},
+		Spec: schedule.Spec.Backup,
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(backup)
+	if err != nil {
+		return err
+	}
+	if _, err := op.Client.Resource(CassandraBackupResource).Namespace(schedule.Namespace).Create(&unstructured.Unstructured{Object: obj}, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("could not create backup %s: %s", backup.Name, err)
+	}
+	log.Println("Created scheduled backup", resourceKey(CassandraBackupResource, backup.Namespace, backup.Name))
+	status.LastBackup = backup.Name
+
+	return op.updateStatus(CassandraBackupScheduleResource, schedule.Namespace, schedule.Name, &status)
+}
+
+// scheduledBackups gets the backups created by a schedule, oldest first
+func (op *Operator) scheduledBackups(schedule *CassandraBackupSchedule) ([]*CassandraBackup, error) {
+	list, err := op.Client.Resource(CassandraBackupResource).Namespace(schedule.Namespace).List(metav1.ListOptions{
+		LabelSelector: ScheduleLabel + "=" + schedule.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var backups []*CassandraBackup
+	for _, item := range list.Items {
+		backup := &CassandraBackup{}
+		if err := fromUnstructured(&item, backup); err != nil {
+			return nil, err
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+
+	return backups, nil
+}
+
+// removeOldBackups deletes the oldest ended backups of a schedule beyond its history limits
+// Only the resources are deleted, the backed up files are kept
+func (op *Operator) removeOldBackups(schedule *CassandraBackupSchedule, backups []*CassandraBackup) error {
+	limits := map[string]int{
+		PhaseSucceeded: intOrDefault(schedule.Spec.SuccessfulBackupsHistoryLimit, 3),
+		PhaseFailed:    intOrDefault(schedule.Spec.FailedBackupsHistoryLimit, 1),
+	}
+	counts := make(map[string]int)
+	for i := len(backups) - 1; i >= 0; i-- {
+		backup := backups[i]
+		limit, ok := limits[backup.Status.Phase]
+		if !ok {
+			continue
+		}
+		counts[backup.Status.Phase]++
+		if counts[backup.Status.Phase] <= limit {
+			continue
+		}
+		if err := op.Client.Resource(CassandraBackupResource).Namespace(backup.Namespace).Delete(backup.Name, &metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("could not delete backup %s: %s", backup.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// start runs f in the background, marking key as running until it returns
+func (op *Operator) start(key string, f func()) {
+	op.mutex.Lock()
+	op.running[key] = true
+	op.mutex.Unlock()
+	op.wg.Add(1)
+
+	go func() {
+		defer op.wg.Done()
+		defer func() {
+			op.mutex.Lock()
+			delete(op.running, key)
+			op.mutex.Unlock()
+		}()
+		f()
+	}()
+}
+
+// isRunning returns true if key was started by this operator and did not end yet
+func (op *Operator) isRunning(key string) bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	return op.running[key]
+}
+
+// updateStatus replaces the status of a resource
+func (op *Operator) updateStatus(resource schema.GroupVersionResource, namespace, name string, status interface{}) error {
+	client := op.Client.Resource(resource).Namespace(namespace)
+	obj, err := client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	statusObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		return err
+	}
+	obj.Object["status"] = statusObj
+	_, err = client.UpdateStatus(obj, metav1.UpdateOptions{})
+
+	return err
+}
+
+// now returns the current time as a Kubernetes time
+func (op *Operator) now() *metav1.Time {
+	return &metav1.Time{Time: op.Now()}
+}
+
+// fromUnstructured converts a resource read by the dynamic client
+func fromUnstructured(u *unstructured.Unstructured, obj interface{}) error {
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj); err != nil {
+		return fmt.Errorf("could not parse %s %s/%s: %s", u.GetKind(), u.GetNamespace(), u.GetName(), err)
+	}
+	return nil
+}
+
+// resourceKey returns the key of a resource, used for logging and to track running operations
+func resourceKey(resource schema.GroupVersionResource, namespace, name string) string {
+	return resource.Resource + "/" + namespace + "/" + name
+}
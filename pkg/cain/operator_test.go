@@ -0,0 +1,369 @@
+package cain
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+var testNow = time.Date(2020, 1, 1, 12, 30, 0, 0, time.UTC)
+
+// testOperator is an Operator with a fake client, which records the backups and restores it performs
+type testOperator struct {
+	*Operator
+	t        *testing.T
+	mutex    sync.Mutex
+	backups  []BackupOptions
+	restores []RestoreOptions
+	err      error
+}
+
+func newTestOperator(t *testing.T, objects ...interface{}) *testOperator {
+	var runtimeObjects []runtime.Object
+	for _, obj := range objects {
+		runtimeObjects = append(runtimeObjects, toTestUnstructured(t, obj))
+	}
+	op := &testOperator{
+		Operator: NewOperator(fake.NewSimpleDynamicClient(runtime.NewScheme(), runtimeObjects...), "cassandra"),
+		t:        t,
+	}
+	op.Kubeconfig, op.Context = "/etc/cain/kubeconfig", "operator"
+	op.Now = func() time.Time { return testNow }
+	op.Backup = func(o BackupOptions) (*BackupResult, error) {
+		op.mutex.Lock()
+		defer op.mutex.Unlock()
+		op.backups = append(op.backups, o)
+		if op.err != nil {
+			return nil, op.err
+		}
+		return &BackupResult{Tag: "20200101123000", Path: "cassandra/cluster/" + o.Keyspace + "/sum/20200101123000", Files: 2, Bytes: 10}, nil
+	}
+	op.Restore = func(o RestoreOptions) (*RestoreResult, error) {
+		op.mutex.Lock()
+		defer op.mutex.Unlock()
+		op.restores = append(op.restores, o)
+		if op.err != nil {
+			return nil, op.err
+		}
+		return &RestoreResult{Files: 2, Bytes: 10}, nil
+	}
+
+	return op
+}
+
+// reconcile reconciles once and waits for the started backups and restores
+func (op *testOperator) reconcile() {
+	if err := op.Reconcile(); err != nil {
+		op.t.Fatal(err)
+	}
+	op.Wait()
+}
+
+// get reads a resource into obj
+func (op *testOperator) get(resource schema.GroupVersionResource, name string, obj interface{}) {
+	u, err := op.Client.Resource(resource).Namespace("cassandra").Get(name, metav1.GetOptions{})
+	if err != nil {
+		op.t.Fatal(err)
+	}
+	if err := fromUnstructured(u, obj); err != nil {
+		op.t.Fatal(err)
+	}
+}
+
+// listBackups lists the backups in the namespace of the operator
+func (op *testOperator) listBackups() []CassandraBackup {
+	list, err := op.Client.Resource(CassandraBackupResource).Namespace("cassandra").List(metav1.ListOptions{})
+	if err != nil {
+		op.t.Fatal(err)
+	}
+	var backups []CassandraBackup
+	for _, item := range list.Items {
+		backup := CassandraBackup{}
+		if err := fromUnstructured(&item, &backup); err != nil {
+			op.t.Fatal(err)
+		}
+		backups = append(backups, backup)
+	}
+	return backups
+}
+
+func toTestUnstructured(t *testing.T, obj interface{}) *unstructured.Unstructured {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &unstructured.Unstructured{Object: u}
+}
+
+func testObjectMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Namespace: "cassandra", CreationTimestamp: metav1.Time{Time: testNow.Add(-2 * time.Hour)}}
+}
+
+func testBackup(name, phase string) *CassandraBackup {
+	return &CassandraBackup{
+		TypeMeta:   metav1.TypeMeta{APIVersion: ResourceGroup + "/" + ResourceVersion, Kind: "CassandraBackup"},
+		ObjectMeta: testObjectMeta(name),
+		Spec:       CassandraBackupSpec{Keyspace: "keyspace", Dst: []string{"s3://bucket/cassandra"}},
+		Status:     CassandraBackupStatus{Phase: phase},
+	}
+}
+
+func testRestore(name, phase string) *CassandraRestore {
+	return &CassandraRestore{
+		TypeMeta:   metav1.TypeMeta{APIVersion: ResourceGroup + "/" + ResourceVersion, Kind: "CassandraRestore"},
+		ObjectMeta: testObjectMeta(name),
+		Spec:       CassandraRestoreSpec{Src: "s3://bucket/cassandra/cassandra/cluster", Keyspace: "keyspace", Tag: "20200101123000"},
+		Status:     CassandraRestoreStatus{Phase: phase},
+	}
+}
+
+func testSchedule(name string) *CassandraBackupSchedule {
+	return &CassandraBackupSchedule{
+		TypeMeta:   metav1.TypeMeta{APIVersion: ResourceGroup + "/" + ResourceVersion, Kind: "CassandraBackupSchedule"},
+		ObjectMeta: testObjectMeta(name),
+		Spec: CassandraBackupScheduleSpec{
+			Schedule: "0 * * * *",
+			Backup:   CassandraBackupSpec{Keyspace: "keyspace", Dst: []string{"s3://bucket/cassandra"}},
+		},
+	}
+}
+
+func TestOperatorBackup(t *testing.T) {
+	tests := []struct {
+		name      string
+		backup    *CassandraBackup
+		err       error
+		started   bool
+		wantPhase string
+		wantError string
+	}{
+		{name: "new backup succeeds", backup: testBackup("new", ""), started: true, wantPhase: PhaseSucceeded},
+		{name: "pending backup succeeds", backup: testBackup("pending", PhasePending), started: true, wantPhase: PhaseSucceeded},
+		{name: "failed backup", backup: testBackup("failed", ""), err: fmt.Errorf("no pods"), started: true, wantPhase: PhaseFailed, wantError: "no pods"},
+		{name: "interrupted backup", backup: testBackup("interrupted", PhaseRunning), wantPhase: PhaseFailed, wantError: "backup was interrupted"},
+		{name: "succeeded backup is ignored", backup: testBackup("succeeded", PhaseSucceeded), wantPhase: PhaseSucceeded},
+		{name: "failed backup is ignored", backup: testBackup("failed", PhaseFailed), wantPhase: PhaseFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := newTestOperator(t, tt.backup)
+			op.err = tt.err
+			op.reconcile()
+			// Resources which were handled are not started again
+			op.reconcile()
+
+			if started := len(op.backups) == 1; started != tt.started || len(op.backups) > 1 {
+				t.Fatalf("expected started %v, got %d backups", tt.started, len(op.backups))
+			}
+			if tt.started {
+				o := op.backups[0]
+				if o.Namespace != "cassandra" || o.Kubeconfig != op.Kubeconfig || o.Context != op.Context || o.Keyspace != "keyspace" {
+					t.Errorf("unexpected backup options %+v", o)
+				}
+			}
+			backup := &CassandraBackup{}
+			op.get(CassandraBackupResource, tt.backup.Name, backup)
+			if backup.Status.Phase != tt.wantPhase || backup.Status.Error != tt.wantError {
+				t.Errorf("expected phase %s and error %q, got %+v", tt.wantPhase, tt.wantError, backup.Status)
+			}
+			if tt.started && (backup.Status.StartTime == nil || backup.Status.CompletionTime == nil) {
+				t.Errorf("expected start and completion times, got %+v", backup.Status)
+			}
+			if tt.started && tt.err == nil && (backup.Status.Tag != "20200101123000" || backup.Status.Files != 2 || backup.Status.Bytes != 10) {
+				t.Errorf("expected the result in the status, got %+v", backup.Status)
+			}
+		})
+	}
+}
+
+func TestOperatorRejectsBackupOutsideNamespace(t *testing.T) {
+	backup := testBackup("other-namespace", "")
+	backup.Spec.Dst = []string{"pvc://other/backups"}
+	op := newTestOperator(t, backup)
+	op.reconcile()
+
+	if len(op.backups) != 0 {
+		t.Fatalf("expected no backups, got %d", len(op.backups))
+	}
+	op.get(CassandraBackupResource, backup.Name, backup)
+	if backup.Status.Phase != PhaseFailed || backup.Status.Error == "" {
+		t.Errorf("expected a failed backup, got %+v", backup.Status)
+	}
+}
+
+func TestOperatorRejectsLocalHooks(t *testing.T) {
+	backup := testBackup("local-hook", "")
+	backup.Spec.Hooks = []Hook{{Phase: HookPreSnapshot, Command: "touch /tmp/operator"}}
+	restore := testRestore("local-hook", "")
+	restore.Spec.Hooks = []Hook{{Phase: HookPostRefresh, Command: "touch /tmp/operator"}}
+	op := newTestOperator(t, backup, restore)
+	op.reconcile()
+
+	if len(op.backups) != 0 || len(op.restores) != 0 {
+		t.Fatalf("expected no backups or restores, got %d backups and %d restores", len(op.backups), len(op.restores))
+	}
+	op.get(CassandraBackupResource, backup.Name, backup)
+	if backup.Status.Phase != PhaseFailed || !strings.Contains(backup.Status.Error, "local hooks are not allowed") {
+		t.Errorf("expected a failed backup, got %+v", backup.Status)
+	}
+	op.get(CassandraRestoreResource, restore.Name, restore)
+	if restore.Status.Phase != PhaseFailed || !strings.Contains(restore.Status.Error, "local hooks are not allowed") {
+		t.Errorf("expected a failed restore, got %+v", restore.Status)
+	}
+}
+
+func TestOperatorRestore(t *testing.T) {
+	tests := []struct {
+		name      string
+		restore   *CassandraRestore
+		err       error
+		started   bool
+		wantPhase string
+		wantError string
+	}{
+		{name: "new restore succeeds", restore: testRestore("new", ""), started: true, wantPhase: PhaseSucceeded},
+		{name: "failed restore", restore: testRestore("failed", ""), err: fmt.Errorf("no pods"), started: true, wantPhase: PhaseFailed, wantError: "no pods"},
+		{name: "interrupted restore", restore: testRestore("interrupted", PhaseRunning), wantPhase: PhaseFailed, wantError: "restore was interrupted"},
+		{name: "succeeded restore is ignored", restore: testRestore("succeeded", PhaseSucceeded), wantPhase: PhaseSucceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := newTestOperator(t, tt.restore)
+			op.err = tt.err
+			op.reconcile()
+			op.reconcile()
+
+			if started := len(op.restores) == 1; started != tt.started || len(op.restores) > 1 {
+				t.Fatalf("expected started %v, got %d restores", tt.started, len(op.restores))
+			}
+			if tt.started && (op.restores[0].Namespace != "cassandra" || op.restores[0].Kubeconfig != op.Kubeconfig) {
+				t.Errorf("unexpected restore options %+v", op.restores[0])
+			}
+			restore := &CassandraRestore{}
+			op.get(CassandraRestoreResource, tt.restore.Name, restore)
+			if restore.Status.Phase != tt.wantPhase || restore.Status.Error != tt.wantError {
+				t.Errorf("expected phase %s and error %q, got %+v", tt.wantPhase, tt.wantError, restore.Status)
+			}
+		})
+	}
+}
+
+func TestOperatorSchedule(t *testing.T) {
+	op := newTestOperator(t, testSchedule("hourly"))
+	op.reconcile()
+
+	// The schedule fired at 12:00, its backup is created and started on the next reconciliation
+	schedule := &CassandraBackupSchedule{}
+	op.get(CassandraBackupScheduleResource, "hourly", schedule)
+	wantName := fmt.Sprintf("hourly-%d", testNow.Unix())
+	if schedule.Status.LastBackup != wantName || schedule.Status.LastScheduleTime == nil || schedule.Status.Error != "" {
+		t.Fatalf("expected backup %s to be scheduled, got %+v", wantName, schedule.Status)
+	}
+	backups := op.listBackups()
+	if len(backups) != 1 || backups[0].Name != wantName || backups[0].Labels[ScheduleLabel] != "hourly" {
+		t.Fatalf("expected backup %s, got %+v", wantName, backups)
+	}
+	op.reconcile()
+	if len(op.backups) != 1 {
+		t.Fatalf("expected the scheduled backup to run once, got %d", len(op.backups))
+	}
+
+	// The schedule does not fire again until 13:00
+	op.reconcile()
+	if backups := op.listBackups(); len(backups) != 1 {
+		t.Fatalf("expected a single backup before the next run, got %d", len(backups))
+	}
+	op.Now = func() time.Time { return testNow.Add(time.Hour) }
+	op.reconcile()
+	if backups := op.listBackups(); len(backups) != 2 {
+		t.Fatalf("expected a second backup after the next run, got %d", len(backups))
+	}
+}
+
+func TestOperatorScheduleSkipsRunningBackup(t *testing.T) {
+	running := testBackup("hourly-1", PhaseRunning)
+	running.Labels = map[string]string{ScheduleLabel: "hourly"}
+	op := newTestOperator(t, testSchedule("hourly"), running)
+	op.running[resourceKey(CassandraBackupResource, "cassandra", running.Name)] = true
+	if err := op.reconcileSchedules(); err != nil {
+		t.Fatal(err)
+	}
+
+	if backups := op.listBackups(); len(backups) != 1 {
+		t.Fatalf("expected the run to be skipped, got %d backups", len(backups))
+	}
+	schedule := &CassandraBackupSchedule{}
+	op.get(CassandraBackupScheduleResource, "hourly", schedule)
+	if schedule.Status.LastScheduleTime == nil || schedule.Status.LastBackup != "" {
+		t.Errorf("expected a skipped run, got %+v", schedule.Status)
+	}
+}
+
+func TestOperatorScheduleFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(s *CassandraBackupSchedule)
+	}{
+		{"illegal schedule", func(s *CassandraBackupSchedule) { s.Spec.Schedule = "every hour" }},
+		{"backup outside namespace", func(s *CassandraBackupSchedule) { s.Spec.Backup.CassandraDatacenter = "other/dc1" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule := testSchedule("hourly")
+			tt.modify(schedule)
+			op := newTestOperator(t, schedule)
+			op.reconcile()
+
+			op.get(CassandraBackupScheduleResource, "hourly", schedule)
+			if schedule.Status.Error == "" || schedule.Status.LastBackup != "" {
+				t.Errorf("expected an error in the status, got %+v", schedule.Status)
+			}
+			if backups := op.listBackups(); len(backups) != 0 {
+				t.Errorf("expected no backups, got %d", len(backups))
+			}
+		})
+	}
+}
+
+func TestOperatorScheduleHistoryLimits(t *testing.T) {
+	schedule := testSchedule("hourly")
+	schedule.Spec.Suspend = true
+	objects := []interface{}{schedule}
+	phases := []string{PhaseFailed, PhaseSucceeded, PhaseSucceeded, PhaseFailed, PhaseSucceeded, PhaseSucceeded, PhaseSucceeded}
+	for i, phase := range phases {
+		backup := testBackup(fmt.Sprintf("hourly-%d", i), phase)
+		backup.Labels = map[string]string{ScheduleLabel: "hourly"}
+		objects = append(objects, backup)
+	}
+	op := newTestOperator(t, objects...)
+	op.reconcile()
+
+	kept := make(map[string]bool)
+	for _, backup := range op.listBackups() {
+		kept[backup.Name] = true
+	}
+	// The newest 3 succeeded and the newest failed backups are kept
+	want := []string{"hourly-3", "hourly-4", "hourly-5", "hourly-6"}
+	if len(kept) != len(want) {
+		t.Fatalf("expected backups %v, got %v", want, kept)
+	}
+	for _, name := range want {
+		if !kept[name] {
+			t.Fatalf("expected backups %v, got %v", want, kept)
+		}
+	}
+	if len(op.backups) != 0 {
+		t.Errorf("expected a suspended schedule not to run, got %d backups", len(op.backups))
+	}
+}
@@ -0,0 +1,274 @@
+package cain
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+// PruneOptions are the options to pass to Prune
+type PruneOptions struct {
+	Dst              string
+	Clusters         []string
+	Keyspaces        []string
+	KeepLast         int
+	KeepDays         int
+	DryRun           bool
+	Parallel         int
+	S3Endpoint       string
+	S3ForcePathStyle bool
+	Kubeconfig       string
+	Context          string
+	Verbose          bool
+}
+
+// PruneResult describes the backups pruned by Prune
+type PruneResult struct {
+	// Pruned are the paths of the pruned backups, relative to Dst (namespace/cluster-name/keyspace/schema/tag)
+	Pruned []string
+	// Retained are the paths of backups beyond the retention which are immutable, and were kept
+	Retained []string
+}
+
+// Prune deletes backups beyond a retention and returns their paths
+// Dst is the path backups are stored under (the dst of backup). Of every keyspace, the newest KeepLast complete backups
+// and the backups taken in the last KeepDays days are kept. The newest complete backup is never deleted, and neither
+// are incomplete backups newer than it, since they may still be running. Backups with any file still retained by S3 Object
+// Lock or azure immutability policies are kept and reported as retained
+func Prune(o PruneOptions) (*PruneResult, error) {
+	if o.KeepLast < 0 || o.KeepDays < 0 {
+		return nil, fmt.Errorf("retention must be positive")
+	}
+	if o.KeepLast == 0 && o.KeepDays == 0 {
+		return nil, fmt.Errorf("retention requires a number of backups or days to keep")
+	}
+	storageOptions := utils.StorageOptions{
+		S3Endpoint:       o.S3Endpoint,
+		S3ForcePathStyle: o.S3ForcePathStyle,
+		Kubeconfig:       o.Kubeconfig,
+		KubeContext:      o.Context,
+	}
+	dstPrefix, dstBasePath, storageOptions, err := utils.SplitDestination(o.Dst, storageOptions)
+	if err != nil {
+		return nil, err
+	}
+	client, err := utils.GetClient(dstPrefix, dstBasePath, storageOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := utils.GetListOfFilesWithSizes(client, dstPrefix, dstBasePath)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for file := range files {
+		paths = append(paths, file)
+	}
+	keyspaceTags, tagFiles := groupBackupTags(paths, o.Clusters, o.Keyspaces)
+	markers := completeTags(paths)
+
+	now := time.Now()
+	result := &PruneResult{}
+	var selected []string
+	for _, tagPaths := range keyspaceTags {
+		selected = append(selected, selectTagsToPrune(tagPaths, markers, o.KeepLast, o.KeepDays, now)...)
+	}
+	sort.Strings(selected)
+	for _, tagPath := range selected {
+		retained, err := backupRetained(client, dstPrefix, dstBasePath, tagFiles[tagPath], o.Parallel, now)
+		if err != nil {
+			return nil, fmt.Errorf("could not get retention of backup %s: %s", tagPath, err)
+		}
+		if retained {
+			log.Println("Keeping retained backup", tagPath)
+			result.Retained = append(result.Retained, tagPath)
+			continue
+		}
+		result.Pruned = append(result.Pruned, tagPath)
+	}
+	if len(result.Pruned) == 0 {
+		log.Println("No backups to prune")
+		return result, nil
+	}
+	for _, tagPath := range result.Pruned {
+		log.Println("Pruning backup", tagPath)
+	}
+	if o.DryRun {
+		log.Printf("Dry run, would delete %d backups", len(result.Pruned))
+		return result, nil
+	}
+
+	// Completion markers are deleted first, so partially deleted backups are not mistaken for complete backups
+	// A backup whose marker can not be deleted is kept whole
+	var toDelete, pruned, failedTags []string
+	for _, tagPath := range result.Pruned {
+		if markers[tagPath] {
+			if err := utils.Delete(client, dstPrefix, completionMarkerPath(filepath.Join(dstBasePath, tagPath)), o.Verbose); err != nil {
+				log.Println("WARNING: could not delete backup", tagPath+":", err)
+				failedTags = append(failedTags, tagPath)
+				continue
+			}
+		}
+		for _, file := range tagFiles[tagPath] {
+			if !isCompletionMarker(file) {
+				toDelete = append(toDelete, file)
+			}
+		}
+		delete(tagFiles, tagPath)
+		pruned = append(pruned, tagPath)
+	}
+	result.Pruned = pruned
+	// Schemas are shared by the tags of a keyspace, and are deleted with the last of them
+	sums := make(map[string]bool)
+	for tagPath := range tagFiles {
+		sums[filepath.Dir(tagPath)] = true
+	}
+	for _, tagPath := range pruned {
+		sumPath := filepath.Dir(tagPath)
+		schema := filepath.Join(sumPath, "schema.cql")
+		if _, ok := files[schema]; ok && !sums[sumPath] {
+			toDelete = append(toDelete, schema)
+			sums[sumPath] = true
+		}
+	}
+	log.Printf("Deleting %d files of %d backups", len(toDelete), len(pruned))
+
+	parallel := o.Parallel
+	if parallel == 0 || parallel > len(toDelete) {
+		parallel = len(toDelete)
+	}
+	failed := 0
+	var mutex sync.Mutex
+	bwg := utils.NewBoundedWaitGroup(parallel)
+	for _, file := range toDelete {
+		bwg.Add(1)
+
+		go func(file string) {
+			defer bwg.Done()
+			if err := utils.Delete(client, dstPrefix, filepath.Join(dstBasePath, file), o.Verbose); err != nil {
+				log.Println(file, err)
+				mutex.Lock()
+				failed++
+				mutex.Unlock()
+			}
+		}(file)
+	}
+	bwg.Wait()
+	var errs []string
+	if len(failedTags) != 0 {
+		errs = append(errs, fmt.Sprintf("could not delete %d backups: %s", len(failedTags), strings.Join(failedTags, ", ")))
+	}
+	if failed != 0 {
+		errs = append(errs, fmt.Sprintf("could not delete %d files of pruned backups", failed))
+	}
+	if len(errs) != 0 {
+		return result, fmt.Errorf(strings.Join(errs, "; "))
+	}
+
+	return result, nil
+}
+
+// backupRetained returns true if any file of a backup is retained at now, files are checked in parallel
+// Files of a backup may have different retentions, such as when retention was extended for some of them
+func backupRetained(client interface{}, prefix, basePath string, files []string, parallel int, now time.Time) (bool, error) {
+	if parallel == 0 || parallel > len(files) {
+		parallel = len(files)
+	}
+	retained := false
+	var errs []string
+	var mutex sync.Mutex
+	bwg := utils.NewBoundedWaitGroup(parallel)
+	for _, file := range files {
+		bwg.Add(1)
+
+		go func(file string) {
+			defer bwg.Done()
+			retention, err := utils.GetObjectRetention(client, prefix, filepath.Join(basePath, file))
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", file, err))
+				return
+			}
+			if retention.Retained(now) {
+				retained = true
+			}
+		}(file)
+	}
+	bwg.Wait()
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return false, fmt.Errorf("%d files failed. first: %s", len(errs), errs[0])
+	}
+
+	return retained, nil
+}
+
+// groupBackupTags groups files listed under the path backups are stored under by tag (namespace/cluster/keyspace/sum/tag),
+// and tags by keyspace (namespace/cluster/keyspace). Empty filters select all clusters and keyspaces
+func groupBackupTags(files, clusters, keyspaces []string) (map[string][]string, map[string][]string) {
+	keyspaceTags := make(map[string][]string)
+	tagFiles := make(map[string][]string)
+	for _, file := range files {
+		pSplit := strings.Split(file, "/")
+		if len(pSplit) < 6 {
+			continue
+		}
+		if len(clusters) != 0 && !utils.Contains(clusters, filepath.Join(pSplit[0], pSplit[1])) {
+			continue
+		}
+		if len(keyspaces) != 0 && !utils.Contains(keyspaces, pSplit[2]) {
+			continue
+		}
+		tagPath := filepath.Join(pSplit[:5]...)
+		if _, ok := tagFiles[tagPath]; !ok {
+			keyspacePath := filepath.Join(pSplit[:3]...)
+			keyspaceTags[keyspacePath] = append(keyspaceTags[keyspacePath], tagPath)
+		}
+		tagFiles[tagPath] = append(tagFiles[tagPath], file)
+	}
+	for _, tFiles := range tagFiles {
+		sort.Strings(tFiles)
+	}
+
+	return keyspaceTags, tagFiles
+}
+
+// selectTagsToPrune selects the tags of a keyspace beyond a retention at now, see Prune
+// markers are the complete tags. Tags with unknown times are kept
+func selectTagsToPrune(tagPaths []string, markers map[string]bool, keepLast, keepDays int, now time.Time) []string {
+	// Newest first, tags are timestamps
+	tagPaths = append([]string{}, tagPaths...)
+	sort.Slice(tagPaths, func(i, j int) bool { return filepath.Base(tagPaths[i]) > filepath.Base(tagPaths[j]) })
+	keepAfter := now.AddDate(0, 0, -keepDays)
+	complete := 0
+	var selected []string
+	for _, tagPath := range tagPaths {
+		tagTime, err := time.ParseInLocation("20060102150405", filepath.Base(tagPath), now.Location())
+		if err != nil {
+			log.Println("WARNING: keeping backup with unknown time", tagPath)
+			continue
+		}
+		if markers[tagPath] {
+			complete++
+			if complete == 1 || complete <= keepLast {
+				continue
+			}
+		} else if complete == 0 {
+			continue
+		}
+		if keepDays != 0 && tagTime.After(keepAfter) {
+			continue
+		}
+		selected = append(selected, tagPath)
+	}
+
+	return selected
+}
@@ -0,0 +1,192 @@
+package cain
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+func TestSelectTagsToPrune(t *testing.T) {
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		tags     []string
+		complete []string
+		keepLast int
+		keepDays int
+		want     []string
+	}{
+		{
+			name:     "keep last",
+			tags:     []string{"20200101000000", "20200102000000", "20200103000000", "20200104000000"},
+			complete: []string{"20200101000000", "20200102000000", "20200103000000", "20200104000000"},
+			keepLast: 2,
+			want:     []string{"20200101000000", "20200102000000"},
+		},
+		{
+			name:     "keep days",
+			tags:     []string{"20200101000000", "20200105000000", "20200108000000", "20200109000000"},
+			complete: []string{"20200101000000", "20200105000000", "20200108000000", "20200109000000"},
+			keepDays: 3,
+			want:     []string{"20200101000000", "20200105000000"},
+		},
+		{
+			name:     "keep last or days",
+			tags:     []string{"20200101000000", "20200102000000", "20200108000000", "20200109000000"},
+			complete: []string{"20200101000000", "20200102000000", "20200108000000", "20200109000000"},
+			keepLast: 3,
+			keepDays: 3,
+			want:     []string{"20200101000000"},
+		},
+		{
+			name:     "newest complete tag is always kept",
+			tags:     []string{"20200101000000", "20200102000000"},
+			complete: []string{"20200101000000", "20200102000000"},
+			keepDays: 1,
+			want:     []string{"20200101000000"},
+		},
+		{
+			name:     "incomplete tags newer than the newest complete tag are kept",
+			tags:     []string{"20200101000000", "20200102000000", "20200103000000", "20200104000000"},
+			complete: []string{"20200101000000", "20200102000000"},
+			keepLast: 1,
+			want:     []string{"20200101000000"},
+		},
+		{
+			name:     "incomplete tags older than the newest complete tag are pruned",
+			tags:     []string{"20200101000000", "20200102000000", "20200103000000"},
+			complete: []string{"20200103000000"},
+			keepLast: 1,
+			want:     []string{"20200101000000", "20200102000000"},
+		},
+		{
+			name:     "no complete tags",
+			tags:     []string{"20200101000000", "20200102000000"},
+			keepLast: 1,
+		},
+		{
+			name:     "tags with unknown times are kept",
+			tags:     []string{"20200101000000", "20200102000000", "latest"},
+			complete: []string{"20200101000000", "20200102000000", "latest"},
+			keepLast: 1,
+			want:     []string{"20200101000000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tagPaths []string
+			for _, tag := range tt.tags {
+				tagPaths = append(tagPaths, "ns/cluster/keyspace/sum/"+tag)
+			}
+			markers := make(map[string]bool)
+			for _, tag := range tt.complete {
+				markers["ns/cluster/keyspace/sum/"+tag] = true
+			}
+			var want []string
+			for _, tag := range tt.want {
+				want = append(want, "ns/cluster/keyspace/sum/"+tag)
+			}
+
+			got := selectTagsToPrune(tagPaths, markers, tt.keepLast, tt.keepDays, now)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGroupBackupTags(t *testing.T) {
+	files := []string{
+		"ns/cluster/keyspace/sum/schema.cql",
+		"ns/cluster/keyspace/sum/20200101000000/_COMPLETE",
+		"ns/cluster/keyspace/sum/20200101000000/pod/table/file",
+		"ns/cluster/keyspace/sum/20200102000000/pod/table/file",
+		"ns/cluster/other/sum/20200101000000/pod/table/file",
+		"ns/other/keyspace/sum/20200101000000/pod/table/file",
+	}
+	keyspaceTags, tagFiles := groupBackupTags(files, []string{"ns/cluster"}, []string{"keyspace"})
+
+	for _, tagPaths := range keyspaceTags {
+		sort.Strings(tagPaths)
+	}
+	wantTags := map[string][]string{
+		"ns/cluster/keyspace": {"ns/cluster/keyspace/sum/20200101000000", "ns/cluster/keyspace/sum/20200102000000"},
+	}
+	if !reflect.DeepEqual(keyspaceTags, wantTags) {
+		t.Errorf("got tags %v, want %v", keyspaceTags, wantTags)
+	}
+	wantFiles := map[string][]string{
+		"ns/cluster/keyspace/sum/20200101000000": {"ns/cluster/keyspace/sum/20200101000000/_COMPLETE", "ns/cluster/keyspace/sum/20200101000000/pod/table/file"},
+		"ns/cluster/keyspace/sum/20200102000000": {"ns/cluster/keyspace/sum/20200102000000/pod/table/file"},
+	}
+	if !reflect.DeepEqual(tagFiles, wantFiles) {
+		t.Errorf("got files %v, want %v", tagFiles, wantFiles)
+	}
+	if markers := completeTags(files); !markers["ns/cluster/keyspace/sum/20200101000000"] || markers["ns/cluster/keyspace/sum/20200102000000"] {
+		t.Errorf("got complete tags %v", markers)
+	}
+}
+
+func TestBackupRetained(t *testing.T) {
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	// Retention of objects by key, a missing object fails
+	retainUntil := map[string]time.Time{
+		"bucket/cassandra/tag/pod-0/table/mc-1-big-Data.db": now.Add(-time.Hour),
+		"bucket/cassandra/tag/pod-1/table/mc-1-big-Data.db": now.Add(time.Hour),
+		"bucket/cassandra/tag/_COMPLETE":                    {},
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(r.URL.Path, "/")
+		if r.Method != http.MethodHead {
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>bucket</Name></ListBucketResult>`)
+			return
+		}
+		until, ok := retainUntil[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !until.IsZero() {
+			w.Header().Set("x-amz-object-lock-retain-until-date", until.Format(time.RFC3339))
+		}
+	}))
+	defer server.Close()
+	client, err := utils.GetClient("s3", "bucket/cassandra", utils.StorageOptions{S3Endpoint: server.URL, S3ForcePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		files   []string
+		want    bool
+		wantErr bool
+	}{
+		{"expired", []string{"tag/_COMPLETE", "tag/pod-0/table/mc-1-big-Data.db"}, false, false},
+		{"one file retained", []string{"tag/_COMPLETE", "tag/pod-0/table/mc-1-big-Data.db", "tag/pod-1/table/mc-1-big-Data.db"}, true, false},
+		{"file not found", []string{"tag/_COMPLETE", "tag/pod-2/table/mc-1-big-Data.db"}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := backupRetained(client, "s3", "bucket/cassandra", tt.files, 2, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
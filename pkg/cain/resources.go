@@ -0,0 +1,393 @@
+package cain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nuvo/cain/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// API group and version of the custom resources reconciled by the operator
+const (
+	ResourceGroup   = "cain.nuvo.io"
+	ResourceVersion = "v1alpha1"
+)
+
+// Resources reconciled by the operator
+var (
+	CassandraBackupResource         = schema.GroupVersionResource{Group: ResourceGroup, Version: ResourceVersion, Resource: "cassandrabackups"}
+	CassandraBackupScheduleResource = schema.GroupVersionResource{Group: ResourceGroup, Version: ResourceVersion, Resource: "cassandrabackupschedules"}
+	CassandraRestoreResource        = schema.GroupVersionResource{Group: ResourceGroup, Version: ResourceVersion, Resource: "cassandrarestores"}
+)
+
+// Phases of backups and restores
+const (
+	PhasePending   = "Pending"
+	PhaseRunning   = "Running"
+	PhaseSucceeded = "Succeeded"
+	PhaseFailed    = "Failed"
+)
+
+// ScheduleLabel is the label of backups created by a schedule, its value is the name of the schedule
+const ScheduleLabel = ResourceGroup + "/schedule"
+
+// CassandraBackup is a single backup of a keyspace
+type CassandraBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CassandraBackupSpec   `json:"spec"`
+	Status CassandraBackupStatus `json:"status,omitempty"`
+}
+
+// CassandraBackupSpec is the spec of a backup, fields are named after the flags of backup and have the same defaults
+// A backup acts on the cassandra cluster in the namespace of the resource, and reads secrets from that namespace
+type CassandraBackupSpec struct {
+	Selector                string           `json:"selector,omitempty"`
+	StatefulSet             string           `json:"statefulSet,omitempty"`
+	CassandraDatacenter     string           `json:"cassandraDatacenter,omitempty"`
+	UnreadyPods             string           `json:"unreadyPods,omitempty"`
+	UnreadyTimeout          *metav1.Duration `json:"unreadyTimeout,omitempty"`
+	Container               string           `json:"container,omitempty"`
+	Keyspace                string           `json:"keyspace"`
+	Dst                     []string         `json:"dst"`
+	Parallel                *int             `json:"parallel,omitempty"`
+	BufferSize              float64          `json:"bufferSize,omitempty"`
+	S3PartSize              int64            `json:"s3PartSize,omitempty"`
+	S3MaxUploadParts        int              `json:"s3MaxUploadParts,omitempty"`
+	MaxBandwidth            float64          `json:"maxBandwidth,omitempty"`
+	MaxPodBandwidth         float64          `json:"maxPodBandwidth,omitempty"`
+	S3Endpoint              string           `json:"s3Endpoint,omitempty"`
+	S3ForcePathStyle        bool             `json:"s3ForcePathStyle,omitempty"`
+	S3StorageClass          string           `json:"s3StorageClass,omitempty"`
+	S3ServerSideEncryption  string           `json:"s3Sse,omitempty"`
+	S3SSEKMSKeyID           string           `json:"s3SseKmsKeyId,omitempty"`
+	S3ACL                   string           `json:"s3Acl,omitempty"`
+	RetentionMode           string           `json:"retentionMode,omitempty"`
+	RetentionDays           int              `json:"retentionDays,omitempty"`
+	RetainUntil             string           `json:"retainUntil,omitempty"`
+	CassandraDataDir        string           `json:"cassandraDataDir,omitempty"`
+	Authentication          bool             `json:"authentication,omitempty"`
+	CassandraUsername       string           `json:"cassandraUsername,omitempty"`
+	NodetoolCredentialsFile string           `json:"nodetoolCredentialsFile,omitempty"`
+	CredentialsSecret       string           `json:"credentialsSecret,omitempty"`
+	Checksum                *bool            `json:"checksum,omitempty"`
+	Compression             string           `json:"compression,omitempty"`
+	Layout                  string           `json:"layout,omitempty"`
+	ArchiveMaxSize          int64            `json:"archiveMaxSize,omitempty"`
+	EncryptionKeyID         string           `json:"encryptionKeyId,omitempty"`
+	EncryptionKeySecret     string           `json:"encryptionKeySecret,omitempty"`
+	Datacenter              string           `json:"datacenter,omitempty"`
+	DatacenterLabel         string           `json:"datacenterLabel,omitempty"`
+	RackLabel               string           `json:"rackLabel,omitempty"`
+	Agent                   bool             `json:"agent,omitempty"`
+	AgentPort               int              `json:"agentPort,omitempty"`
+	Events                  bool             `json:"events,omitempty"`
+	Annotate                bool             `json:"annotate,omitempty"`
+	Hooks                   []Hook           `json:"hooks,omitempty"`
+}
+
+// CassandraBackupStatus is the status of a backup
+type CassandraBackupStatus struct {
+	Phase       string `json:"phase,omitempty"`
+	Tag         string `json:"tag,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Files       int    `json:"files,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	StoredBytes int64  `json:"storedBytes,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// FailedDestinations are the errors of the destinations the backup failed in, keyed by destination
+	FailedDestinations map[string]string `json:"failedDestinations,omitempty"`
+	StartTime          *metav1.Time      `json:"startTime,omitempty"`
+	CompletionTime     *metav1.Time      `json:"completionTime,omitempty"`
+}
+
+// CassandraBackupSchedule creates backups on a cron schedule
+type CassandraBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CassandraBackupScheduleSpec   `json:"spec"`
+	Status CassandraBackupScheduleStatus `json:"status,omitempty"`
+}
+
+// CassandraBackupScheduleSpec is the spec of a backup schedule
+type CassandraBackupScheduleSpec struct {
+	// Schedule is a cron expression (minute hour day-of-month month day-of-week)
+	Schedule string `json:"schedule"`
+	// Suspend stops creating backups
+	Suspend bool `json:"suspend,omitempty"`
+	// History limits of the backups created by the schedule, defaults to 3 successful and 1 failed backups
+	SuccessfulBackupsHistoryLimit *int                `json:"successfulBackupsHistoryLimit,omitempty"`
+	FailedBackupsHistoryLimit     *int                `json:"failedBackupsHistoryLimit,omitempty"`
+	Backup                        CassandraBackupSpec `json:"backup"`
+}
+
+// CassandraBackupScheduleStatus is the status of a backup schedule
+type CassandraBackupScheduleStatus struct {
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	LastBackup       string       `json:"lastBackup,omitempty"`
+	Error            string       `json:"error,omitempty"`
+}
+
+// CassandraRestore is a single restore of a keyspace
+type CassandraRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CassandraRestoreSpec   `json:"spec"`
+	Status CassandraRestoreStatus `json:"status,omitempty"`
+}
+
+// CassandraRestoreSpec is the spec of a restore, fields are named after the flags of restore and have the same defaults
+// A restore acts on the cassandra cluster in the namespace of the resource, and reads secrets from that namespace
+type CassandraRestoreSpec struct {
+	Src                     string           `json:"src"`
+	Keyspace                string           `json:"keyspace"`
+	Tag                     string           `json:"tag"`
+	Schema                  string           `json:"schema,omitempty"`
+	Selector                string           `json:"selector,omitempty"`
+	StatefulSet             string           `json:"statefulSet,omitempty"`
+	CassandraDatacenter     string           `json:"cassandraDatacenter,omitempty"`
+	UnreadyPods             string           `json:"unreadyPods,omitempty"`
+	UnreadyTimeout          *metav1.Duration `json:"unreadyTimeout,omitempty"`
+	Container               string           `json:"container,omitempty"`
+	Parallel                *int             `json:"parallel,omitempty"`
+	BufferSize              float64          `json:"bufferSize,omitempty"`
+	S3PartSize              int64            `json:"s3PartSize,omitempty"`
+	S3MaxDownloadParts      int              `json:"s3MaxDownloadParts,omitempty"`
+	MaxBandwidth            float64          `json:"maxBandwidth,omitempty"`
+	MaxPodBandwidth         float64          `json:"maxPodBandwidth,omitempty"`
+	S3Endpoint              string           `json:"s3Endpoint,omitempty"`
+	S3ForcePathStyle        bool             `json:"s3ForcePathStyle,omitempty"`
+	UserGroup               string           `json:"userGroup,omitempty"`
+	CassandraDataDir        string           `json:"cassandraDataDir,omitempty"`
+	Authentication          bool             `json:"authentication,omitempty"`
+	CassandraUsername       string           `json:"cassandraUsername,omitempty"`
+	NodetoolCredentialsFile string           `json:"nodetoolCredentialsFile,omitempty"`
+	CredentialsSecret       string           `json:"credentialsSecret,omitempty"`
+	AllowIncomplete         bool             `json:"allowIncomplete,omitempty"`
+	Checksum                *bool            `json:"checksum,omitempty"`
+	EncryptionKeySecret     string           `json:"encryptionKeySecret,omitempty"`
+	Rehydrate               bool             `json:"rehydrate,omitempty"`
+	RehydrateDays           int              `json:"rehydrateDays,omitempty"`
+	Datacenter              string           `json:"datacenter,omitempty"`
+	DatacenterLabel         string           `json:"datacenterLabel,omitempty"`
+	RackLabel               string           `json:"rackLabel,omitempty"`
+	Agent                   bool             `json:"agent,omitempty"`
+	AgentPort               int              `json:"agentPort,omitempty"`
+	Events                  bool             `json:"events,omitempty"`
+	Hooks                   []Hook           `json:"hooks,omitempty"`
+}
+
+// CassandraRestoreStatus is the status of a restore
+type CassandraRestoreStatus struct {
+	Phase          string       `json:"phase,omitempty"`
+	Files          int          `json:"files,omitempty"`
+	Bytes          int64        `json:"bytes,omitempty"`
+	Error          string       `json:"error,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// BackupOptions returns the options of a backup by its spec in namespace, with the defaults of the backup command
+func (s CassandraBackupSpec) BackupOptions(namespace string) BackupOptions {
+	return BackupOptions{
+		Namespace:               namespace,
+		Selector:                stringOrDefault(s.Selector, "app=cassandra"),
+		StatefulSet:             s.StatefulSet,
+		CassandraDatacenter:     s.CassandraDatacenter,
+		UnreadyPods:             stringOrDefault(s.UnreadyPods, utils.UnreadyPodsFail),
+		UnreadyTimeout:          durationOrDefault(s.UnreadyTimeout, 10*time.Minute),
+		Container:               stringOrDefault(s.Container, "cassandra"),
+		Keyspace:                s.Keyspace,
+		Dsts:                    s.Dst,
+		Parallel:                intOrDefault(s.Parallel, 1),
+		BufferSize:              float64OrDefault(s.BufferSize, 6.75),
+		S3PartSize:              int64OrDefault(s.S3PartSize, 128*1024*1024),
+		S3MaxUploadParts:        int(int64OrDefault(int64(s.S3MaxUploadParts), 10000)),
+		MaxBandwidth:            s.MaxBandwidth,
+		MaxPodBandwidth:         s.MaxPodBandwidth,
+		S3Endpoint:              s.S3Endpoint,
+		S3ForcePathStyle:        s.S3ForcePathStyle,
+		S3StorageClass:          s.S3StorageClass,
+		S3ServerSideEncryption:  s.S3ServerSideEncryption,
+		S3SSEKMSKeyID:           s.S3SSEKMSKeyID,
+		S3ACL:                   s.S3ACL,
+		RetentionMode:           s.RetentionMode,
+		RetentionDays:           s.RetentionDays,
+		RetainUntil:             s.RetainUntil,
+		CassandraDataDir:        stringOrDefault(s.CassandraDataDir, "/var/lib/cassandra/data"),
+		Authentication:          s.Authentication,
+		CassandraUsername:       stringOrDefault(s.CassandraUsername, "cain"),
+		NodetoolCredentialsFile: stringOrDefault(s.NodetoolCredentialsFile, "/home/cassandra/.nodetool/credentials"),
+		CredentialsSecret:       s.CredentialsSecret,
+		Checksum:                boolOrDefault(s.Checksum, true),
+		Compression:             s.Compression,
+		Layout:                  stringOrDefault(s.Layout, LayoutFiles),
+		ArchiveMaxSize:          s.ArchiveMaxSize,
+		EncryptionKeyID:         s.EncryptionKeyID,
+		EncryptionKeySecret:     s.EncryptionKeySecret,
+		Datacenter:              s.Datacenter,
+		DatacenterLabel:         s.DatacenterLabel,
+		RackLabel:               s.RackLabel,
+		Agent:                   s.Agent,
+		AgentPort:               int(int64OrDefault(int64(s.AgentPort), AgentPort)),
+		Events:                  s.Events,
+		Annotate:                s.Annotate,
+		Hooks:                   s.Hooks,
+	}
+}
+
+// RestoreOptions returns the options of a restore by its spec in namespace, with the defaults of the restore command
+func (s CassandraRestoreSpec) RestoreOptions(namespace string) RestoreOptions {
+	return RestoreOptions{
+		Src:                     s.Src,
+		Keyspace:                s.Keyspace,
+		Tag:                     s.Tag,
+		Schema:                  s.Schema,
+		Namespace:               namespace,
+		Selector:                stringOrDefault(s.Selector, "app=cassandra"),
+		StatefulSet:             s.StatefulSet,
+		CassandraDatacenter:     s.CassandraDatacenter,
+		UnreadyPods:             stringOrDefault(s.UnreadyPods, utils.UnreadyPodsFail),
+		UnreadyTimeout:          durationOrDefault(s.UnreadyTimeout, 10*time.Minute),
+		Container:               stringOrDefault(s.Container, "cassandra"),
+		Parallel:                intOrDefault(s.Parallel, 1),
+		BufferSize:              float64OrDefault(s.BufferSize, 6.75),
+		S3PartSize:              int64OrDefault(s.S3PartSize, 128*1024*1024),
+		S3MaxDownloadParts:      int(int64OrDefault(int64(s.S3MaxDownloadParts), 10000)),
+		MaxBandwidth:            s.MaxBandwidth,
+		MaxPodBandwidth:         s.MaxPodBandwidth,
+		S3Endpoint:              s.S3Endpoint,
+		S3ForcePathStyle:        s.S3ForcePathStyle,
+		UserGroup:               stringOrDefault(s.UserGroup, "cassandra:cassandra"),
+		CassandraDataDir:        stringOrDefault(s.CassandraDataDir, "/var/lib/cassandra/data"),
+		Authentication:          s.Authentication,
+		CassandraUsername:       stringOrDefault(s.CassandraUsername, "cain"),
+		NodetoolCredentialsFile: stringOrDefault(s.NodetoolCredentialsFile, "/home/cassandra/.nodetool/credentials"),
+		CredentialsSecret:       s.CredentialsSecret,
+		AllowIncomplete:         s.AllowIncomplete,
+		Checksum:                boolOrDefault(s.Checksum, true),
+		EncryptionKeySecret:     s.EncryptionKeySecret,
+		Rehydrate:               s.Rehydrate,
+		RehydrateDays:           int(int64OrDefault(int64(s.RehydrateDays), 7)),
+		Datacenter:              s.Datacenter,
+		DatacenterLabel:         s.DatacenterLabel,
+		RackLabel:               s.RackLabel,
+		Agent:                   s.Agent,
+		AgentPort:               int(int64OrDefault(int64(s.AgentPort), AgentPort)),
+		Events:                  s.Events,
+		Hooks:                   s.Hooks,
+	}
+}
+
+// test checks that a backup stays in namespace, where it is reconciled by the operator
+func (s CassandraBackupSpec) test(namespace string) error {
+	if err := testResourceDatacenter(s.CassandraDatacenter, namespace); err != nil {
+		return err
+	}
+	if err := testResourceHooks(s.Hooks); err != nil {
+		return err
+	}
+	for _, dst := range s.Dst {
+		if err := testResourceStorage(dst, namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// test checks that a restore stays in namespace, where it is reconciled by the operator
+func (s CassandraRestoreSpec) test(namespace string) error {
+	if err := testResourceDatacenter(s.CassandraDatacenter, namespace); err != nil {
+		return err
+	}
+	if err := testResourceHooks(s.Hooks); err != nil {
+		return err
+	}
+	return testResourceStorage(s.Src, namespace)
+}
+
+// testResourceDatacenter checks that a CassandraDatacenter reference of a resource is in namespace
+func testResourceDatacenter(reference, namespace string) error {
+	if split := strings.SplitN(reference, "/", 2); len(split) == 2 && split[0] != namespace {
+		return fmt.Errorf("CassandraDatacenter %s is not in namespace %s", reference, namespace)
+	}
+	return nil
+}
+
+// testResourceHooks checks that the hooks of a resource run in pods
+// Local hooks would run in the operator pod, so they are not allowed
+func testResourceHooks(hooks []Hook) error {
+	for _, hook := range hooks {
+		if !hook.InPods {
+			return fmt.Errorf("%s hook must run in pods, local hooks are not allowed in resources", hook.Phase)
+		}
+	}
+	return nil
+}
+
+// testResourceStorage checks that a source or destination of a resource is in namespace
+// Local files would be read or written by the operator, so they are not allowed
+func testResourceStorage(path, namespace string) error {
+	prefix, p, _, err := utils.SplitDestination(path, utils.StorageOptions{})
+	if err != nil {
+		return err
+	}
+	switch prefix {
+	case "file":
+		return fmt.Errorf("local paths are not allowed in resources: %s", path)
+	case "pvc":
+		if pvcNamespace := strings.SplitN(strings.Trim(p, "/"), "/", 2)[0]; pvcNamespace != namespace {
+			return fmt.Errorf("pvc %s is not in namespace %s", path, namespace)
+		}
+	}
+	return nil
+}
+
+func stringOrDefault(s, defVal string) string {
+	if s == "" {
+		return defVal
+	}
+	return s
+}
+
+func intOrDefault(i *int, defVal int) int {
+	if i == nil {
+		return defVal
+	}
+	return *i
+}
+
+func int64OrDefault(i, defVal int64) int64 {
+	if i == 0 {
+		return defVal
+	}
+	return i
+}
+
+func float64OrDefault(f, defVal float64) float64 {
+	if f == 0 {
+		return defVal
+	}
+	return f
+}
+
+func boolOrDefault(b *bool, defVal bool) bool {
+	if b == nil {
+		return defVal
+	}
+	return *b
+}
+
+func durationOrDefault(d *metav1.Duration, defVal time.Duration) time.Duration {
+	if d == nil {
+		return defVal
+	}
+	return d.Duration
+}
@@ -0,0 +1,56 @@
+package cain
+
+import "testing"
+
+func TestResourceSpecTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		backup  CassandraBackupSpec
+		restore CassandraRestoreSpec
+		valid   bool
+	}{
+		{
+			name:    "in namespace",
+			backup:  CassandraBackupSpec{CassandraDatacenter: "dc1", Dst: []string{"s3://bucket/cassandra?endpoint=http://minio:9000", "pvc://cassandra/backups"}},
+			restore: CassandraRestoreSpec{CassandraDatacenter: "cassandra/dc1", Src: "pvc://cassandra/backups/cassandra/cluster"},
+			valid:   true,
+		},
+		{
+			name:    "datacenter in other namespace",
+			backup:  CassandraBackupSpec{CassandraDatacenter: "other/dc1", Dst: []string{"s3://bucket/cassandra"}},
+			restore: CassandraRestoreSpec{CassandraDatacenter: "other/dc1", Src: "s3://bucket/cassandra"},
+		},
+		{
+			name:    "pvc in other namespace",
+			backup:  CassandraBackupSpec{Dst: []string{"s3://bucket/cassandra", "pvc://other/backups"}},
+			restore: CassandraRestoreSpec{Src: "pvc://other/backups/cassandra/cluster"},
+		},
+		{
+			name:    "pod hooks",
+			backup:  CassandraBackupSpec{Dst: []string{"s3://bucket/cassandra"}, Hooks: []Hook{{Phase: HookPreSnapshot, Command: "nodetool flush", InPods: true}}},
+			restore: CassandraRestoreSpec{Src: "s3://bucket/cassandra", Hooks: []Hook{{Phase: HookPostRefresh, Command: "nodetool repair", InPods: true}}},
+			valid:   true,
+		},
+		{
+			name:    "local hooks",
+			backup:  CassandraBackupSpec{Dst: []string{"s3://bucket/cassandra"}, Hooks: []Hook{{Phase: HookPreSnapshot, Command: "cat /etc/cain/token"}}},
+			restore: CassandraRestoreSpec{Src: "s3://bucket/cassandra", Hooks: []Hook{{Phase: HookPostRefresh, Command: "cat /etc/cain/token"}}},
+		},
+		{
+			name:    "local path",
+			backup:  CassandraBackupSpec{Dst: []string{"file:///etc/cain"}},
+			restore: CassandraRestoreSpec{Src: "file:///etc/cain"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.backup.test("cassandra"); (err == nil) != tt.valid {
+				t.Errorf("backup: expected valid %v, got %v", tt.valid, err)
+			}
+			if err := tt.restore.test("cassandra"); (err == nil) != tt.valid {
+				t.Errorf("restore: expected valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
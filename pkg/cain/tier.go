@@ -0,0 +1,185 @@
+package cain
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+// TierOptions are the options to pass to Tier
+type TierOptions struct {
+	Src              string
+	Clusters         []string
+	Keyspaces        []string
+	Tags             []string
+	OlderThanDays    int
+	StorageClass     string
+	DryRun           bool
+	Parallel         int
+	S3Endpoint       string
+	S3ForcePathStyle bool
+	S3ACL            string
+	Verbose          bool
+}
+
+// Tier moves the files of backups older than a number of days to a colder storage class
+// Src is the path backups are stored under (the dst of backup). Schemas, manifests and completion markers are not moved,
+// so backups can still be listed, verified and copied without rehydration
+func Tier(o TierOptions) error {
+	log.Println("Tier started!")
+	srcPrefix, srcBasePath := utils.SplitInTwo(o.Src, "://")
+
+	if err := utils.TestStorageClass(srcPrefix, o.StorageClass); err != nil {
+		return err
+	}
+	if o.OlderThanDays < 0 {
+		return fmt.Errorf("days must be positive")
+	}
+
+	log.Println("Getting client")
+	storageOptions := utils.StorageOptions{
+		S3Endpoint:       o.S3Endpoint,
+		S3ForcePathStyle: o.S3ForcePathStyle,
+		S3ACL:            o.S3ACL,
+	}
+	client, err := utils.GetClient(srcPrefix, srcBasePath, storageOptions)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Listing backup files")
+	classes, err := utils.GetStorageClasses(client, srcPrefix, srcBasePath)
+	if err != nil {
+		return err
+	}
+	files := selectBackupFiles(utils.MapKeysToSlice(classes), o.Clusters, o.Keyspaces, o.Tags, false)
+
+	olderThan := time.Now().AddDate(0, 0, -o.OlderThanDays)
+	var toMove []string
+	tags := make(map[string]bool)
+	for _, file := range files {
+		pSplit := strings.Split(file, "/")
+		// Schemas are shared by tags, manifests and markers are small and read without restoring
+		if len(pSplit) == 5 || pSplit[len(pSplit)-1] == ManifestFile || isCompletionMarker(file) {
+			continue
+		}
+		tagTime, err := time.ParseInLocation("20060102150405", pSplit[4], time.Local)
+		if err != nil {
+			log.Println("WARNING: skipping tag with unknown time", filepath.Join(pSplit[:5]...))
+			continue
+		}
+		if !tagTime.Before(olderThan) {
+			continue
+		}
+		class := classes[file]
+		if class == o.StorageClass {
+			continue
+		}
+		if utils.IsArchivedStorageClass(srcPrefix, class) {
+			log.Printf("WARNING: skipping %s, it is archived in %s", file, class)
+			continue
+		}
+		toMove = append(toMove, file)
+		tags[filepath.Join(pSplit[:5]...)] = true
+	}
+	if len(toMove) == 0 {
+		log.Println("No files to move")
+		return nil
+	}
+
+	var sortedTags []string
+	for tag := range tags {
+		sortedTags = append(sortedTags, tag)
+	}
+	sort.Strings(sortedTags)
+	for _, tag := range sortedTags {
+		log.Println("Tiering backup", tag)
+	}
+	if o.DryRun {
+		log.Printf("Dry run, would move %d files of %d backups to %s", len(toMove), len(tags), o.StorageClass)
+		return nil
+	}
+	log.Printf("Moving %d files of %d backups to %s", len(toMove), len(tags), o.StorageClass)
+
+	parallel := o.Parallel
+	if parallel == 0 || parallel > len(toMove) {
+		parallel = len(toMove)
+	}
+	var failed []string
+	var mutex sync.Mutex
+	bwg := utils.NewBoundedWaitGroup(parallel)
+	for _, file := range toMove {
+		bwg.Add(1)
+
+		go func(file string) {
+			defer bwg.Done()
+			if err := utils.SetStorageClass(client, srcPrefix, filepath.Join(srcBasePath, file), o.StorageClass, o.Verbose); err != nil {
+				log.Println(file, err)
+				mutex.Lock()
+				failed = append(failed, file)
+				mutex.Unlock()
+			}
+		}(file)
+	}
+	bwg.Wait()
+	if len(failed) != 0 {
+		return fmt.Errorf("could not move %d files to %s", len(failed), o.StorageClass)
+	}
+
+	log.Println("All done!")
+	return nil
+}
+
+// TestRehydration checks that the files of a backup can be downloaded, and starts their rehydration if rehydrate is true
+// Returns an error if any of the files is archived, since restoring the backup has to wait for its rehydration
+func TestRehydration(iSrcClient interface{}, srcPrefix, tagPath string, rehydrate bool, days int, verbose bool) error {
+	if srcPrefix != "s3" && srcPrefix != "abs" {
+		return nil
+	}
+	classes, err := utils.GetStorageClasses(iSrcClient, srcPrefix, tagPath)
+	if err != nil {
+		return err
+	}
+
+	var required, pending []string
+	for file, class := range classes {
+		if !utils.IsArchivedStorageClass(srcPrefix, class) {
+			continue
+		}
+		path := filepath.Join(tagPath, file)
+		state, err := utils.GetRehydrationState(iSrcClient, srcPrefix, path)
+		if err != nil {
+			return err
+		}
+		switch state {
+		case utils.RehydrationRequired:
+			required = append(required, path)
+		case utils.RehydrationPending:
+			pending = append(pending, path)
+		}
+	}
+
+	if len(required) != 0 && rehydrate {
+		log.Printf("Starting rehydration of %d archived files", len(required))
+		for _, path := range required {
+			if err := utils.Rehydrate(iSrcClient, srcPrefix, path, days, verbose); err != nil {
+				return err
+			}
+		}
+		pending, required = append(pending, required...), nil
+	}
+	if len(required) != 0 {
+		return fmt.Errorf("%d files of backup %s are archived and must be rehydrated before restoring. use \"--rehydrate\" to start their rehydration", len(required), tagPath)
+	}
+	if len(pending) != 0 {
+		return fmt.Errorf("rehydration of %d files of backup %s is in progress, restore again when it completes (this may take hours)", len(pending), tagPath)
+	}
+
+	return nil
+}
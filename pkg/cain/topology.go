@@ -0,0 +1,132 @@
+package cain
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nuvo/cain/pkg/utils"
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// NodeTopology is the datacenter and rack of a cassandra node
+type NodeTopology struct {
+	Datacenter string `json:"datacenter"`
+	Rack       string `json:"rack"`
+}
+
+// GetTopology gets the datacenter and rack of pods in parallel
+// They are read from the labels datacenterLabel and rackLabel if datacenterLabel is set, and from nodetool info otherwise
+func GetTopology(iK8sClient interface{}, namespace, container string, pods []string, datacenterLabel, rackLabel string, creds Credentials) (map[string]NodeTopology, error) {
+	topology := make(map[string]NodeTopology)
+	var errs []string
+	var mutex sync.Mutex
+	bwg := utils.NewBoundedWaitGroup(len(pods))
+	for _, pod := range pods {
+		bwg.Add(1)
+
+		go func(pod string) {
+			defer bwg.Done()
+			node, err := getNodeTopology(iK8sClient, namespace, pod, container, datacenterLabel, rackLabel, creds)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", pod, err))
+				return
+			}
+			topology[pod] = node
+		}(pod)
+	}
+	bwg.Wait()
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("could not get datacenter and rack of pods: %s", strings.Join(errs, "; "))
+	}
+
+	return topology, nil
+}
+
+// FilterPodsByDatacenter returns the pods in a datacenter
+func FilterPodsByDatacenter(pods []string, topology map[string]NodeTopology, datacenter string) ([]string, error) {
+	var filtered []string
+	var datacenters []string
+	for _, pod := range pods {
+		dc := topology[pod].Datacenter
+		if dc == datacenter {
+			filtered = append(filtered, pod)
+		}
+		if !utils.Contains(datacenters, dc) {
+			datacenters = append(datacenters, dc)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no pods found in datacenter %s. found datacenters: %s", datacenter, strings.Join(datacenters, ", "))
+	}
+
+	return filtered, nil
+}
+
+// datacenterPodsToRestore returns the pods of a backup which are restored to a datacenter
+// These are the pods which were in the datacenter when the backup was taken, or the pods which are in it now if the
+// backup does not hold its topology
+func datacenterPodsToRestore(manifest *Manifest, datacenterPods []string, datacenter string) []string {
+	if manifest == nil || manifest.Topology == nil {
+		return datacenterPods
+	}
+	pods := []string{}
+	for pod, node := range manifest.Topology {
+		if node.Datacenter == datacenter {
+			pods = append(pods, pod)
+		}
+	}
+	sort.Strings(pods)
+
+	return pods
+}
+
+// getNodeTopology gets the datacenter and rack of a single pod
+func getNodeTopology(iK8sClient interface{}, namespace, pod, container, datacenterLabel, rackLabel string, creds Credentials) (NodeTopology, error) {
+	var node NodeTopology
+	if datacenterLabel != "" {
+		labels, err := utils.GetPodLabels(iK8sClient, namespace, pod)
+		if err != nil {
+			return node, err
+		}
+		node.Datacenter = labels[datacenterLabel]
+		node.Rack = labels[rackLabel]
+		if node.Datacenter == "" {
+			return node, fmt.Errorf("pod has no label %s", datacenterLabel)
+		}
+		return node, nil
+	}
+
+	output, err := nodetool(iK8sClient.(*skbn.K8sClient), namespace, pod, container, []string{"info"}, creds)
+	if err != nil {
+		return node, err
+	}
+
+	return parseNodeTopology(output)
+}
+
+// parseNodeTopology parses the datacenter and rack of a node from the output of nodetool info
+func parseNodeTopology(output string) (NodeTopology, error) {
+	var node NodeTopology
+	// nodetool info prints "Data Center            : dc1"
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Data Center":
+			node.Datacenter = strings.TrimSpace(value)
+		case "Rack":
+			node.Rack = strings.TrimSpace(value)
+		}
+	}
+	if node.Datacenter == "" {
+		return node, fmt.Errorf("could not find datacenter in nodetool info")
+	}
+
+	return node, nil
+}
@@ -0,0 +1,294 @@
+package cain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nuvo/cain/pkg/utils"
+)
+
+// requiredComponents are the SSTable components every SSTable must have, in addition to its primary index and the ones listed in its TOC
+var requiredComponents = []string{"Data.db", "Statistics.db", "TOC.txt"}
+
+// indexComponent returns the primary index component of an SSTable, by the format at the end of its name (such as nb-1-big)
+// SSTables of the bti format of Cassandra 5 index partitions in Partitions.db, all other SSTables have an Index.db
+func indexComponent(sstable string) string {
+	if strings.HasSuffix(sstable, "-bti") {
+		return "Partitions.db"
+	}
+	return "Index.db"
+}
+
+// VerifyOptions are the options to pass to Verify
+type VerifyOptions struct {
+	Src              string
+	Keyspace         string
+	Tag              string
+	Schema           string
+	Checksum         bool
+	EncryptionKey    string
+	S3Endpoint       string
+	S3ForcePathStyle bool
+	Parallel         int
+	Kubeconfig       string
+	Context          string
+	Verbose          bool
+}
+
+// Verify validates a backup without restoring it
+func Verify(o VerifyOptions) error {
+	log.Println("Verify started!")
+	srcPrefix, srcBasePath := utils.SplitInTwo(o.Src, "://")
+
+	log.Println("Getting client")
+	storageOptions := utils.StorageOptions{
+		S3Endpoint:       o.S3Endpoint,
+		S3ForcePathStyle: o.S3ForcePathStyle,
+		Kubeconfig:       o.Kubeconfig,
+		KubeContext:      o.Context,
+	}
+	srcClient, err := utils.GetClient(srcPrefix, srcBasePath, storageOptions)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Listing backup files")
+	keyspacePath := filepath.Join(srcBasePath, o.Keyspace)
+	files, err := utils.GetListOfFilesWithSizes(srcClient, srcPrefix, keyspacePath)
+	if err != nil {
+		return err
+	}
+
+	sum := o.Schema
+	if sum == "" {
+		sum, err = findSchemaSum(files, o.Tag)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Found schema:", sum)
+
+	tagPath := filepath.Join(keyspacePath, sum, o.Tag)
+	tagFiles := make(map[string]int64)
+	var paths []string
+	for file, size := range files {
+		paths = append(paths, file)
+		if strings.HasPrefix(file, filepath.Join(sum, o.Tag)+"/") {
+			tagFiles[utils.RelativePath(file, filepath.Join(sum, o.Tag))] = size
+		}
+	}
+	if len(tagFiles) == 0 {
+		return fmt.Errorf("No files found for tag %s", o.Tag)
+	}
+
+	var problems []string
+
+	log.Println("Verifying schema")
+	problems = append(problems, verifySchema(srcClient, srcPrefix, keyspacePath, sum, files, o.Verbose)...)
+
+	log.Println("Verifying completion marker")
+	if !completeTags(paths)[filepath.Join(sum, o.Tag)] {
+		problems = append(problems, fmt.Sprintf("%s not found, backup is incomplete", CompletionMarker))
+	}
+
+	log.Println("Verifying manifest")
+	manifest, err := ReadManifest(srcClient, srcPrefix, tagPath, o.Verbose)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		problems = append(problems, fmt.Sprintf("%s not found", ManifestFile))
+	} else {
+		problems = append(problems, verifyManifest(manifest, tagFiles)...)
+	}
+
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+	encrypted := manifest.Encryption != nil
+	readTOC := !encrypted || o.EncryptionKey != "" || o.Checksum
+	var transform utils.StreamTransform
+	if readTOC {
+		transform, err = RestoreTransform(manifest, o.EncryptionKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Println("WARNING: backup is encrypted and no key was provided, components listed in TOC files will not be verified")
+	}
+
+	var backedUpFiles []string
+	if manifest.Layout == LayoutArchive {
+		// The contents of archives are only known from the manifest
+		for file := range manifest.Files {
+			backedUpFiles = append(backedUpFiles, file)
+		}
+		if readTOC {
+			log.Println("Backup is archived, components listed in TOC files will not be verified")
+		}
+		readTOC = false
+	} else {
+		for object := range tagFiles {
+			if utils.IsTableFile(object) {
+				backedUpFiles = append(backedUpFiles, manifest.FileName(object))
+			}
+		}
+	}
+
+	if readTOC || o.Checksum {
+		log.Println("Testing rehydration of archived files")
+		if err := TestRehydration(srcClient, srcPrefix, tagPath, false, 0, o.Verbose); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Verifying SSTable components")
+	problems = append(problems, verifySSTables(srcClient, srcPrefix, tagPath, backedUpFiles, manifest, readTOC, transform, o.Parallel, o.Verbose)...)
+
+	if o.Checksum {
+		log.Println("Verifying checksums")
+		if err := VerifyUploadedFiles(srcClient, srcPrefix, tagPath, manifest, o.Parallel, transform, o.Verbose); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) != 0 {
+		for _, problem := range problems {
+			log.Println("PROBLEM:", problem)
+		}
+		return fmt.Errorf("backup verification failed with %d problems", len(problems))
+	}
+
+	log.Println("Backup is valid!")
+	return nil
+}
+
+// findSchemaSum finds the schema sum a tag was backed up under
+func findSchemaSum(files map[string]int64, tag string) (string, error) {
+	sums := make(map[string]string)
+	for file := range files {
+		pSplit := strings.Split(file, "/")
+		if len(pSplit) > 2 && pSplit[1] == tag {
+			sums[pSplit[0]] = "hello there!"
+		}
+	}
+	if len(sums) != 1 {
+		return "", fmt.Errorf("Error with tag %s, found %d schemas", tag, len(sums))
+	}
+
+	return utils.MapKeysToSlice(sums)[0], nil
+}
+
+// verifySchema checks that schema.cql exists and matches the schema sum
+func verifySchema(iSrcClient interface{}, srcPrefix, keyspacePath, sum string, files map[string]int64, verbose bool) []string {
+	schemaFile := filepath.Join(sum, "schema.cql")
+	if _, ok := files[schemaFile]; !ok {
+		return []string{fmt.Sprintf("%s not found", schemaFile)}
+	}
+
+	schema := new(bytes.Buffer)
+	if err := utils.Download(iSrcClient, srcPrefix, filepath.Join(keyspacePath, schemaFile), schema, verbose); err != nil {
+		return []string{fmt.Sprintf("could not download %s: %s", schemaFile, err)}
+	}
+	h := sha256.New()
+	h.Write(schema.Bytes())
+	if foundSum := fmt.Sprintf("%x", h.Sum(nil))[0:6]; foundSum != sum {
+		return []string{fmt.Sprintf("%s sum is %s, expected %s", schemaFile, foundSum, sum)}
+	}
+
+	return nil
+}
+
+// verifyManifest checks that every object in the manifest exists with the right size
+func verifyManifest(manifest *Manifest, tagFiles map[string]int64) []string {
+	var problems []string
+	for object, info := range manifest.Objects() {
+		size, ok := tagFiles[manifest.ObjectName(object)]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is missing", manifest.ObjectName(object)))
+			continue
+		}
+		expected := info.Size
+		if info.StoredSize != 0 {
+			expected = info.StoredSize
+		}
+		if size != expected {
+			problems = append(problems, fmt.Sprintf("%s size is %d, expected %d", object, size, expected))
+		}
+	}
+	sort.Strings(problems)
+
+	return problems
+}
+
+// verifySSTables checks that every SSTable in every pod and table has all of its components
+// files are the backed up files (pod/table/file)
+// If readTOC is set, components listed in the TOC of each SSTable are expected as well. transform is applied to TOC files
+func verifySSTables(iSrcClient interface{}, srcPrefix, tagPath string, files []string, manifest *Manifest, readTOC bool, transform utils.StreamTransform, parallel int, verbose bool) []string {
+	// pod/table/generation -> components
+	sstables := make(map[string][]string)
+	for _, file := range files {
+		dir, name := filepath.Split(file)
+		i := strings.LastIndex(name, "-")
+		if i == -1 {
+			// Not an SSTable component (manifest.json, schema.cql)
+			continue
+		}
+		sstable := filepath.Join(dir, name[:i])
+		sstables[sstable] = append(sstables[sstable], name[i+1:])
+	}
+	if len(sstables) == 0 {
+		return []string{"no SSTables found"}
+	}
+	if parallel == 0 || parallel > len(sstables) {
+		parallel = len(sstables)
+	}
+
+	var problems []string
+	var mutex sync.Mutex
+	bwg := utils.NewBoundedWaitGroup(parallel)
+	for sstable, components := range sstables {
+		bwg.Add(1)
+
+		go func(sstable string, components []string) {
+			defer bwg.Done()
+			expected := append(append([]string{}, requiredComponents...), indexComponent(sstable))
+			if readTOC && utils.Contains(components, "TOC.txt") {
+				toc := new(bytes.Buffer)
+				if err := utils.DownloadTransformed(iSrcClient, srcPrefix, filepath.Join(tagPath, manifest.ObjectName(sstable+"-TOC.txt")), toc, transform, verbose); err != nil {
+					mutex.Lock()
+					problems = append(problems, fmt.Sprintf("could not download %s-TOC.txt: %s", sstable, err))
+					mutex.Unlock()
+					return
+				}
+				for _, line := range strings.Split(toc.String(), "\n") {
+					if line = strings.TrimSpace(line); line != "" && !utils.Contains(expected, line) {
+						expected = append(expected, line)
+					}
+				}
+			}
+
+			var missing []string
+			for _, component := range expected {
+				if !utils.Contains(components, component) {
+					missing = append(missing, component)
+				}
+			}
+			if len(missing) != 0 {
+				mutex.Lock()
+				problems = append(problems, fmt.Sprintf("%s is missing components: %s", sstable, strings.Join(missing, ", ")))
+				mutex.Unlock()
+			}
+		}(sstable, components)
+	}
+	bwg.Wait()
+	sort.Strings(problems)
+
+	return problems
+}
@@ -0,0 +1,49 @@
+package cain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVerifySSTables(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{
+			"big format",
+			[]string{"pod-0/table/nb-1-big-Data.db", "pod-0/table/nb-1-big-Index.db", "pod-0/table/nb-1-big-Statistics.db", "pod-0/table/nb-1-big-TOC.txt"},
+			nil,
+		},
+		{
+			"big format without index",
+			[]string{"pod-0/table/nb-1-big-Data.db", "pod-0/table/nb-1-big-Statistics.db", "pod-0/table/nb-1-big-TOC.txt"},
+			[]string{"pod-0/table/nb-1-big is missing components: Index.db"},
+		},
+		{
+			"legacy name without index",
+			[]string{"pod-0/table/keyspace-table-ka-1-Data.db", "pod-0/table/keyspace-table-ka-1-Statistics.db", "pod-0/table/keyspace-table-ka-1-TOC.txt"},
+			[]string{"pod-0/table/keyspace-table-ka-1 is missing components: Index.db"},
+		},
+		{
+			"bti format",
+			[]string{"pod-0/table/da-1-bti-Data.db", "pod-0/table/da-1-bti-Partitions.db", "pod-0/table/da-1-bti-Rows.db", "pod-0/table/da-1-bti-Statistics.db", "pod-0/table/da-1-bti-TOC.txt"},
+			nil,
+		},
+		{
+			"bti format without partitions",
+			[]string{"pod-0/table/da-1-bti-Data.db", "pod-0/table/da-1-bti-Statistics.db", "pod-0/table/da-1-bti-TOC.txt"},
+			[]string{"pod-0/table/da-1-bti is missing components: Partitions.db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifySSTables(nil, "s3", "tag", tt.files, &Manifest{}, false, nil, 1, false)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// AbsClient holds an azure blob storage pipeline and the options to use for every upload
+type AbsClient struct {
+	Pipeline pipeline.Pipeline
+	Options  StorageOptions
+}
+
+// GetClientToAbs checks the connection to azure blob storage and returns the tested client
+func GetClientToAbs(ctx context.Context, path string, o StorageOptions) (*AbsClient, error) {
+	pl, err := skbn.GetClientToAbs(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AbsClient{Pipeline: pl, Options: o}, nil
+}
+
+// GetListOfFilesWithSizesFromAbs gets relative paths and sizes of files in path from azure blob storage (recursive)
+func GetListOfFilesWithSizesFromAbs(ctx context.Context, iClient interface{}, path string) (map[string]int64, error) {
+	account, container, absPath := initAbsVariables(path)
+	cu, err := getContainerURL(iClient.(*AbsClient).Pipeline, account, container)
+	if err != nil {
+		return nil, err
+	}
+	absPrefix := dirPrefix(absPath)
+
+	files := make(map[string]int64)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := cu.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: absPrefix})
+		if err != nil {
+			return nil, err
+		}
+		marker = listBlob.NextMarker
+
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			var size int64
+			if blobInfo.Properties.ContentLength != nil {
+				size = *blobInfo.Properties.ContentLength
+			}
+			files[strings.TrimPrefix(blobInfo.Name, absPrefix)] = size
+		}
+	}
+
+	return files, nil
+}
+
+// UploadToAbs uploads a single file to azure blob storage, with an immutability policy if the client has a retention
+func UploadToAbs(ctx context.Context, iClient interface{}, toPath, fromPath string, reader io.Reader, verbose bool) error {
+	c := iClient.(*AbsClient)
+	account, container, absPath := initAbsVariables(toPath)
+	if absPath == "" {
+		_, absPath = filepath.Split(fromPath)
+	}
+	cu, err := getContainerURL(c.Pipeline, account, container)
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		log.Printf("Uploading file to abs://%s/%s/%s", account, container, absPath)
+	}
+	options := azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: 4 * 1024 * 1024,
+		MaxBuffers: 16,
+	}
+	if c.Options.RetentionMode != "" {
+		// Compliance retention is locked, governance retention can be changed by users with special permissions
+		mode := azblob.BlobImmutabilityPolicyModeUnlocked
+		if c.Options.RetentionMode == RetentionCompliance {
+			mode = azblob.BlobImmutabilityPolicyModeLocked
+		}
+		options.ImmutabilityPolicyOptions = azblob.NewImmutabilityPolicyOptions(&c.Options.RetainUntil, mode, nil)
+	}
+	_, err = azblob.UploadStreamToBlockBlob(ctx, reader, cu.NewBlockBlobURL(absPath), options)
+
+	return err
+}
+
+// GetObjectRetentionFromAbs gets the immutability policy and legal hold of a blob in azure blob storage
+func GetObjectRetentionFromAbs(ctx context.Context, iClient interface{}, path string) (ObjectRetention, error) {
+	props, err := getBlobURL(iClient, path).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return ObjectRetention{}, err
+	}
+
+	return ObjectRetention{RetainUntil: props.ImmutabilityPolicyExpiresOn(), LegalHold: props.LegalHold() == "true"}, nil
+}
+
+// DeleteFromAbs deletes a single file and its snapshots from azure blob storage
+func DeleteFromAbs(ctx context.Context, iClient interface{}, path string, verbose bool) error {
+	if verbose {
+		account, container, absPath := initAbsVariables(path)
+		log.Printf("Deleting file abs://%s/%s/%s", account, container, absPath)
+	}
+	_, err := getBlobURL(iClient, path).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+
+	return err
+}
+
+// initAbsVariables splits an azure blob storage path to account, container and blob path
+func initAbsVariables(path string) (string, string, string) {
+	pSplit := strings.SplitN(strings.Trim(path, "/"), "/", 3)
+	for len(pSplit) < 3 {
+		pSplit = append(pSplit, "")
+	}
+	return pSplit[0], pSplit[1], pSplit[2]
+}
+
+func getContainerURL(pl pipeline.Pipeline, accountName, containerName string) (azblob.ContainerURL, error) {
+	URL, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, containerName))
+	if err != nil {
+		return azblob.ContainerURL{}, err
+	}
+
+	return azblob.NewContainerURL(*URL, pl), nil
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// Archive is a tar archive of files from a single directory in a pod
+type Archive struct {
+	// Path is the path of the archive in the destination
+	Path string
+	// Dir is the Kubernetes path of the directory (namespace/pod/container/path)
+	Dir string
+	// Files are the names of the archived files in Dir
+	Files []string
+	// Size and Sha256 of the archive are set when it is copied
+	Size   int64
+	Sha256 string
+}
+
+// PerformArchiveCopy archives files in pods and copies the archives to a destination in parallel
+// Every archive is created by a single tar command, and is streamed to the destination without touching the disk
+func PerformArchiveCopy(k8sClient, dstClient interface{}, dstPrefix string, archives []Archive, parallel int, bufferSize float64, s3partSize int64, s3maxUploadParts int, transform StreamTransform, limiter *BandwidthLimiter, verbose bool) error {
+	return performArchiveCopy(k8sClient, dstPrefix, archives, parallel, bufferSize, transform, limiter, verbose,
+		func(toPath, fromPath string, reader io.Reader) error {
+			return Upload(dstClient, dstPrefix, toPath, fromPath, reader, s3partSize, s3maxUploadParts, verbose)
+		})
+}
+
+// performArchiveCopy archives files in pods in parallel, uploading every archive with upload
+func performArchiveCopy(k8sClient interface{}, dstPrefix string, archives []Archive, parallel int, bufferSize float64, transform StreamTransform, limiter *BandwidthLimiter, verbose bool, upload uploadFunc) error {
+	var jobs []copyJob
+	for i := range archives {
+		archive := &archives[i]
+		fileTransform := throttledTransform(limiter, "k8s", dstPrefix, archive.Dir, archive.Path, transform)
+		jobs = append(jobs, copyJob{
+			srcPrefix: "k8s",
+			srcPath:   archive.Dir,
+			dstPrefix: dstPrefix,
+			dstPath:   archive.Path,
+			download: func(writer io.Writer) error {
+				h := sha256.New()
+				counter := &countingWriter{}
+				if err := DownloadArchiveFromK8s(k8sClient, archive.Dir, archive.Files, io.MultiWriter(writer, h, counter), verbose); err != nil {
+					return err
+				}
+				archive.Size = counter.n
+				archive.Sha256 = fmt.Sprintf("%x", h.Sum(nil))
+				return nil
+			},
+			upload: func(reader io.Reader) error {
+				return applyTransform(reader, fileTransform, func(reader io.Reader) error {
+					return upload(archive.Path, "", reader)
+				})
+			},
+		})
+	}
+
+	return copyInParallel(jobs, parallel, bufferSize)
+}
+
+// PerformArchiveRestore copies archives from a source and extracts them in pods in parallel
+// Every archive is extracted to the directory of its ToPath
+func PerformArchiveRestore(srcClient, k8sClient interface{}, srcPrefix string, fromToPaths []skbn.FromToPair, parallel int, bufferSize float64, transform StreamTransform, limiter *BandwidthLimiter, verbose bool) error {
+	var jobs []copyJob
+	for _, ftp := range fromToPaths {
+		fromPath, dir := ftp.FromPath, filepath.Dir(ftp.ToPath)
+		fileTransform := throttledTransform(limiter, srcPrefix, "k8s", fromPath, dir, transform)
+		jobs = append(jobs, copyJob{
+			srcPrefix: srcPrefix,
+			srcPath:   fromPath,
+			dstPrefix: "k8s",
+			dstPath:   dir,
+			download: func(writer io.Writer) error {
+				return Download(srcClient, srcPrefix, fromPath, writer, verbose)
+			},
+			upload: func(reader io.Reader) error {
+				return applyTransform(reader, fileTransform, func(reader io.Reader) error {
+					return ExtractArchiveToK8s(k8sClient, dir, reader, verbose)
+				})
+			},
+		})
+	}
+
+	return copyInParallel(jobs, parallel, bufferSize)
+}
+
+// DownloadArchiveFromK8s writes a tar archive of files in a directory in a pod to writer
+// The list of files is passed through stdin, so it is not limited by the maximum length of a command
+func DownloadArchiveFromK8s(iClient interface{}, dir string, files []string, writer io.Writer, verbose bool) error {
+	k8sClient := iClient.(*skbn.K8sClient)
+	namespace, pod, container, path := SplitK8sPath(dir)
+	if verbose {
+		log.Printf("Archiving %d files from %s/%s/%s:%s", len(files), namespace, pod, container, path)
+	}
+
+	command := []string{"tar", "cf", "-", "-C", path, "-T", "-"}
+	stdin := strings.NewReader(strings.Join(files, "\n") + "\n")
+	stderr, err := skbn.Exec(*k8sClient, namespace, pod, container, command, stdin, writer)
+	if len(stderr) != 0 {
+		return fmt.Errorf("STDERR: " + (string)(stderr))
+	}
+
+	return err
+}
+
+// ExtractArchiveToK8s extracts a tar archive read from reader to a directory in a pod
+func ExtractArchiveToK8s(iClient interface{}, dir string, reader io.Reader, verbose bool) error {
+	k8sClient := iClient.(*skbn.K8sClient)
+	namespace, pod, container, path := SplitK8sPath(dir)
+	if verbose {
+		log.Printf("Extracting archive to %s/%s/%s:%s", namespace, pod, container, path)
+	}
+
+	command := []string{"tar", "xf", "-", "-C", path}
+	stderr, err := skbn.Exec(*k8sClient, namespace, pod, container, command, reader, nil)
+	if len(stderr) != 0 {
+		return fmt.Errorf("STDERR: " + (string)(stderr))
+	}
+	if err != nil {
+		return err
+	}
+	// tar may stop reading after the end of archive marker, drain the padding so the source does not fail
+	_, err = io.Copy(io.Discard, reader)
+
+	return err
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
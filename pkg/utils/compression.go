@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// compressionSuffixes are the suffixes of compressed objects by codec
+var compressionSuffixes = map[string]string{
+	"zstd": ".zst",
+	"lz4":  ".lz4",
+}
+
+// TestCompressionCodec checks that a compression codec is implemented. An empty codec means no compression
+func TestCompressionCodec(codec string) error {
+	if _, ok := compressionSuffixes[codec]; codec != "" && !ok {
+		return fmt.Errorf("compression codec " + codec + " not implemented")
+	}
+	return nil
+}
+
+// CompressionSuffix returns the suffix of objects compressed with codec
+func CompressionSuffix(codec string) string {
+	return compressionSuffixes[codec]
+}
+
+// NewCompressTransform returns a StreamTransform which compresses a stream with codec, or nil for no compression
+func NewCompressTransform(codec string) StreamTransform {
+	if codec == "" {
+		return nil
+	}
+	return func(r io.Reader) (io.Reader, error) {
+		var w io.WriteCloser
+		pr, pw := io.Pipe()
+		switch codec {
+		case "zstd":
+			enc, err := zstd.NewWriter(pw)
+			if err != nil {
+				return nil, err
+			}
+			w = enc
+		case "lz4":
+			w = lz4.NewWriter(pw)
+		default:
+			return nil, fmt.Errorf("compression codec " + codec + " not implemented")
+		}
+
+		go func() {
+			_, err := io.Copy(w, r)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+			pw.CloseWithError(err)
+		}()
+
+		return pr, nil
+	}
+}
+
+// NewDecompressTransform returns a StreamTransform which decompresses a stream compressed with codec, or nil for no compression
+func NewDecompressTransform(codec string) StreamTransform {
+	if codec == "" {
+		return nil
+	}
+	return func(r io.Reader) (io.Reader, error) {
+		switch codec {
+		case "zstd":
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		case "lz4":
+			return lz4.NewReader(r), nil
+		default:
+			return nil, fmt.Errorf("compression codec " + codec + " not implemented")
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+
+	"github.com/djherbis/buffer"
+	"github.com/djherbis/nio/v3"
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// StreamTransform wraps a stream being copied, such as for compression or encryption
+// If the returned reader is an io.Closer, it is closed when the copy of the stream ends
+type StreamTransform func(io.Reader) (io.Reader, error)
+
+// ChainTransforms returns a StreamTransform applying transforms in order, skipping nil transforms
+// Returns nil if all transforms are nil
+func ChainTransforms(transforms ...StreamTransform) StreamTransform {
+	var chain []StreamTransform
+	for _, transform := range transforms {
+		if transform != nil {
+			chain = append(chain, transform)
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+
+	return func(r io.Reader) (io.Reader, error) {
+		cr := &chainReader{Reader: r}
+		for _, transform := range chain {
+			reader, err := transform(cr.Reader)
+			if err != nil {
+				cr.Close()
+				return nil, err
+			}
+			if closer, ok := reader.(io.Closer); ok {
+				cr.closers = append(cr.closers, closer)
+			}
+			cr.Reader = reader
+		}
+		return cr, nil
+	}
+}
+
+// chainReader reads from the last reader of a chain, and closes all readers of the chain
+type chainReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (cr *chainReader) Close() error {
+	for _, closer := range cr.closers {
+		closer.Close()
+	}
+	return nil
+}
+
+// closeReader closes a reader returned by a StreamTransform
+func closeReader(reader io.Reader) {
+	if closer, ok := reader.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// PerformCopy copies files in parallel, streaming each file from source to destination through an in memory buffer
+// transform is applied to every file if it is not nil, and the bandwidth of all files is limited by limiter if it is not nil
+func PerformCopy(srcClient, dstClient interface{}, srcPrefix, dstPrefix string, fromToPaths []skbn.FromToPair, parallel int, bufferSize float64, s3partSize int64, s3maxUploadParts int, transform StreamTransform, limiter *BandwidthLimiter, verbose bool) error {
+	return performCopy(srcClient, srcPrefix, dstPrefix, fromToPaths, parallel, bufferSize, transform, limiter, verbose,
+		func(toPath, fromPath string, reader io.Reader) error {
+			return Upload(dstClient, dstPrefix, toPath, fromPath, reader, s3partSize, s3maxUploadParts, verbose)
+		})
+}
+
+// uploadFunc uploads a single file read from reader to toPath
+type uploadFunc func(toPath, fromPath string, reader io.Reader) error
+
+// performCopy copies files in parallel, uploading every file with upload
+func performCopy(srcClient interface{}, srcPrefix, dstPrefix string, fromToPaths []skbn.FromToPair, parallel int, bufferSize float64, transform StreamTransform, limiter *BandwidthLimiter, verbose bool, upload uploadFunc) error {
+	var jobs []copyJob
+	for _, ftp := range fromToPaths {
+		fromPath, toPath := ftp.FromPath, ftp.ToPath
+		fileTransform := throttledTransform(limiter, srcPrefix, dstPrefix, fromPath, toPath, transform)
+		jobs = append(jobs, copyJob{
+			srcPrefix: srcPrefix,
+			srcPath:   fromPath,
+			dstPrefix: dstPrefix,
+			dstPath:   toPath,
+			download: func(writer io.Writer) error {
+				return Download(srcClient, srcPrefix, fromPath, writer, verbose)
+			},
+			upload: func(reader io.Reader) error {
+				return applyTransform(reader, fileTransform, func(reader io.Reader) error {
+					return upload(toPath, fromPath, reader)
+				})
+			},
+		})
+	}
+
+	return copyInParallel(jobs, parallel, bufferSize)
+}
+
+// copyJob is a single stream to copy, the paths are used for logging
+type copyJob struct {
+	srcPrefix string
+	srcPath   string
+	dstPrefix string
+	dstPath   string
+	download  func(io.Writer) error
+	upload    func(io.Reader) error
+}
+
+// copyInParallel runs copy jobs in parallel, streaming each job from download to upload through an in memory buffer
+func copyInParallel(jobs []copyJob, parallel int, bufferSize float64) error {
+	totalFiles := len(jobs)
+	if totalFiles == 0 {
+		return nil
+	}
+	if parallel == 0 {
+		parallel = totalFiles
+	}
+	bwgSize := int(math.Min(float64(parallel), float64(totalFiles)))
+	bwg := NewBoundedWaitGroup(bwgSize)
+	// Every file may fail on both ends
+	errc := make(chan error, 2*totalFiles)
+	totalDigits := len(fmt.Sprint(totalFiles))
+	for i, job := range jobs {
+
+		if len(errc) != 0 {
+			break
+		}
+
+		bwg.Add(1)
+		currentLine := fmt.Sprintf("%0*d", totalDigits, i+1)
+
+		go func(job copyJob, currentLine string) {
+			defer bwg.Done()
+
+			newBufferSize := (int64)(bufferSize * 1024 * 1024) // may not be super accurate
+			buf := buffer.New(newBufferSize)
+			pr, pw := nio.Pipe(buf)
+
+			log.Printf("[%s/%d] copy: %s://%s -> %s://%s", currentLine, totalFiles, job.srcPrefix, job.srcPath, job.dstPrefix, job.dstPath)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				err := job.download(pw)
+				if err != nil {
+					log.Println(err, fmt.Sprintf(" src: file: %s", job.srcPath))
+					errc <- err
+				}
+				pw.CloseWithError(err)
+			}()
+
+			err := job.upload(pr)
+			pr.Close()
+			<-done
+			if err != nil {
+				log.Println(err, fmt.Sprintf(" dst: file: %s", job.dstPath))
+				errc <- err
+				return
+			}
+			log.Printf("[%s/%d] done: %s://%s -> %s://%s", currentLine, totalFiles, job.srcPrefix, job.srcPath, job.dstPrefix, job.dstPath)
+		}(job, currentLine)
+	}
+	bwg.Wait()
+	close(errc)
+
+	return <-errc
+}
+
+// throttledTransform adds throttling to transform, on the side of the stream that goes through the pod
+func throttledTransform(limiter *BandwidthLimiter, srcPrefix, dstPrefix, fromPath, toPath string, transform StreamTransform) StreamTransform {
+	if limiter == nil {
+		return transform
+	}
+	if srcPrefix == "k8s" {
+		_, pod, _, _ := SplitK8sPath(fromPath)
+		return ChainTransforms(limiter.Transform(pod), transform)
+	}
+	if dstPrefix == "k8s" {
+		_, pod, _, _ := SplitK8sPath(toPath)
+		return ChainTransforms(transform, limiter.Transform(pod))
+	}
+
+	return ChainTransforms(limiter.Transform(""), transform)
+}
+
+// applyTransform passes reader to f, applying transform if it is not nil
+func applyTransform(reader io.Reader, transform StreamTransform, f func(io.Reader) error) error {
+	if transform == nil {
+		return f(reader)
+	}
+
+	reader, err := transform(reader)
+	if err != nil {
+		return err
+	}
+	defer closeReader(reader)
+
+	return f(reader)
+}
+
+// DownloadTransformed downloads a single file into an io.Writer, applying transform if it is not nil
+func DownloadTransformed(srcClient interface{}, srcPrefix, srcPath string, writer io.Writer, transform StreamTransform, verbose bool) error {
+	if transform == nil {
+		return Download(srcClient, srcPrefix, srcPath, writer, verbose)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Download(srcClient, srcPrefix, srcPath, pw, verbose))
+	}()
+	defer pr.Close()
+
+	reader, err := transform(pr)
+	if err != nil {
+		return err
+	}
+	defer closeReader(reader)
+	_, err = io.Copy(writer, reader)
+	return err
+}
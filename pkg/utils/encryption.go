@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted streams start with a header of encryptionMagic and a random base nonce,
+// followed by chunks of up to encryptionChunkSize bytes, each sealed with AES-256-GCM.
+// Every chunk uses the base nonce XORed with its index, and is authenticated with a flag
+// stating whether it is the final chunk, so reordered or truncated streams fail to decrypt.
+const (
+	// EncryptionAlgorithm is the algorithm used for client side encryption
+	EncryptionAlgorithm = "AES-256-GCM-STREAM"
+
+	encryptionMagic     = "CAINENC1"
+	encryptionChunkSize = 64 * 1024
+	encryptionKeySize   = 32
+)
+
+// NewEncryptTransform returns a StreamTransform which encrypts a stream with key
+func NewEncryptTransform(key []byte) StreamTransform {
+	return func(r io.Reader) (io.Reader, error) {
+		return EncryptReader(r, key)
+	}
+}
+
+// NewDecryptTransform returns a StreamTransform which decrypts a stream with key
+func NewDecryptTransform(key []byte) StreamTransform {
+	return func(r io.Reader) (io.Reader, error) {
+		return DecryptReader(r, key)
+	}
+}
+
+// EncryptReader returns a reader of r encrypted with key
+func EncryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &cryptReader{
+		src:   bufio.NewReaderSize(r, encryptionChunkSize),
+		aead:  aead,
+		nonce: nonce,
+		in:    make([]byte, encryptionChunkSize),
+		out:   append([]byte(encryptionMagic), nonce...),
+		seal:  true,
+	}, nil
+}
+
+// DecryptReader returns a reader of r decrypted with key
+func DecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	src := bufio.NewReaderSize(r, encryptionChunkSize+aead.Overhead())
+
+	header := make([]byte, len(encryptionMagic)+aead.NonceSize())
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, fmt.Errorf("could not read encryption header: %s", err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("stream is not encrypted by cain")
+	}
+
+	return &cryptReader{
+		src:   src,
+		aead:  aead,
+		nonce: header[len(encryptionMagic):],
+		in:    make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// cryptReader encrypts or decrypts a stream chunk by chunk
+type cryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	in      []byte
+	out     []byte
+	seal    bool
+	done    bool
+}
+
+func (c *cryptReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+
+	return n, nil
+}
+
+// next reads, seals or opens a single chunk
+func (c *cryptReader) next() error {
+	n, err := io.ReadFull(c.src, c.in)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := err != nil
+	if !final {
+		if _, err := c.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	nonce := make([]byte, len(c.nonce))
+	copy(nonce, c.nonce)
+	counter := binary.BigEndian.Uint64(nonce[len(nonce)-8:]) ^ c.counter
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	additionalData := []byte{0}
+	if final {
+		additionalData[0] = 1
+	}
+
+	if c.seal {
+		c.out = c.aead.Seal(c.out[:0], nonce, c.in[:n], additionalData)
+	} else {
+		c.out, err = c.aead.Open(c.out[:0], nonce, c.in[:n], additionalData)
+		if err != nil {
+			return errors.New("could not decrypt stream: wrong key, or corrupted or truncated data")
+		}
+	}
+	c.counter++
+	c.done = final
+
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
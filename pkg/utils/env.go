@@ -4,6 +4,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // GetIntEnvVar returns 0 if the variable is empty or not int, else the value
@@ -65,3 +66,40 @@ func GetInt64EnvVar(name string, defVal int64) int64 {
 	}
 	return iVal
 }
+
+// GetDurationEnvVar returns the default value if the variable is empty or not a duration, else the value
+func GetDurationEnvVar(name string, defVal time.Duration) time.Duration {
+	val := os.Getenv(name)
+	if val == "" {
+		return defVal
+	}
+	dVal, err := time.ParseDuration(val)
+	if err != nil {
+		return defVal
+	}
+	return dVal
+}
+
+// GetStringSliceEnvVar returns the default value if the variable is empty, else the comma separated values
+func GetStringSliceEnvVar(name string, defVal []string) []string {
+	val := os.Getenv(name)
+	if val == "" {
+		return defVal
+	}
+	return strings.Split(val, ",")
+}
+
+// GetStringArrayEnvVar returns the default value if the variable is empty, else its lines (values may hold commas)
+func GetStringArrayEnvVar(name string, defVal []string) []string {
+	val := os.Getenv(name)
+	if val == "" {
+		return defVal
+	}
+	var vals []string
+	for _, line := range strings.Split(val, "\n") {
+		if strings.TrimSpace(line) != "" {
+			vals = append(vals, line)
+		}
+	}
+	return vals
+}
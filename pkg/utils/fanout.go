@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// Destination is one of the destinations of a fan-out copy
+type Destination struct {
+	Prefix string
+	Client interface{}
+	// BasePath is the path in the destination the relative paths of copied files are joined to
+	BasePath string
+
+	err   error
+	mutex sync.Mutex
+}
+
+// Err returns the error copying to the destination failed with, if it failed
+func (d *Destination) Err() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.err
+}
+
+// Fail marks the destination as failed, it is skipped by following copies. Only the first error is kept
+func (d *Destination) Fail(err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// String returns the url of the destination
+func (d *Destination) String() string {
+	return d.Prefix + "://" + d.BasePath
+}
+
+// PerformFanOutCopy copies files in parallel, reading each file from the source once and writing it to all destinations
+// ToPaths are relative to the base paths of the destinations. transform is applied once, so all destinations get the same bytes
+// A destination which fails is marked as failed and skipped, the copy fails only if the source fails or all destinations fail
+func PerformFanOutCopy(srcClient interface{}, srcPrefix string, dsts []*Destination, fromToPaths []skbn.FromToPair, parallel int, bufferSize float64, s3partSize int64, s3maxUploadParts int, transform StreamTransform, limiter *BandwidthLimiter, verbose bool) error {
+	return performCopy(srcClient, srcPrefix, fanOutPrefix(dsts), fromToPaths, parallel, bufferSize, transform, limiter, verbose,
+		fanOutUpload(dsts, s3partSize, s3maxUploadParts, verbose))
+}
+
+// PerformArchiveFanOutCopy archives files in pods and copies the archives to all destinations in parallel
+// Paths of archives are relative to the base paths of the destinations
+func PerformArchiveFanOutCopy(k8sClient interface{}, dsts []*Destination, archives []Archive, parallel int, bufferSize float64, s3partSize int64, s3maxUploadParts int, transform StreamTransform, limiter *BandwidthLimiter, verbose bool) error {
+	return performArchiveCopy(k8sClient, fanOutPrefix(dsts), archives, parallel, bufferSize, transform, limiter, verbose,
+		fanOutUpload(dsts, s3partSize, s3maxUploadParts, verbose))
+}
+
+// fanOutPrefix returns the prefix to log copies to several destinations with
+func fanOutPrefix(dsts []*Destination) string {
+	var prefixes []string
+	for _, dst := range dsts {
+		prefixes = append(prefixes, dst.Prefix)
+	}
+	return "{" + strings.Join(prefixes, ",") + "}"
+}
+
+// fanOutUpload returns an uploadFunc which writes a stream to all destinations which did not fail yet
+func fanOutUpload(dsts []*Destination, s3partSize int64, s3maxUploadParts int, verbose bool) uploadFunc {
+	return func(toPath, fromPath string, reader io.Reader) error {
+		var branches []*fanOutBranch
+		for _, dst := range dsts {
+			if dst.Err() == nil {
+				branches = append(branches, &fanOutBranch{dst: dst})
+			}
+		}
+		if len(branches) == 0 {
+			return fmt.Errorf("all destinations failed")
+		}
+
+		var wg sync.WaitGroup
+		for _, branch := range branches {
+			pr, pw := io.Pipe()
+			branch.pw = pw
+			wg.Add(1)
+			go func(branch *fanOutBranch) {
+				defer wg.Done()
+				dst := branch.dst
+				branch.err = Upload(dst.Client, dst.Prefix, filepath.Join(dst.BasePath, toPath), fromPath, pr, s3partSize, s3maxUploadParts, verbose)
+				// Unblock the writer if the upload stopped reading
+				pr.CloseWithError(io.ErrClosedPipe)
+			}(branch)
+		}
+
+		_, readErr := io.Copy(&fanOutWriter{branches: branches}, reader)
+		for _, branch := range branches {
+			branch.pw.CloseWithError(readErr)
+		}
+		wg.Wait()
+		// A failure of the source is a failure of the file, not of the destinations
+		if readErr != nil && readErr != errAllBranchesFailed {
+			return readErr
+		}
+
+		failed := 0
+		for _, branch := range branches {
+			if branch.err == nil && branch.dropped {
+				branch.err = fmt.Errorf("upload of %s ended before the end of the file", toPath)
+			}
+			if branch.err != nil {
+				branch.dst.Fail(fmt.Errorf("%s: %s", toPath, branch.err))
+				failed++
+			}
+		}
+		if failed == len(branches) {
+			return fmt.Errorf("all destinations failed")
+		}
+
+		return nil
+	}
+}
+
+// fanOutBranch is the stream of a file to a single destination
+type fanOutBranch struct {
+	dst     *Destination
+	pw      *io.PipeWriter
+	dropped bool
+	err     error
+}
+
+// errAllBranchesFailed is returned by a fanOutWriter when no branch is left to write to
+var errAllBranchesFailed = fmt.Errorf("all branches failed")
+
+// fanOutWriter writes to all branches, dropping branches which fail to write
+type fanOutWriter struct {
+	branches []*fanOutBranch
+}
+
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	written := 0
+	for _, branch := range w.branches {
+		if branch.dropped {
+			continue
+		}
+		if _, err := branch.pw.Write(p); err != nil {
+			branch.dropped = true
+			continue
+		}
+		written++
+	}
+	if written == 0 {
+		return 0, errAllBranchesFailed
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileTmpSuffix is the suffix of files that are still being written
+const fileTmpSuffix = ".cain-tmp"
+
+// GetClientToFile checks that the base directory of path exists on the local filesystem
+// The local filesystem has no client, the returned client is the tested path
+func GetClientToFile(path string) (string, error) {
+	root := getFilePath(path)
+	for dir := root; ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", dir)
+			}
+			return root, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if dir == filepath.Dir(dir) {
+			return "", err
+		}
+	}
+}
+
+// GetListOfFilesFromFile gets list of files in path from the local filesystem (recursive)
+func GetListOfFilesFromFile(path string) ([]string, error) {
+	files, err := GetListOfFilesWithSizesFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var outLines []string
+	for file := range files {
+		outLines = append(outLines, file)
+	}
+
+	return outLines, nil
+}
+
+// GetListOfFilesWithSizesFromFile gets relative paths and sizes of files in path from the local filesystem (recursive)
+func GetListOfFilesWithSizesFromFile(path string) (map[string]int64, error) {
+	root := getFilePath(path)
+	files := make(map[string]int64)
+
+	info, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A single file, same as a full key in object storage
+	if !info.IsDir() {
+		files[""] = info.Size()
+		return files, nil
+	}
+
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(p, fileTmpSuffix) {
+			return nil
+		}
+		files[strings.TrimPrefix(p, root+"/")] = info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// DownloadFromFile reads a single file from the local filesystem
+func DownloadFromFile(path string, writer io.Writer, verbose bool) error {
+	filePath := getFilePath(path)
+	if verbose {
+		log.Printf("Reading file %s", filePath)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(writer, f)
+	return err
+}
+
+// UploadToFile writes a single file to the local filesystem
+// The file is written under a temporary name and renamed when complete, so partial files are never seen
+func UploadToFile(toPath, fromPath string, reader io.Reader, verbose bool) error {
+	filePath := getFilePath(toPath)
+	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		_, fileName := filepath.Split(fromPath)
+		filePath = filepath.Join(filePath, fileName)
+	}
+	if verbose {
+		log.Printf("Writing file %s", filePath)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	tmpPath := filePath + fileTmpSuffix
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filePath)
+}
+
+// DeleteFromFile deletes a single file from the local filesystem
+func DeleteFromFile(path string, verbose bool) error {
+	filePath := getFilePath(path)
+	if verbose {
+		log.Printf("Deleting file %s", filePath)
+	}
+
+	return os.Remove(filePath)
+}
+
+// getFilePath returns the absolute local path of a file:// path (file:///mnt/backups -> /mnt/backups)
+func getFilePath(path string) string {
+	return filepath.Join("/", path)
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// GetClientToGcs checks the connection to google cloud storage and returns the tested client
+// Credentials are taken from Application Default Credentials. Set STORAGE_EMULATOR_HOST to use an emulator
+func GetClientToGcs(ctx context.Context, path string) (*storage.Client, error) {
+	bucket, _ := initGcsVariables(path)
+
+	// The client outlives ctx, so it can not be used to create it
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{})
+	if _, err := it.Next(); err != nil && err != iterator.Done {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// GetListOfFilesFromGcs gets list of files in path from google cloud storage (recursive)
+func GetListOfFilesFromGcs(ctx context.Context, iClient interface{}, path string) ([]string, error) {
+	client := iClient.(*storage.Client)
+	bucket, gcsPath := initGcsVariables(path)
+
+	var outLines []string
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: gcsPath})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		outLines = append(outLines, strings.Replace(attrs.Name, gcsPath, "", 1))
+	}
+
+	return outLines, nil
+}
+
+// GetListOfFilesWithSizesFromGcs gets relative paths and sizes of files in path from google cloud storage (recursive)
+func GetListOfFilesWithSizesFromGcs(ctx context.Context, iClient interface{}, path string) (map[string]int64, error) {
+	client := iClient.(*storage.Client)
+	bucket, gcsPath := initGcsVariables(path)
+	gcsPrefix := dirPrefix(gcsPath)
+
+	files := make(map[string]int64)
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: gcsPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[strings.TrimPrefix(attrs.Name, gcsPrefix)] = attrs.Size
+	}
+
+	return files, nil
+}
+
+// DownloadFromGcs downloads a single file from google cloud storage
+func DownloadFromGcs(ctx context.Context, iClient interface{}, path string, writer io.Writer, verbose bool) error {
+	client := iClient.(*storage.Client)
+	bucket, gcsPath := initGcsVariables(path)
+
+	if verbose {
+		log.Printf("Downloading file from gs://%s/%s", bucket, gcsPath)
+	}
+	reader, err := client.Bucket(bucket).Object(gcsPath).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// UploadToGcs uploads a single file to google cloud storage using a resumable upload
+func UploadToGcs(ctx context.Context, iClient interface{}, toPath, fromPath string, reader io.Reader, verbose bool) error {
+	client := iClient.(*storage.Client)
+	bucket, gcsPath := initGcsVariables(toPath)
+	if gcsPath == "" {
+		_, gcsPath = filepath.Split(fromPath)
+	}
+
+	if verbose {
+		log.Printf("Uploading file to gs://%s/%s", bucket, gcsPath)
+	}
+	writer := client.Bucket(bucket).Object(gcsPath).NewWriter(ctx)
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+// DeleteFromGcs deletes a single file from google cloud storage
+func DeleteFromGcs(ctx context.Context, iClient interface{}, path string, verbose bool) error {
+	client := iClient.(*storage.Client)
+	bucket, gcsPath := initGcsVariables(path)
+
+	if verbose {
+		log.Printf("Deleting file gs://%s/%s", bucket, gcsPath)
+	}
+	return client.Bucket(bucket).Object(gcsPath).Delete(ctx)
+}
+
+// initGcsVariables splits a google cloud storage path to bucket and object path
+func initGcsVariables(path string) (string, string) {
+	pSplit := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	if len(pSplit) == 1 {
+		return pSplit[0], ""
+	}
+	return pSplit[0], pSplit[1]
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// TestGcsEmulatorRoundTrip uploads, lists, downloads and deletes a file in a google cloud storage emulator
+// It runs only if STORAGE_EMULATOR_HOST is set, such as with fake-gcs-server:
+// docker run -p 4443:4443 fsouza/fake-gcs-server -scheme http && STORAGE_EMULATOR_HOST=localhost:4443 go test ./pkg/utils
+func TestGcsEmulatorRoundTrip(t *testing.T) {
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("STORAGE_EMULATOR_HOST is not set")
+	}
+	bucket := "cain-test"
+	if b := os.Getenv("CAIN_TEST_GCS_BUCKET"); b != "" {
+		bucket = b
+	}
+
+	ctx := context.Background()
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storageClient.Close()
+	err = storageClient.Bucket(bucket).Create(ctx, "cain-test", nil)
+	if e, ok := err.(*googleapi.Error); err != nil && (!ok || e.Code != http.StatusConflict) {
+		t.Fatal(err)
+	}
+
+	basePath := bucket + "/cassandra"
+	client, err := GetClient("gs", basePath, StorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hello there!")
+	filePath := basePath + "/ns/cluster/keyspace/sum/tag/pod/table/file-Data.db"
+	if err := Upload(client, "gs", filePath, "", bytes.NewReader(content), 0, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	defer Delete(client, "gs", filePath, false)
+
+	files, err := GetListOfFilesWithSizes(client, "gs", basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relPath := "ns/cluster/keyspace/sum/tag/pod/table/file-Data.db"
+	if size, ok := files[relPath]; !ok || size != int64(len(content)) {
+		t.Fatalf("expected %s of %d bytes in listing, got %v", relPath, len(content), files)
+	}
+
+	downloaded := new(bytes.Buffer)
+	if err := Download(client, "gs", filePath, downloaded, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Fatalf("expected %q, got %q", content, downloaded.Bytes())
+	}
+
+	if err := Delete(client, "gs", filePath, false); err != nil {
+		t.Fatal(err)
+	}
+	files, err = GetListOfFilesWithSizes(client, "gs", basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files[relPath]; ok {
+		t.Fatalf("expected %s to be deleted", relPath)
+	}
+}
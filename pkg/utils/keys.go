@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Encryption holds the encryption metadata of a backup
+type Encryption struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"keyId"`
+	// EncryptedKey is the data key encrypted by the key provider (envelope encryption only)
+	EncryptedKey []byte `json:"encryptedKey,omitempty"`
+}
+
+// NewDataKey gets a key to encrypt a backup with from a key source. Supported key sources:
+// file:///path/to/keyring - a file with a "<key-id> <base64 encoded 32 byte key>" per line. keyID selects the key, the first key is the default
+// awskms://<key-id|alias/name|arn> - a new data key is generated by AWS KMS for every backup (envelope encryption)
+func NewDataKey(keySource, keyID string) ([]byte, *Encryption, error) {
+	prefix, path := SplitInTwo(keySource, "://")
+	switch prefix {
+	case "file":
+		data, err := ioutil.ReadFile(getFilePath(path))
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewDataKeyFromKeyring(data, keySource, keyID)
+	case "awskms":
+		s, err := session.NewSession()
+		if err != nil {
+			return nil, nil, err
+		}
+		output, err := kms.New(s).GenerateDataKey(&kms.GenerateDataKeyInput{
+			KeyId:   aws.String(path),
+			KeySpec: aws.String(kms.DataKeySpecAes256),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return output.Plaintext, &Encryption{Algorithm: EncryptionAlgorithm, KeyID: *output.KeyId, EncryptedKey: output.CiphertextBlob}, nil
+	default:
+		return nil, nil, fmt.Errorf("key source " + prefix + " not implemented")
+	}
+}
+
+// GetDataKey gets the key a backup was encrypted with from a key source
+func GetDataKey(keySource string, encryption *Encryption) ([]byte, error) {
+	if encryption.Algorithm != EncryptionAlgorithm {
+		return nil, fmt.Errorf("encryption algorithm %s not implemented", encryption.Algorithm)
+	}
+	prefix, path := SplitInTwo(keySource, "://")
+	switch prefix {
+	case "file":
+		data, err := ioutil.ReadFile(getFilePath(path))
+		if err != nil {
+			return nil, err
+		}
+		return GetDataKeyFromKeyring(data, keySource, encryption)
+	case "awskms":
+		s, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		output, err := kms.New(s).Decrypt(&kms.DecryptInput{
+			CiphertextBlob: encryption.EncryptedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt data key with key %s: %s", encryption.KeyID, err)
+		}
+		return output.Plaintext, nil
+	default:
+		return nil, fmt.Errorf("key source " + prefix + " not implemented")
+	}
+}
+
+// NewDataKeyFromKeyring gets a key to encrypt a backup with from the content of a keyring, such as a keyring file
+// keyID selects the key, the first key is the default. source describes the keyring in errors
+func NewDataKeyFromKeyring(keyring []byte, source, keyID string) ([]byte, *Encryption, error) {
+	keys, ids, err := parseKeyring(keyring, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyID == "" {
+		keyID = ids[0]
+	}
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, nil, fmt.Errorf("key %s not found in %s", keyID, source)
+	}
+	return key, &Encryption{Algorithm: EncryptionAlgorithm, KeyID: keyID}, nil
+}
+
+// GetDataKeyFromKeyring gets the key a backup was encrypted with from the content of a keyring
+func GetDataKeyFromKeyring(keyring []byte, source string, encryption *Encryption) ([]byte, error) {
+	if encryption.Algorithm != EncryptionAlgorithm {
+		return nil, fmt.Errorf("encryption algorithm %s not implemented", encryption.Algorithm)
+	}
+	keys, _, err := parseKeyring(keyring, source)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[encryption.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("backup was encrypted with key %s, which was not found in %s", encryption.KeyID, source)
+	}
+	return key, nil
+}
+
+// parseKeyring parses a keyring, and returns the keys by ID and the IDs in order of appearance
+func parseKeyring(keyring []byte, source string) (map[string][]byte, []string, error) {
+	keys := make(map[string][]byte)
+	var ids []string
+	scanner := bufio.NewScanner(bytes.NewReader(keyring))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("illegal keyring line in %s, expected \"<key-id> <base64 key>\"", source)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not decode key %s: %s", fields[0], err)
+		}
+		if len(key) != encryptionKeySize {
+			return nil, nil, fmt.Errorf("key %s must be %d bytes, got %d", fields[0], encryptionKeySize, len(key))
+		}
+		keys[fields[0]] = key
+		ids = append(ids, fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, fmt.Errorf("no keys found in %s", source)
+	}
+
+	return keys, ids, nil
+}
@@ -1,14 +1,59 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nuvo/skbn/pkg/skbn"
 
+	core_v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
-// GetPods returns a slice of strings of pod names by namespace and selector
+// Policies for pods which are not ready
+const (
+	// UnreadyPodsFail fails if any pod is not ready
+	UnreadyPodsFail = "fail"
+	// UnreadyPodsWait waits for all pods to be ready, and fails after a timeout
+	UnreadyPodsWait = "wait"
+	// UnreadyPodsSkip skips pods which are not ready with a warning
+	UnreadyPodsSkip = "skip"
+)
+
+// podsPollInterval is the interval between checks of pods readiness
+const podsPollInterval = 5 * time.Second
+
+// GetClientToK8s gets a client to the kubernetes cluster of a kubeconfig file and a context
+// If both are empty, the client is the one of skbn ($KUBECONFIG, ~/.kube/config or in cluster configuration)
+func GetClientToK8s(kubeconfig, context string) (*skbn.K8sClient, error) {
+	if kubeconfig == "" && context == "" {
+		return skbn.GetClientToK8s()
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &skbn.K8sClient{ClientSet: clientset, Config: config}, nil
+}
+
+// GetPods returns a slice of strings of pod names by namespace and selector, sorted by name and ordinal
 func GetPods(iClient interface{}, namespace, selector string) ([]string, error) {
 
 	k8sClient := *iClient.(*skbn.K8sClient)
@@ -26,6 +71,345 @@ func GetPods(iClient interface{}, namespace, selector string) ([]string, error)
 	if len(podList) == 0 {
 		return nil, fmt.Errorf("No pods were found in namespace %s by selector %s", namespace, selector)
 	}
+	SortPods(podList)
 
 	return podList, nil
 }
+
+// GetReadyPods returns the names of ready pods, sorted by name and ordinal
+// Pods are found by selector, or are the pods of every ordinal of a statefulset if statefulSet is set (pods which
+// do not exist are not ready). Pods which are not ready are handled according to unreadyPods (fail, wait or skip)
+func GetReadyPods(iClient interface{}, namespace, selector, statefulSet, unreadyPods string, unreadyTimeout time.Duration) ([]string, error) {
+	if unreadyPods == "" {
+		unreadyPods = UnreadyPodsFail
+	}
+	if err := TestUnreadyPodsPolicy(unreadyPods); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(unreadyTimeout)
+	for {
+		ready, unready, err := getPodsReadiness(iClient, namespace, selector, statefulSet)
+		if err != nil {
+			return nil, err
+		}
+		if len(unready) == 0 {
+			return ready, nil
+		}
+
+		switch unreadyPods {
+		case UnreadyPodsSkip:
+			for _, pod := range unready {
+				log.Println("WARNING: skipping pod which is not ready", pod)
+			}
+			if len(ready) == 0 {
+				return nil, fmt.Errorf("no pods are ready in namespace %s", namespace)
+			}
+			return ready, nil
+		case UnreadyPodsWait:
+			if time.Now().Before(deadline) {
+				log.Println("Waiting for pods to be ready:", strings.Join(unready, ", "))
+				time.Sleep(podsPollInterval)
+				continue
+			}
+			return nil, fmt.Errorf("pods are not ready after %s: %s", unreadyTimeout, strings.Join(unready, ", "))
+		default:
+			return nil, fmt.Errorf("pods are not ready: %s", strings.Join(unready, ", "))
+		}
+	}
+}
+
+// TestUnreadyPodsPolicy checks that a policy for pods which are not ready is supported
+func TestUnreadyPodsPolicy(policy string) error {
+	switch policy {
+	case UnreadyPodsFail, UnreadyPodsWait, UnreadyPodsSkip:
+		return nil
+	default:
+		return fmt.Errorf("illegal unready pods policy %s. must be one of: %s, %s, %s", policy, UnreadyPodsFail, UnreadyPodsWait, UnreadyPodsSkip)
+	}
+}
+
+// SortPods sorts pod names by name and then by ordinal, so pod-10 comes after pod-2
+func SortPods(pods []string) {
+	sort.Slice(pods, func(i, j int) bool {
+		iName, iOrdinal := splitPodOrdinal(pods[i])
+		jName, jOrdinal := splitPodOrdinal(pods[j])
+		if iName != jName || iOrdinal == jOrdinal {
+			return pods[i] < pods[j]
+		}
+		return iOrdinal < jOrdinal
+	})
+}
+
+// getPodsReadiness returns the names of ready pods and descriptions of unready pods, sorted by name and ordinal
+func getPodsReadiness(iClient interface{}, namespace, selector, statefulSet string) ([]string, []string, error) {
+	k8sClient := *iClient.(*skbn.K8sClient)
+	var expected []string
+	if statefulSet != "" {
+		sts, err := k8sClient.ClientSet.AppsV1().StatefulSets(namespace).Get(statefulSet, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		stsSelector, err := metav1.LabelSelectorAsSelector(sts.Spec.Selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		selector = stsSelector.String()
+		replicas := 1
+		if sts.Spec.Replicas != nil {
+			replicas = int(*sts.Spec.Replicas)
+		}
+		for ordinal := 0; ordinal < replicas; ordinal++ {
+			expected = append(expected, fmt.Sprintf("%s-%d", statefulSet, ordinal))
+		}
+	}
+
+	pods, err := k8sClient.ClientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	found := make(map[string]core_v1.Pod)
+	for _, pod := range pods.Items {
+		found[pod.Name] = pod
+	}
+	if statefulSet == "" {
+		for name := range found {
+			expected = append(expected, name)
+		}
+		if len(expected) == 0 {
+			return nil, nil, fmt.Errorf("No pods were found in namespace %s by selector %s", namespace, selector)
+		}
+	}
+
+	SortPods(expected)
+	var ready, unready []string
+	for _, name := range expected {
+		pod, ok := found[name]
+		switch {
+		case !ok:
+			unready = append(unready, name+" (missing)")
+		case !isPodReady(pod):
+			unready = append(unready, fmt.Sprintf("%s (%s)", name, podState(pod)))
+		default:
+			ready = append(ready, name)
+		}
+	}
+	return ready, unready, nil
+}
+
+// isPodReady returns true if a pod is running, ready and not terminating
+func isPodReady(pod core_v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != core_v1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core_v1.PodReady {
+			return condition.Status == core_v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podState describes why a pod is not ready
+func podState(pod core_v1.Pod) string {
+	if pod.DeletionTimestamp != nil {
+		return "terminating"
+	}
+	if pod.Status.Phase != core_v1.PodRunning {
+		return strings.ToLower(string(pod.Status.Phase))
+	}
+	return "not ready"
+}
+
+// splitPodOrdinal splits a pod name to its name and ordinal (cassandra-2 -> cassandra, 2), -1 if it has no ordinal
+func splitPodOrdinal(pod string) (string, int) {
+	i := strings.LastIndex(pod, "-")
+	if i == -1 {
+		return pod, -1
+	}
+	ordinal, err := strconv.Atoi(pod[i+1:])
+	if err != nil {
+		return pod, -1
+	}
+	return pod[:i], ordinal
+}
+
+// GetPodLabels returns the labels of a pod
+func GetPodLabels(iClient interface{}, namespace, pod string) (map[string]string, error) {
+	k8sClient := *iClient.(*skbn.K8sClient)
+	p, err := k8sClient.ClientSet.CoreV1().Pods(namespace).Get(pod, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Labels, nil
+}
+
+// GetPodIPs returns the IPs of pods, keyed by pod name
+func GetPodIPs(iClient interface{}, namespace string, pods []string) (map[string]string, error) {
+	k8sClient := *iClient.(*skbn.K8sClient)
+	ips := make(map[string]string)
+	for _, pod := range pods {
+		p, err := k8sClient.ClientSet.CoreV1().Pods(namespace).Get(pod, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if p.Status.PodIP == "" {
+			return nil, fmt.Errorf("pod %s has no IP", pod)
+		}
+		ips[pod] = p.Status.PodIP
+	}
+
+	return ips, nil
+}
+
+// GetEventTarget returns a reference to the object events of a cassandra cluster are recorded on
+// It is the statefulset if statefulSet is set, the statefulset owning the pods found by selector, or the first of these pods
+func GetEventTarget(iClient interface{}, namespace, selector, statefulSet string) (*core_v1.ObjectReference, error) {
+	k8sClient := *iClient.(*skbn.K8sClient)
+	if statefulSet != "" {
+		sts, err := k8sClient.ClientSet.AppsV1().StatefulSets(namespace).Get(statefulSet, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &core_v1.ObjectReference{Kind: "StatefulSet", APIVersion: "apps/v1", Namespace: namespace, Name: sts.Name, UID: sts.UID}, nil
+	}
+
+	pods, err := k8sClient.ClientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("No pods were found in namespace %s by selector %s", namespace, selector)
+	}
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	pod := pods.Items[0]
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "StatefulSet" {
+			return &core_v1.ObjectReference{Kind: owner.Kind, APIVersion: owner.APIVersion, Namespace: namespace, Name: owner.Name, UID: owner.UID}, nil
+		}
+	}
+
+	return &core_v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: namespace, Name: pod.Name, UID: pod.UID}, nil
+}
+
+// CreateEvent records an event on an object
+func CreateEvent(iClient interface{}, object *core_v1.ObjectReference, eventType, reason, message string) error {
+	k8sClient := *iClient.(*skbn.K8sClient)
+	now := metav1.Now()
+	event := &core_v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", object.Name, now.UnixNano()),
+			Namespace: object.Namespace,
+		},
+		InvolvedObject: *object,
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         core_v1.EventSource{Component: "cain"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := k8sClient.ClientSet.CoreV1().Events(object.Namespace).Create(event)
+
+	return err
+}
+
+// AnnotateStatefulSet sets annotations of a statefulset, leaving its other annotations as they are
+func AnnotateStatefulSet(iClient interface{}, namespace, statefulSet string, annotations map[string]string) error {
+	k8sClient := *iClient.(*skbn.K8sClient)
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = k8sClient.ClientSet.AppsV1().StatefulSets(namespace).Patch(statefulSet, types.MergePatchType, data)
+
+	return err
+}
+
+// GetSecretData gets the data of a secret
+func GetSecretData(iClient interface{}, namespace, secret string) (map[string][]byte, error) {
+	k8sClient := *iClient.(*skbn.K8sClient)
+	s, err := k8sClient.ClientSet.CoreV1().Secrets(namespace).Get(secret, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Data, nil
+}
+
+// GetChecksumsFromK8s calculates the sha256 checksum of files in a pod
+func GetChecksumsFromK8s(iClient interface{}, namespace, pod, container string, paths []string) (map[string]string, error) {
+	output, err := execOnFiles(iClient, namespace, pod, container, []string{"sha256sum"}, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		// sha256sum prints "<sum>  <path>"
+		split := strings.SplitN(line, "  ", 2)
+		if len(split) != 2 {
+			continue
+		}
+		sums[split[1]] = split[0]
+	}
+
+	return sums, nil
+}
+
+// GetSizesFromK8s gets the size in bytes of files in a pod
+func GetSizesFromK8s(iClient interface{}, namespace, pod, container string, paths []string) (map[string]int64, error) {
+	output, err := execOnFiles(iClient, namespace, pod, container, []string{"stat", "-c", "%s %n"}, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64)
+	for _, line := range strings.Split(output, "\n") {
+		split := strings.SplitN(line, " ", 2)
+		if len(split) != 2 {
+			continue
+		}
+		size, err := strconv.ParseInt(split[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse size of %s: %s", split[1], err)
+		}
+		sizes[split[1]] = size
+	}
+
+	return sizes, nil
+}
+
+// execOnFiles executes a command with paths as arguments, in chunks to keep the command line short
+func execOnFiles(iClient interface{}, namespace, pod, container string, command, paths []string) (string, error) {
+	k8sClient := *iClient.(*skbn.K8sClient)
+	const chunkSize = 500
+
+	output := new(bytes.Buffer)
+	for i := 0; i < len(paths); i += chunkSize {
+		end := i + chunkSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		chunkCommand := append(append([]string{}, command...), paths[i:end]...)
+		stderr, err := skbn.Exec(k8sClient, namespace, pod, container, chunkCommand, nil, output)
+		if len(stderr) != 0 {
+			return "", fmt.Errorf("STDERR: " + (string)(stderr))
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return output.String(), nil
+}
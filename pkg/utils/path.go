@@ -25,10 +25,11 @@ func GetFromAndToPathsFromK8s(iClient interface{}, pods []string, namespace, con
 }
 
 // GetFromAndToPathsSrcToK8s performs a path mapping between a source and Kubernetes
-func GetFromAndToPathsSrcToK8s(srcClient, k8sClient interface{}, srcPrefix, srcPath, srcBasePath, namespace, container, cassandraDataDir string) ([]skbn.FromToPair, []string, []string, error) {
+// suffix is removed from the names of restored files (compressed files). If selectedPods is not nil, only files of these pods are mapped
+func GetFromAndToPathsSrcToK8s(srcClient, k8sClient interface{}, srcPrefix, srcPath, srcBasePath, namespace, container, cassandraDataDir, suffix string, selectedPods []string) ([]skbn.FromToPair, []string, []string, error) {
 	var fromToPaths []skbn.FromToPair
 
-	filesToCopyRelativePaths, err := skbn.GetListOfFiles(srcClient, srcPrefix, srcPath)
+	filesToCopyRelativePaths, err := GetListOfFiles(srcClient, srcPrefix, srcPath)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -41,8 +42,17 @@ func GetFromAndToPathsSrcToK8s(srcClient, k8sClient interface{}, srcPrefix, srcP
 	testedPaths := make(map[string]string)
 	for _, fileToCopyRelativePath := range filesToCopyRelativePaths {
 
+		// Skip backup metadata such as the completion marker
+		if !IsTableFile(fileToCopyRelativePath) {
+			continue
+		}
+		// pod/table/file
+		if selectedPods != nil && !Contains(selectedPods, strings.Split(fileToCopyRelativePath, "/")[0]) {
+			continue
+		}
+
 		fromPath := filepath.Join(srcPath, fileToCopyRelativePath)
-		toPath, err := PathFromSrcToK8s(k8sClient, fromPath, cassandraDataDir, srcBasePath, namespace, container, pods, tables, testedPaths)
+		toPath, err := PathFromSrcToK8s(k8sClient, strings.TrimSuffix(fromPath, suffix), cassandraDataDir, srcBasePath, namespace, container, pods, tables, testedPaths)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -104,6 +114,11 @@ func PathFromK8sToDst(k8sPath, cassandraDataDir, dstBasePath string) string {
 	return filepath.Join(dstBasePath, tag, pod, table, file)
 }
 
+// IsTableFile checks if a path relative to a backup tag is a table file (pod/table/file)
+func IsTableFile(relativePath string) bool {
+	return len(strings.Split(strings.Trim(relativePath, "/"), "/")) == 3
+}
+
 // PathFromSrcToK8s maps a single path from source to Kubernetes
 func PathFromSrcToK8s(k8sClient interface{}, fromPath, cassandraDataDir, srcBasePath, namespace, container string, pods, tables, testedPaths map[string]string) (string, error) {
 	fromPath = strings.Replace(fromPath, srcBasePath+"/", "", 1)
@@ -174,3 +189,17 @@ func TestK8sDirectory(iK8sClient interface{}, pods []string, namespace, containe
 	}
 	return nil
 }
+
+// SplitK8sPath splits a Kubernetes path to namespace, pod, container and the absolute path inside the container
+func SplitK8sPath(k8sPath string) (string, string, string, string) {
+	pSplit := strings.SplitN(strings.Trim(k8sPath, "/"), "/", 4)
+	if len(pSplit) != 4 {
+		return "", "", "", ""
+	}
+	return pSplit[0], pSplit[1], pSplit[2], "/" + pSplit[3]
+}
+
+// RelativePath returns the path relative to a base path
+func RelativePath(path, basePath string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, basePath), "/")
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuvo/skbn/pkg/skbn"
+
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// pvcHelperContainer is the name of the container of the helper pod
+	pvcHelperContainer = "helper"
+	// pvcMountPath is where the claim is mounted in the helper pod
+	pvcMountPath = "/backup"
+	// pvcHelperTimeout is how long to wait for a helper pod to be running
+	pvcHelperTimeout = 5 * time.Minute
+)
+
+// PvcClient is a client to a persistent volume claim, which is accessed through a helper pod mounting it
+type PvcClient struct {
+	K8sClient *skbn.K8sClient
+	Namespace string
+	Claim     string
+	Pod       string
+}
+
+// GetClientToPvc starts or reuses a helper pod which mounts the claim of path (namespace/claim-name/path)
+// The helper pod is left running, so following runs can reuse it
+func GetClientToPvc(path string, o StorageOptions) (*PvcClient, error) {
+	namespace, claim, _ := splitPvcPath(path)
+	if namespace == "" || claim == "" {
+		return nil, fmt.Errorf("illegal pvc path %s. expected namespace/claim-name/path", path)
+	}
+	k8sClient, err := GetClientToK8s(o.Kubeconfig, o.KubeContext)
+	if err != nil {
+		return nil, err
+	}
+	pods := k8sClient.ClientSet.CoreV1().Pods(namespace)
+
+	if _, err := k8sClient.ClientSet.CoreV1().PersistentVolumeClaims(namespace).Get(claim, metav1.GetOptions{}); err != nil {
+		return nil, err
+	}
+
+	podName := "cain-pvc-" + claim
+	pod, err := pods.Get(podName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		log.Printf("Starting helper pod %s for claim %s", podName, claim)
+		pod, err = pods.Create(newPvcHelperPod(podName, claim))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for start := time.Now(); pod.Status.Phase != core_v1.PodRunning; {
+		if pod.Status.Phase == core_v1.PodFailed || pod.Status.Phase == core_v1.PodSucceeded {
+			return nil, fmt.Errorf("helper pod %s is %s", podName, pod.Status.Phase)
+		}
+		if time.Since(start) > pvcHelperTimeout {
+			return nil, fmt.Errorf("timed out waiting for helper pod %s to be running", podName)
+		}
+		time.Sleep(2 * time.Second)
+		if pod, err = pods.Get(podName, metav1.GetOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &PvcClient{K8sClient: k8sClient, Namespace: namespace, Claim: claim, Pod: podName}, nil
+}
+
+// newPvcHelperPod returns a pod which mounts a claim and does nothing else
+func newPvcHelperPod(name, claim string) *core_v1.Pod {
+	return &core_v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"app":   "cain-pvc-helper",
+				"claim": claim,
+			},
+		},
+		Spec: core_v1.PodSpec{
+			Containers: []core_v1.Container{
+				{
+					Name:    pvcHelperContainer,
+					Image:   GetStringEnvVar("CAIN_PVC_HELPER_IMAGE", "busybox:1.36"),
+					Command: []string{"sh", "-c", "trap 'exit 0' TERM; while true; do sleep 3600 & wait; done"},
+					VolumeMounts: []core_v1.VolumeMount{
+						{Name: "backup", MountPath: pvcMountPath},
+					},
+				},
+			},
+			Volumes: []core_v1.Volume{
+				{
+					Name: "backup",
+					VolumeSource: core_v1.VolumeSource{
+						PersistentVolumeClaim: &core_v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+					},
+				},
+			},
+		},
+	}
+}
+
+// GetListOfFilesFromPvc gets list of files in path from a persistent volume claim (recursive)
+func GetListOfFilesFromPvc(iClient interface{}, path string) ([]string, error) {
+	files, err := GetListOfFilesWithSizesFromPvc(iClient, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var outLines []string
+	for file := range files {
+		outLines = append(outLines, file)
+	}
+
+	return outLines, nil
+}
+
+// GetListOfFilesWithSizesFromPvc gets relative paths and sizes of files in path from a persistent volume claim (recursive)
+func GetListOfFilesWithSizesFromPvc(iClient interface{}, path string) (map[string]int64, error) {
+	client := iClient.(*PvcClient)
+	root := getPvcMountedPath(path)
+
+	// A missing path is an empty directory, same as in object storage
+	script := `[ -e "$1" ] || exit 0; find "$1" -type f ! -name "*$2" -exec stat -c "%s %n" {} +`
+	output := new(bytes.Buffer)
+	if err := execInPvcHelper(client, []string{"sh", "-c", script, "sh", root, fileTmpSuffix}, nil, output); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]int64)
+	for _, line := range strings.Split(output.String(), "\n") {
+		split := strings.SplitN(line, " ", 2)
+		if len(split) != 2 {
+			continue
+		}
+		size, err := strconv.ParseInt(split[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse size of %s: %s", split[1], err)
+		}
+		// A single file, same as a full key in object storage
+		if split[1] == root {
+			files[""] = size
+			continue
+		}
+		files[strings.TrimPrefix(split[1], root+"/")] = size
+	}
+
+	return files, nil
+}
+
+// DownloadFromPvc reads a single file from a persistent volume claim
+func DownloadFromPvc(iClient interface{}, path string, writer io.Writer, verbose bool) error {
+	client := iClient.(*PvcClient)
+	filePath := getPvcMountedPath(path)
+	if verbose {
+		log.Printf("Reading file %s from claim %s", filePath, client.Claim)
+	}
+
+	return execInPvcHelper(client, []string{"cat", filePath}, nil, writer)
+}
+
+// UploadToPvc writes a single file to a persistent volume claim
+// The file is written under a temporary name and renamed when complete, so partial files are never seen
+func UploadToPvc(iClient interface{}, toPath, fromPath string, reader io.Reader, verbose bool) error {
+	client := iClient.(*PvcClient)
+	filePath := getPvcMountedPath(toPath)
+	if verbose {
+		log.Printf("Writing file %s to claim %s", filePath, client.Claim)
+	}
+
+	// Same as the file:// destination, a path of an existing directory gets the name of the source file
+	script := `f="$1"; [ -d "$f" ] && f="$f/$2"; mkdir -p "$(dirname "$f")" && cat > "$f$3" && mv "$f$3" "$f"`
+	command := []string{"sh", "-c", script, "sh", filePath, filepath.Base(fromPath), fileTmpSuffix}
+
+	return execInPvcHelper(client, command, reader, nil)
+}
+
+// DeleteFromPvc deletes a single file from a persistent volume claim
+func DeleteFromPvc(iClient interface{}, path string, verbose bool) error {
+	client := iClient.(*PvcClient)
+	filePath := getPvcMountedPath(path)
+	if verbose {
+		log.Printf("Deleting file %s from claim %s", filePath, client.Claim)
+	}
+
+	return execInPvcHelper(client, []string{"rm", filePath}, nil, nil)
+}
+
+// execInPvcHelper executes a command in the helper pod of a client
+func execInPvcHelper(client *PvcClient, command []string, stdin io.Reader, stdout io.Writer) error {
+	stderr, err := skbn.Exec(*client.K8sClient, client.Namespace, client.Pod, pvcHelperContainer, command, stdin, stdout)
+	if len(stderr) != 0 {
+		return fmt.Errorf("STDERR: " + (string)(stderr))
+	}
+
+	return err
+}
+
+// splitPvcPath splits a pvc path to namespace, claim and the path inside the claim
+func splitPvcPath(path string) (string, string, string) {
+	pSplit := strings.SplitN(strings.Trim(path, "/"), "/", 3)
+	for len(pSplit) < 3 {
+		pSplit = append(pSplit, "")
+	}
+	return pSplit[0], pSplit[1], pSplit[2]
+}
+
+// getPvcMountedPath returns the path of a pvc:// path in the helper pod (pvc://ns/claim/backups -> /backup/backups)
+func getPvcMountedPath(path string) string {
+	_, _, claimPath := splitPvcPath(path)
+	return filepath.Join(pvcMountPath, claimPath)
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Retention modes of immutable objects
+const (
+	// RetentionGovernance objects can only be removed by users with special permissions before their retention ends
+	RetentionGovernance = "governance"
+	// RetentionCompliance objects can not be removed by anyone before their retention ends
+	RetentionCompliance = "compliance"
+)
+
+// GetRetainUntil returns the date to retain objects until, from a date (RFC 3339 or 2006-01-02) or a number of days from now
+// Returns the zero time if neither is set
+func GetRetainUntil(retainUntil string, retentionDays int) (time.Time, error) {
+	if retainUntil != "" && retentionDays != 0 {
+		return time.Time{}, fmt.Errorf("retain until date and retention days can not be used together")
+	}
+	if retentionDays < 0 {
+		return time.Time{}, fmt.Errorf("retention days must be positive")
+	}
+	if retentionDays != 0 {
+		return time.Now().UTC().AddDate(0, 0, retentionDays), nil
+	}
+	if retainUntil == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, retainUntil); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("illegal retain until date %s. expected RFC 3339 or YYYY-MM-DD", retainUntil)
+}
+
+// testRetention checks that the retention options are complete and supported by the storage service
+func testRetention(prefix string, o StorageOptions) error {
+	if o.RetentionMode == "" {
+		if !o.RetainUntil.IsZero() {
+			return fmt.Errorf("retention mode must be set to retain objects")
+		}
+		return nil
+	}
+	if o.RetentionMode != RetentionGovernance && o.RetentionMode != RetentionCompliance {
+		return fmt.Errorf("illegal retention mode %s. must be one of: %s, %s", o.RetentionMode, RetentionGovernance, RetentionCompliance)
+	}
+	if o.RetainUntil.IsZero() {
+		return fmt.Errorf("retention mode %s requires a retain until date or retention days", o.RetentionMode)
+	}
+	if !o.RetainUntil.After(time.Now()) {
+		return fmt.Errorf("retain until date %s is in the past", o.RetainUntil.Format(time.RFC3339))
+	}
+	switch prefix {
+	case "s3", "abs":
+		return nil
+	default:
+		return fmt.Errorf("retention is not supported for " + prefix)
+	}
+}
+
+// ObjectRetention is the retention of an immutable object
+type ObjectRetention struct {
+	RetainUntil time.Time
+	LegalHold   bool
+}
+
+// Retained returns true if the object can not be deleted at t
+func (r ObjectRetention) Retained(t time.Time) bool {
+	return r.LegalHold || r.RetainUntil.After(t)
+}
+
+// GetObjectRetention gets the retention of an object from S3 Object Lock or azure blob immutability policies
+// Objects of other storage services are never retained
+func GetObjectRetention(client interface{}, prefix, path string) (ObjectRetention, error) {
+	switch prefix {
+	case "s3":
+		return GetObjectRetentionFromS3(client, path)
+	case "abs":
+		return GetObjectRetentionFromAbs(context.Background(), client, path)
+	default:
+		return ObjectRetention{}, nil
+	}
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Client holds an S3 session and the options to use for every upload
+type S3Client struct {
+	Session *session.Session
+	Options StorageOptions
+}
+
+// GetClientToS3 checks the connection to S3 and returns the tested client
+func GetClientToS3(path string, o StorageOptions) (*S3Client, error) {
+	if err := testS3Options(o); err != nil {
+		return nil, err
+	}
+	bucket, _ := initS3Variables(path)
+
+	attempts := 3
+	attempt := 0
+	for {
+		attempt++
+
+		s, err := getNewS3Session(o)
+		if err == nil {
+			_, err = s3.New(s).ListObjects(&s3.ListObjectsInput{
+				Bucket:  aws.String(bucket),
+				MaxKeys: aws.Int64(0),
+			})
+		}
+		if err == nil {
+			return &S3Client{Session: s, Options: o}, nil
+		}
+		if attempt == attempts {
+			return nil, err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// GetListOfFilesWithSizesFromS3 gets relative paths and sizes of files in path from S3 (recursive)
+func GetListOfFilesWithSizesFromS3(iClient interface{}, path string) (map[string]int64, error) {
+	c := iClient.(*S3Client)
+	bucket, s3Path := initS3Variables(path)
+	s3Prefix := dirPrefix(s3Path)
+
+	files := make(map[string]int64)
+	err := s3.New(c.Session).ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(s3Prefix),
+	}, func(p *s3.ListObjectsOutput, last bool) (shouldContinue bool) {
+		for _, obj := range p.Contents {
+			files[strings.TrimPrefix(*obj.Key, s3Prefix)] = *obj.Size
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// UploadToS3 uploads a single file to S3, using the storage class, encryption, ACL and retention of the client
+func UploadToS3(iClient interface{}, toPath, fromPath string, reader io.Reader, s3partSize int64, s3maxUploadParts int, verbose bool) error {
+	c := iClient.(*S3Client)
+	bucket, s3Path := initS3Variables(toPath)
+	if s3Path == "" {
+		_, s3Path = filepath.Split(fromPath)
+	}
+
+	if verbose {
+		log.Printf("Uploading file to s3://%s/%s", bucket, s3Path)
+	}
+	uploader := s3manager.NewUploader(c.Session, func(u *s3manager.Uploader) {
+		if s3partSize != 0 {
+			u.PartSize = s3partSize
+		}
+		if s3maxUploadParts != 0 {
+			u.MaxUploadParts = s3maxUploadParts
+		}
+	})
+
+	// The reader is a stream and can not be read again, s3manager retries failed parts
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Path),
+		Body:   reader,
+	}
+	if c.Options.S3StorageClass != "" {
+		input.StorageClass = aws.String(c.Options.S3StorageClass)
+	}
+	if c.Options.S3ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(c.Options.S3ServerSideEncryption)
+	}
+	if c.Options.S3SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(c.Options.S3SSEKMSKeyID)
+	}
+	if c.Options.S3ACL != "" {
+		input.ACL = aws.String(c.Options.S3ACL)
+	}
+	if c.Options.RetentionMode != "" {
+		input.ObjectLockMode = aws.String(strings.ToUpper(c.Options.RetentionMode))
+		input.ObjectLockRetainUntilDate = aws.Time(c.Options.RetainUntil)
+	}
+	_, err := uploader.Upload(input)
+
+	return err
+}
+
+// GetObjectRetentionFromS3 gets the object lock retention and legal hold of the current version of an object in S3
+func GetObjectRetentionFromS3(iClient interface{}, path string) (ObjectRetention, error) {
+	c := iClient.(*S3Client)
+	bucket, s3Path := initS3Variables(path)
+
+	output, err := s3.New(c.Session).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Path),
+	})
+	if err != nil {
+		return ObjectRetention{}, err
+	}
+	retention := ObjectRetention{LegalHold: aws.StringValue(output.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn}
+	if output.ObjectLockRetainUntilDate != nil {
+		retention.RetainUntil = *output.ObjectLockRetainUntilDate
+	}
+
+	return retention, nil
+}
+
+// DeleteFromS3 deletes a single file from S3
+// Files retained in compliance mode, or in governance mode without permissions to bypass it, can not be deleted
+func DeleteFromS3(iClient interface{}, path string, verbose bool) error {
+	c := iClient.(*S3Client)
+	bucket, s3Path := initS3Variables(path)
+
+	if verbose {
+		log.Printf("Deleting file s3://%s/%s", bucket, s3Path)
+	}
+	_, err := s3.New(c.Session).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Path),
+	})
+
+	return err
+}
+
+// getNewS3Session creates a session. Flags take precedence over the environment variables used by skbn
+func getNewS3Session(o StorageOptions) (*session.Session, error) {
+	awsConfig := &aws.Config{}
+
+	region := "eu-central-1"
+	if rg := os.Getenv("AWS_REGION"); rg != "" {
+		region = rg
+	}
+	awsConfig.Region = aws.String(region)
+
+	endpoint := os.Getenv("AWS_S3_ENDPOINT")
+	if o.S3Endpoint != "" {
+		endpoint = o.S3Endpoint
+	}
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+	}
+
+	if disSSL := os.Getenv("AWS_S3_NO_SSL"); disSSL != "" {
+		disableSSL, _ := strconv.ParseBool(disSSL)
+		awsConfig.DisableSSL = aws.Bool(disableSSL)
+	}
+
+	forcePathStyle, _ := strconv.ParseBool(os.Getenv("AWS_S3_FORCE_PATH_STYLE"))
+	if o.S3ForcePathStyle || forcePathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	return session.NewSession(awsConfig)
+}
+
+// testS3Options validates values which would otherwise only fail on the first upload
+func testS3Options(o StorageOptions) error {
+	if o.S3StorageClass != "" && !Contains(s3.StorageClass_Values(), o.S3StorageClass) {
+		return fmt.Errorf("illegal s3 storage class %s. must be one of: %s", o.S3StorageClass, strings.Join(s3.StorageClass_Values(), ", "))
+	}
+	if o.S3ServerSideEncryption != "" && !Contains(s3.ServerSideEncryption_Values(), o.S3ServerSideEncryption) {
+		return fmt.Errorf("illegal s3 server side encryption %s. must be one of: %s", o.S3ServerSideEncryption, strings.Join(s3.ServerSideEncryption_Values(), ", "))
+	}
+	if o.S3SSEKMSKeyID != "" && o.S3ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("s3 sse kms key id can only be used with server side encryption %s", s3.ServerSideEncryptionAwsKms)
+	}
+	if o.S3ACL != "" && !Contains(s3.ObjectCannedACL_Values(), o.S3ACL) {
+		return fmt.Errorf("illegal s3 acl %s. must be one of: %s", o.S3ACL, strings.Join(s3.ObjectCannedACL_Values(), ", "))
+	}
+	return nil
+}
+
+// initS3Variables splits an S3 path to bucket and key
+func initS3Variables(path string) (string, string) {
+	pSplit := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	if len(pSplit) == 1 {
+		return pSplit[0], ""
+	}
+	return pSplit[0], pSplit[1]
+}
@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuvo/skbn/pkg/skbn"
+)
+
+// Storage services not implemented by skbn are implemented here,
+// the rest of the actions are passed to skbn
+
+// StorageOptions are options of storage services, which are set on their clients
+type StorageOptions struct {
+	S3Endpoint             string
+	S3ForcePathStyle       bool
+	S3StorageClass         string
+	S3ServerSideEncryption string
+	S3SSEKMSKeyID          string
+	S3ACL                  string
+	// RetentionMode and RetainUntil make uploaded objects immutable (S3 Object Lock, azure blob immutability policies)
+	RetentionMode string
+	RetainUntil   time.Time
+	// Kubeconfig and KubeContext select the kubernetes cluster of k8s and pvc clients
+	Kubeconfig  string
+	KubeContext string
+}
+
+// TestImplementationsExist checks that implementations exist for the desired action
+func TestImplementationsExist(srcPrefix, dstPrefix string) error {
+	for _, prefix := range []string{srcPrefix, dstPrefix} {
+		switch prefix {
+		case "k8s":
+		case "s3":
+		case "abs":
+		case "gs":
+		case "file":
+		case "pvc":
+		default:
+			return fmt.Errorf(prefix + " not implemented")
+		}
+	}
+
+	return nil
+}
+
+// SplitDestination splits a destination url to prefix and path, and applies its query parameters to a copy of o
+// Supported parameters are endpoint and force-path-style of S3, to use different S3 services as destinations at once
+// Example: s3://bucket/cassandra?endpoint=https://minio.local:9000&force-path-style=true
+func SplitDestination(dst string, o StorageOptions) (string, string, StorageOptions, error) {
+	dst, query, _ := strings.Cut(dst, "?")
+	prefix, path := SplitInTwo(dst, "://")
+	if query == "" {
+		return prefix, path, o, nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", "", o, fmt.Errorf("could not parse parameters of %s: %s", dst, err)
+	}
+	for key := range values {
+		if prefix != "s3" {
+			return "", "", o, fmt.Errorf("parameters are not supported for " + prefix)
+		}
+		switch key {
+		case "endpoint":
+			o.S3Endpoint = values.Get(key)
+		case "force-path-style":
+			if o.S3ForcePathStyle, err = strconv.ParseBool(values.Get(key)); err != nil {
+				return "", "", o, fmt.Errorf("illegal value of %s in %s: %s", key, dst, err)
+			}
+		default:
+			return "", "", o, fmt.Errorf("unknown parameter %s in %s", key, dst)
+		}
+	}
+
+	return prefix, path, o, nil
+}
+
+// GetClients gets the clients for the source and destination
+// Options of uploaded objects are only set on the destination client
+func GetClients(srcPrefix, dstPrefix, srcPath, dstPath string, o StorageOptions) (interface{}, interface{}, error) {
+	srcOptions := StorageOptions{
+		S3Endpoint:       o.S3Endpoint,
+		S3ForcePathStyle: o.S3ForcePathStyle,
+		Kubeconfig:       o.Kubeconfig,
+		KubeContext:      o.KubeContext,
+	}
+	srcClient, err := GetClient(srcPrefix, srcPath, srcOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	dstClient, err := GetClient(dstPrefix, dstPath, o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return srcClient, dstClient, nil
+}
+
+// GetClient gets a tested client to a single storage service
+func GetClient(prefix, path string, o StorageOptions) (interface{}, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := testRetention(prefix, o); err != nil {
+		return nil, err
+	}
+
+	switch prefix {
+	case "k8s":
+		return GetClientToK8s(o.Kubeconfig, o.KubeContext)
+	case "s3":
+		return GetClientToS3(path, o)
+	case "abs":
+		return GetClientToAbs(ctx, path, o)
+	case "gs":
+		return GetClientToGcs(ctx, path)
+	case "file":
+		return GetClientToFile(path)
+	case "pvc":
+		return GetClientToPvc(path, o)
+	default:
+		return nil, fmt.Errorf(prefix + " not implemented")
+	}
+}
+
+// GetListOfFiles gets relative paths from the provided path
+func GetListOfFiles(client interface{}, prefix, path string) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	switch prefix {
+	case "s3":
+		return skbn.GetListOfFiles(client.(*S3Client).Session, prefix, path)
+	case "abs":
+		return skbn.GetListOfFiles(client.(*AbsClient).Pipeline, prefix, path)
+	case "gs":
+		return GetListOfFilesFromGcs(ctx, client, path)
+	case "file":
+		return GetListOfFilesFromFile(path)
+	case "pvc":
+		return GetListOfFilesFromPvc(client, path)
+	default:
+		return skbn.GetListOfFiles(client, prefix, path)
+	}
+}
+
+// GetListOfFilesWithSizes gets relative paths and sizes of files in path (recursive)
+func GetListOfFilesWithSizes(client interface{}, prefix, path string) (map[string]int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	switch prefix {
+	case "s3":
+		return GetListOfFilesWithSizesFromS3(client, path)
+	case "abs":
+		return GetListOfFilesWithSizesFromAbs(ctx, client, path)
+	case "gs":
+		return GetListOfFilesWithSizesFromGcs(ctx, client, path)
+	case "file":
+		return GetListOfFilesWithSizesFromFile(path)
+	case "pvc":
+		return GetListOfFilesWithSizesFromPvc(client, path)
+	default:
+		return nil, fmt.Errorf(prefix + " not implemented")
+	}
+}
+
+// Download downloads a single file from path into an io.Writer
+func Download(srcClient interface{}, srcPrefix, srcPath string, writer io.Writer, verbose bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	switch srcPrefix {
+	case "s3":
+		return skbn.Download(srcClient.(*S3Client).Session, srcPrefix, srcPath, writer, verbose)
+	case "abs":
+		return skbn.Download(srcClient.(*AbsClient).Pipeline, srcPrefix, srcPath, writer, verbose)
+	case "gs":
+		return DownloadFromGcs(ctx, srcClient, srcPath, writer, verbose)
+	case "file":
+		return DownloadFromFile(srcPath, writer, verbose)
+	case "pvc":
+		return DownloadFromPvc(srcClient, srcPath, writer, verbose)
+	default:
+		return skbn.Download(srcClient, srcPrefix, srcPath, writer, verbose)
+	}
+}
+
+// Upload uploads a single file provided as an io.Reader to path
+func Upload(dstClient interface{}, dstPrefix, dstPath, srcPath string, reader io.Reader, s3partSize int64, s3maxUploadParts int, verbose bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	switch dstPrefix {
+	case "s3":
+		return UploadToS3(dstClient, dstPath, srcPath, reader, s3partSize, s3maxUploadParts, verbose)
+	case "abs":
+		return UploadToAbs(ctx, dstClient, dstPath, srcPath, reader, verbose)
+	case "gs":
+		return UploadToGcs(ctx, dstClient, dstPath, srcPath, reader, verbose)
+	case "file":
+		return UploadToFile(dstPath, srcPath, reader, verbose)
+	case "pvc":
+		return UploadToPvc(dstClient, dstPath, srcPath, reader, verbose)
+	default:
+		return skbn.Upload(dstClient, dstPrefix, dstPath, srcPath, reader, s3partSize, s3maxUploadParts, verbose)
+	}
+}
+
+// Delete deletes a single file
+func Delete(iClient interface{}, prefix, path string, verbose bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	switch prefix {
+	case "s3":
+		return DeleteFromS3(iClient, path, verbose)
+	case "abs":
+		return DeleteFromAbs(ctx, iClient, path, verbose)
+	case "gs":
+		return DeleteFromGcs(ctx, iClient, path, verbose)
+	case "file":
+		return DeleteFromFile(path, verbose)
+	case "pvc":
+		return DeleteFromPvc(iClient, path, verbose)
+	default:
+		return fmt.Errorf("delete is not supported for " + prefix)
+	}
+}
+
+// dirPrefix returns a path with a single trailing slash, so only objects under the directory match it
+func dirPrefix(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return path + "/"
+}
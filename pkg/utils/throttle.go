@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// maxThrottleBurst is the largest amount of bytes read at once by a throttled reader
+const maxThrottleBurst = 1024 * 1024
+
+// BandwidthLimiter limits the bandwidth of copies, in total and per pod
+// A nil BandwidthLimiter does not limit anything
+type BandwidthLimiter struct {
+	total     *rate.Limiter
+	podLimit  float64
+	pods      map[string]*rate.Limiter
+	podsMutex sync.Mutex
+}
+
+// NewBandwidthLimiter returns a BandwidthLimiter, limits are in MB/s and 0 means unlimited
+// Returns nil if both limits are 0
+func NewBandwidthLimiter(maxBandwidth, maxPodBandwidth float64) *BandwidthLimiter {
+	if maxBandwidth <= 0 && maxPodBandwidth <= 0 {
+		return nil
+	}
+
+	return &BandwidthLimiter{
+		total:    newLimiter(maxBandwidth),
+		podLimit: maxPodBandwidth,
+		pods:     make(map[string]*rate.Limiter),
+	}
+}
+
+// Transform returns a StreamTransform which throttles a stream to and from pod
+// pod may be empty if the stream is not related to a pod, in which case only the total limit applies
+func (l *BandwidthLimiter) Transform(pod string) StreamTransform {
+	if l == nil {
+		return nil
+	}
+
+	var limiters []*rate.Limiter
+	if l.total != nil {
+		limiters = append(limiters, l.total)
+	}
+	if podLimiter := l.podLimiter(pod); podLimiter != nil {
+		limiters = append(limiters, podLimiter)
+	}
+	if len(limiters) == 0 {
+		return nil
+	}
+
+	return func(r io.Reader) (io.Reader, error) {
+		return &throttledReader{src: r, limiters: limiters}, nil
+	}
+}
+
+// podLimiter gets the limiter shared by all streams of a pod
+func (l *BandwidthLimiter) podLimiter(pod string) *rate.Limiter {
+	if pod == "" || l.podLimit <= 0 {
+		return nil
+	}
+	l.podsMutex.Lock()
+	defer l.podsMutex.Unlock()
+
+	if _, ok := l.pods[pod]; !ok {
+		l.pods[pod] = newLimiter(l.podLimit)
+	}
+	return l.pods[pod]
+}
+
+// newLimiter returns a limiter of mbps MB/s, or nil if mbps is 0
+func newLimiter(mbps float64) *rate.Limiter {
+	if mbps <= 0 {
+		return nil
+	}
+	bytesPerSecond := mbps * 1024 * 1024
+	burst := int(math.Max(1, math.Min(bytesPerSecond, maxThrottleBurst)))
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// throttledReader waits for all of its limiters after every read
+type throttledReader struct {
+	src      io.Reader
+	limiters []*rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	for _, limiter := range t.limiters {
+		if len(p) > limiter.Burst() {
+			p = p[:limiter.Burst()]
+		}
+	}
+	n, err := t.src.Read(p)
+	for _, limiter := range t.limiters {
+		if waitErr := limiter.WaitN(context.Background(), n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
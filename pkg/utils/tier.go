@@ -0,0 +1,307 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Rehydration states of objects
+const (
+	// RehydrationNotRequired objects can be downloaded
+	RehydrationNotRequired = "not-required"
+	// RehydrationRequired objects are archived, and must be rehydrated before they can be downloaded
+	RehydrationRequired = "required"
+	// RehydrationPending objects are being rehydrated
+	RehydrationPending = "pending"
+)
+
+const (
+	// s3MaxCopySize is the largest object S3 can copy in a single request
+	s3MaxCopySize = 5 * 1024 * 1024 * 1024
+	// s3CopyPartSize is the size of parts of multipart copies
+	s3CopyPartSize = 512 * 1024 * 1024
+)
+
+// archivedStorageClasses are the storage classes of objects which must be rehydrated before they can be downloaded
+var archivedStorageClasses = map[string][]string{
+	"s3":  {s3.StorageClassGlacier, s3.StorageClassDeepArchive},
+	"abs": {string(azblob.AccessTierArchive)},
+}
+
+// TestStorageClass checks that a storage class exists in a storage service
+func TestStorageClass(prefix, class string) error {
+	var classes []string
+	switch prefix {
+	case "s3":
+		classes = s3.StorageClass_Values()
+	case "abs":
+		classes = []string{string(azblob.AccessTierHot), string(azblob.AccessTierCool), string(azblob.AccessTierArchive)}
+	default:
+		return fmt.Errorf("storage classes are not supported for " + prefix)
+	}
+	if !Contains(classes, class) {
+		return fmt.Errorf("illegal storage class %s. must be one of: %s", class, strings.Join(classes, ", "))
+	}
+
+	return nil
+}
+
+// IsArchivedStorageClass returns true if objects of a storage class must be rehydrated before they can be downloaded
+func IsArchivedStorageClass(prefix, class string) bool {
+	return Contains(archivedStorageClasses[prefix], class)
+}
+
+// GetStorageClasses gets relative paths and storage classes of files in path (recursive)
+func GetStorageClasses(iClient interface{}, prefix, path string) (map[string]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	switch prefix {
+	case "s3":
+		return getStorageClassesFromS3(iClient, path)
+	case "abs":
+		return getStorageClassesFromAbs(ctx, iClient, path)
+	default:
+		return nil, fmt.Errorf("storage classes are not supported for " + prefix)
+	}
+}
+
+// SetStorageClass moves a single object to a storage class
+func SetStorageClass(iClient interface{}, prefix, path, class string, verbose bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if verbose {
+		log.Printf("Moving %s://%s to %s", prefix, path, class)
+	}
+	switch prefix {
+	case "s3":
+		return setStorageClassInS3(iClient, path, class)
+	case "abs":
+		_, err := getBlobURL(iClient, path).SetTier(ctx, azblob.AccessTierType(class), azblob.LeaseAccessConditions{}, azblob.RehydratePriorityNone)
+		return err
+	default:
+		return fmt.Errorf("storage classes are not supported for " + prefix)
+	}
+}
+
+// GetRehydrationState gets the rehydration state of a single object in an archived storage class
+func GetRehydrationState(iClient interface{}, prefix, path string) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	switch prefix {
+	case "s3":
+		bucket, s3Path := initS3Variables(path)
+		head, err := s3.New(iClient.(*S3Client).Session).HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(s3Path),
+		})
+		if err != nil {
+			return "", err
+		}
+		if !IsArchivedStorageClass(prefix, aws.StringValue(head.StorageClass)) {
+			return RehydrationNotRequired, nil
+		}
+		// x-amz-restore: ongoing-request="false", expiry-date="..." once a restored copy is available
+		restore := aws.StringValue(head.Restore)
+		switch {
+		case restore == "":
+			return RehydrationRequired, nil
+		case strings.Contains(restore, `ongoing-request="true"`):
+			return RehydrationPending, nil
+		default:
+			return RehydrationNotRequired, nil
+		}
+	case "abs":
+		props, err := getBlobURL(iClient, path).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return "", err
+		}
+		if props.AccessTier() != string(azblob.AccessTierArchive) {
+			return RehydrationNotRequired, nil
+		}
+		if strings.HasPrefix(props.ArchiveStatus(), "rehydrate-pending") {
+			return RehydrationPending, nil
+		}
+		return RehydrationRequired, nil
+	default:
+		return RehydrationNotRequired, nil
+	}
+}
+
+// Rehydrate starts the rehydration of a single archived object
+// S3 objects are restored to a temporary copy for days, azure blobs are moved to the hot tier
+func Rehydrate(iClient interface{}, prefix, path string, days int, verbose bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if verbose {
+		log.Printf("Rehydrating %s://%s", prefix, path)
+	}
+	switch prefix {
+	case "s3":
+		bucket, s3Path := initS3Variables(path)
+		_, err := s3.New(iClient.(*S3Client).Session).RestoreObject(&s3.RestoreObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(s3Path),
+			RestoreRequest: &s3.RestoreRequest{
+				Days:                 aws.Int64(int64(days)),
+				GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(s3.TierStandard)},
+			},
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+			return nil
+		}
+		return err
+	case "abs":
+		_, err := getBlobURL(iClient, path).SetTier(ctx, azblob.AccessTierHot, azblob.LeaseAccessConditions{}, azblob.RehydratePriorityStandard)
+		return err
+	default:
+		return fmt.Errorf("rehydration is not supported for " + prefix)
+	}
+}
+
+// getStorageClassesFromS3 gets relative paths and storage classes of files in path from S3 (recursive)
+func getStorageClassesFromS3(iClient interface{}, path string) (map[string]string, error) {
+	c := iClient.(*S3Client)
+	bucket, s3Path := initS3Variables(path)
+	s3Prefix := dirPrefix(s3Path)
+
+	classes := make(map[string]string)
+	err := s3.New(c.Session).ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(s3Prefix),
+	}, func(p *s3.ListObjectsOutput, last bool) (shouldContinue bool) {
+		for _, obj := range p.Contents {
+			classes[strings.TrimPrefix(*obj.Key, s3Prefix)] = aws.StringValue(obj.StorageClass)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return classes, nil
+}
+
+// getStorageClassesFromAbs gets relative paths and access tiers of files in path from azure blob storage (recursive)
+func getStorageClassesFromAbs(ctx context.Context, iClient interface{}, path string) (map[string]string, error) {
+	account, container, absPath := initAbsVariables(path)
+	cu, err := getContainerURL(iClient.(*AbsClient).Pipeline, account, container)
+	if err != nil {
+		return nil, err
+	}
+	absPrefix := dirPrefix(absPath)
+
+	classes := make(map[string]string)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := cu.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: absPrefix})
+		if err != nil {
+			return nil, err
+		}
+		marker = listBlob.NextMarker
+
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			classes[strings.TrimPrefix(blobInfo.Name, absPrefix)] = string(blobInfo.Properties.AccessTier)
+		}
+	}
+
+	return classes, nil
+}
+
+// setStorageClassInS3 copies an object onto itself in a storage class, keeping its metadata and encryption
+// The ACL of the client is set on the copy, since S3 does not copy ACLs
+func setStorageClassInS3(iClient interface{}, path, class string) error {
+	c := iClient.(*S3Client)
+	svc := s3.New(c.Session)
+	bucket, s3Path := initS3Variables(path)
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Path),
+	})
+	if err != nil {
+		return err
+	}
+	copySource := url.PathEscape(bucket) + "/" + (&url.URL{Path: s3Path}).EscapedPath()
+	var acl *string
+	if c.Options.S3ACL != "" {
+		acl = aws.String(c.Options.S3ACL)
+	}
+
+	if aws.Int64Value(head.ContentLength) <= s3MaxCopySize {
+		_, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(s3Path),
+			CopySource:           aws.String(copySource),
+			StorageClass:         aws.String(class),
+			MetadataDirective:    aws.String(s3.MetadataDirectiveCopy),
+			ServerSideEncryption: head.ServerSideEncryption,
+			SSEKMSKeyId:          head.SSEKMSKeyId,
+			ACL:                  acl,
+		})
+		return err
+	}
+
+	// Objects larger than 5GB are copied in parts
+	upload, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(s3Path),
+		StorageClass:         aws.String(class),
+		ContentType:          head.ContentType,
+		Metadata:             head.Metadata,
+		ServerSideEncryption: head.ServerSideEncryption,
+		SSEKMSKeyId:          head.SSEKMSKeyId,
+		ACL:                  acl,
+	})
+	if err != nil {
+		return err
+	}
+	var parts []*s3.CompletedPart
+	size := aws.Int64Value(head.ContentLength)
+	for start, part := int64(0), int64(1); start < size; start, part = start+s3CopyPartSize, part+1 {
+		end := start + s3CopyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		output, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(s3Path),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:      aws.Int64(part),
+			UploadId:        upload.UploadId,
+		})
+		if err != nil {
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(bucket), Key: aws.String(s3Path), UploadId: upload.UploadId})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: aws.Int64(part)})
+	}
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(s3Path),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+
+	return err
+}
+
+// getBlobURL returns the url of a single blob in azure blob storage
+func getBlobURL(iClient interface{}, path string) azblob.BlobURL {
+	account, container, absPath := initAbsVariables(path)
+	// The url of a container is always valid
+	cu, _ := getContainerURL(iClient.(*AbsClient).Pipeline, account, container)
+
+	return cu.NewBlobURL(absPath)
+}